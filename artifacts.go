@@ -0,0 +1,398 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+
+	rcl_interfaces_msg "github.com/tiiuae/mission-data-recorder/msgs/rcl_interfaces/msg"
+	rcl_interfaces_srv "github.com/tiiuae/mission-data-recorder/msgs/rcl_interfaces/srv"
+	"github.com/tiiuae/rclgo/pkg/rclgo"
+)
+
+// artifactsDirName is the name of the subdirectory of the destination
+// directory where artifacts are stored until they have been uploaded. Each
+// artifact is stored in its own directory as artifactFileName, so that the
+// extensions added by processing can be told apart from its original name.
+const artifactsDirName = "artifacts"
+
+const artifactFileName = "artifact"
+
+// defaultArtifactKind is the kind of artifacts submitted without a kind.
+const defaultArtifactKind = "file"
+
+var artifactRegex = regexp.MustCompile(`^` + artifactFileName + `(` + bagExtensionsPattern() + `)$`)
+
+// artifactInfo describes an artifact in its manifest.
+type artifactInfo struct {
+	// Kind is the kind of the artifact, e.g. core dump. Artifacts found in
+	// watched directories have the name of the directory as their kind.
+	Kind string `json:"kind"`
+	// Name is the original name of the artifact file.
+	Name string `json:"name"`
+}
+
+// newArtifactMetadata returns the metadata of the artifact at path or nil if
+// path isn't an artifact.
+func newArtifactMetadata(path string, isNew bool) *bagMetadata {
+	matches := artifactRegex.FindStringSubmatch(filepath.Base(path))
+	if matches == nil || filepath.Base(filepath.Dir(filepath.Dir(path))) != artifactsDirName {
+		return nil
+	}
+	return &bagMetadata{
+		path:     filepath.Join(filepath.Dir(path), artifactFileName),
+		ext:      matches[1],
+		isNew:    isNew,
+		artifact: true,
+	}
+}
+
+// watchedFile is the state of a file in a watched directory when it was last
+// scanned.
+type watchedFile struct {
+	size    int64
+	modTime time.Time
+	// changed is the time when the size or modification time of the file was
+	// last seen to change.
+	changed time.Time
+	// failed is true if collecting the file failed. It is retried when the
+	// file changes.
+	failed bool
+}
+
+// artifactCollector moves files found in watched directories and files
+// submitted using the ~/upload_artifact service to the artifacts directory
+// and passes them to AddArtifact. The service has the type
+// rcl_interfaces/srv/SetParameters. The string parameter "path" is the
+// absolute path of the file, the optional string parameter "kind" is the kind
+// of the artifact and if the optional bool parameter "remove" is true, the
+// file is moved instead of copied. Only files in ServiceDirs and RemovableDirs
+// can be submitted, and only files in RemovableDirs can be moved.
+type artifactCollector struct {
+	// Dir is the directory where artifacts are stored.
+	Dir string
+	// WatchDirs are polled for new files every PollInterval. Files are
+	// collected after their size and modification time haven't changed for
+	// SettleTime, so that files which are still being written are skipped.
+	// Collected files are removed from the watched directories.
+	WatchDirs    []string
+	PollInterval time.Duration
+	SettleTime   time.Duration
+	// AddArtifact is called with each collected artifact.
+	AddArtifact func(*bagMetadata)
+	// ServiceDirs are the directories, in addition to RemovableDirs, from
+	// which files can be copied using the service.
+	ServiceDirs []string
+	// RemovableDirs are the directories from which files can be moved using
+	// the service. They are the watched directories and the ULog directory.
+	RemovableDirs []string
+
+	logger      logger
+	diagnostics *diagnosticsMonitor
+	service     *rcl_interfaces_srv.SetParametersService
+
+	// Files in the watched directories. Accessed only by Run.
+	files map[string]*watchedFile
+}
+
+func newArtifactCollector(
+	node *rclgo.Node,
+	destDir string,
+	watchDirs []string,
+	serviceDirs []string,
+	ulogDir string,
+	addArtifact func(*bagMetadata),
+	diagnostics *diagnosticsMonitor,
+) (c *artifactCollector, err error) {
+	c = &artifactCollector{
+		Dir:          filepath.Join(destDir, artifactsDirName),
+		WatchDirs:    watchDirs,
+		PollInterval: 5 * time.Second,
+		SettleTime:   10 * time.Second,
+		AddArtifact:  addArtifact,
+		ServiceDirs:  serviceDirs,
+		logger:       node.Logger(),
+		diagnostics:  diagnostics,
+		files:        make(map[string]*watchedFile),
+	}
+	c.RemovableDirs = append(c.RemovableDirs, watchDirs...)
+	if ulogDir != "" {
+		c.RemovableDirs = append(c.RemovableDirs, ulogDir)
+	}
+	c.service, err = rcl_interfaces_srv.NewSetParametersService(node, "~/upload_artifact", nil, c.onRequest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create service: %w", err)
+	}
+	return c, nil
+}
+
+func (c *artifactCollector) Close() error {
+	return c.service.Close()
+}
+
+// Run collects the files in the watched directories until ctx is done.
+func (c *artifactCollector) Run(ctx context.Context) error {
+	if len(c.WatchDirs) == 0 {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	ticker := time.NewTicker(c.PollInterval)
+	defer ticker.Stop()
+	for {
+		c.scan(time.Now())
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// scan collects the files in the watched directories which haven't changed
+// for SettleTime.
+func (c *artifactCollector) scan(now time.Time) {
+	found := make(map[string]bool)
+	for _, dir := range c.WatchDirs {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			c.logger.Errorf("failed to read artifact directory '%s': %v", dir, err)
+			c.diagnostics.ReportError("artifacts", err)
+			continue
+		}
+		for _, e := range entries {
+			info, err := e.Info()
+			if err != nil || !info.Mode().IsRegular() {
+				continue
+			}
+			path := filepath.Join(dir, e.Name())
+			found[path] = true
+			f := settledFile(c.files, path, info, now, c.SettleTime)
+			if f == nil {
+				continue
+			}
+			artifact, err := c.Collect(path, filepath.Base(dir), true)
+			if err != nil {
+				c.logger.Errorf("failed to collect artifact '%s': %v", path, err)
+				c.diagnostics.ReportError("artifacts", err)
+				f.failed = true
+				continue
+			}
+			delete(c.files, path)
+			c.AddArtifact(artifact)
+		}
+	}
+	pruneWatchedFiles(c.files, found)
+}
+
+// settledFile updates the state of the file at path in files and returns it
+// if its size and modification time haven't changed for settleTime and
+// collecting it hasn't failed. Otherwise nil is returned.
+func settledFile(
+	files map[string]*watchedFile, path string, info fs.FileInfo, now time.Time, settleTime time.Duration,
+) *watchedFile {
+	f := files[path]
+	if f == nil || f.size != info.Size() || !f.modTime.Equal(info.ModTime()) {
+		files[path] = &watchedFile{size: info.Size(), modTime: info.ModTime(), changed: now}
+		return nil
+	}
+	if f.failed || now.Sub(f.changed) < settleTime {
+		return nil
+	}
+	return f
+}
+
+// pruneWatchedFiles removes the files which weren't found in the last scan.
+func pruneWatchedFiles(files map[string]*watchedFile, found map[string]bool) {
+	for path := range files {
+		if !found[path] {
+			delete(files, path)
+		}
+	}
+}
+
+// Collect stores the file at path as an artifact of the given kind. If remove
+// is true, the file is moved, otherwise it is copied.
+func (c *artifactCollector) Collect(path, kind string, remove bool) (*bagMetadata, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, errors.New("not a regular file")
+	}
+	return c.store(path, &bagManifest{
+		RecordStartTime: info.ModTime().UTC(),
+		Artifact:        &artifactInfo{Kind: kind, Name: filepath.Base(path)},
+	}, remove)
+}
+
+// store stores the file at path as an artifact with the given manifest. If
+// remove is true, the file is moved, otherwise it is copied.
+func (c *artifactCollector) store(path string, manifest *bagManifest, remove bool) (_ *bagMetadata, err error) {
+	//#nosec G301 -- The directory doesn't contain secrets.
+	if err = os.MkdirAll(c.Dir, 0o755); err != nil {
+		return nil, err
+	}
+	dir, err := os.MkdirTemp(c.Dir, time.Now().UTC().Format(timeFormat)+"_*")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(dir)
+		}
+	}()
+	artifact := &bagMetadata{path: filepath.Join(dir, artifactFileName), isNew: true, artifact: true}
+	if err = saveBagManifest(artifact, manifest); err != nil {
+		return nil, err
+	}
+	if remove {
+		err = os.Rename(path, artifact.path)
+		if err == nil {
+			return artifact, nil
+		} else if !errors.Is(err, syscall.EXDEV) {
+			return nil, err
+		}
+	}
+	// The artifact is written to a temporary file first, so that a partial
+	// copy is never uploaded.
+	err = writeFileAtomic(artifact.path, func(w io.Writer) error {
+		//#nosec G304 -- The path is given by the user.
+		src, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		_, err = io.Copy(w, src)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if remove {
+		if err := os.Remove(path); err != nil {
+			c.logger.Errorf("failed to remove collected artifact '%s': %v", path, err)
+		}
+	}
+	return artifact, nil
+}
+
+// artifactRequest is a request to collect an artifact.
+type artifactRequest struct {
+	Path   string
+	Kind   string
+	Remove bool
+}
+
+func artifactRequestFromParameters(params []rcl_interfaces_msg.Parameter) (*artifactRequest, error) {
+	req := &artifactRequest{Kind: defaultArtifactKind}
+	for _, p := range params {
+		switch p.Name {
+		case "path":
+			if p.Value.Type != rcl_interfaces_msg.ParameterType_PARAMETER_STRING {
+				return nil, errors.New("'path' must be a string")
+			}
+			req.Path = p.Value.StringValue
+		case "kind":
+			if p.Value.Type != rcl_interfaces_msg.ParameterType_PARAMETER_STRING {
+				return nil, errors.New("'kind' must be a string")
+			}
+			req.Kind = p.Value.StringValue
+		case "remove":
+			if p.Value.Type != rcl_interfaces_msg.ParameterType_PARAMETER_BOOL {
+				return nil, errors.New("'remove' must be a bool")
+			}
+			req.Remove = p.Value.BoolValue
+		default:
+			return nil, fmt.Errorf("unknown parameter '%s'", p.Name)
+		}
+	}
+	if !filepath.IsAbs(req.Path) {
+		return nil, errors.New("'path' must be an absolute path")
+	}
+	if req.Kind == "" || strings.ContainsAny(req.Kind, `/\`) {
+		return nil, errors.New("'kind' must be a non-empty name")
+	}
+	return req, nil
+}
+
+// checkRequest resolves the symbolic links in the path of req and checks that
+// the file may be collected.
+func (c *artifactCollector) checkRequest(req *artifactRequest) error {
+	path, err := filepath.EvalSymlinks(req.Path)
+	if err != nil {
+		return err
+	}
+	if req.Remove {
+		if !inAnyDir(path, c.RemovableDirs) {
+			return errors.New("'path' is not in a directory whose files can be removed")
+		}
+	} else if !inAnyDir(path, c.ServiceDirs) && !inAnyDir(path, c.RemovableDirs) {
+		return errors.New("'path' is not in an allowed directory")
+	}
+	req.Path = path
+	return nil
+}
+
+// inAnyDir reports whether path, whose symbolic links have been resolved, is
+// in one of dirs or their subdirectories.
+func inAnyDir(path string, dirs []string) bool {
+	for _, dir := range dirs {
+		dir, err := filepath.EvalSymlinks(dir)
+		if err != nil {
+			continue
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err == nil && rel != "." && rel != ".." &&
+			!strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *artifactCollector) onRequest(
+	info *rclgo.RmwServiceInfo,
+	req *rcl_interfaces_srv.SetParameters_Request,
+	sender rcl_interfaces_srv.SetParametersServiceResponseSender,
+) {
+	var result rcl_interfaces_msg.SetParametersResult
+	ar, err := artifactRequestFromParameters(req.Parameters)
+	if err == nil {
+		err = c.checkRequest(ar)
+	}
+	if err != nil {
+		result.Reason = err.Error()
+	} else {
+		result.Successful = true
+		// Copying a large file would block the executor, so the response is
+		// sent when the request has been accepted.
+		go c.collectRequested(ar)
+	}
+	resp := rcl_interfaces_srv.NewSetParameters_Response()
+	for range req.Parameters {
+		resp.Results = append(resp.Results, result)
+	}
+	if err := sender.SendResponse(resp); err != nil {
+		c.logger.Errorf("failed to send response: %v", err)
+	}
+}
+
+func (c *artifactCollector) collectRequested(req *artifactRequest) {
+	artifact, err := c.Collect(req.Path, req.Kind, req.Remove)
+	if err != nil {
+		c.logger.Errorf("failed to collect artifact '%s': %v", req.Path, err)
+		c.diagnostics.ReportError("artifacts", err)
+		return
+	}
+	c.logger.Infof("artifact '%s' collected", req.Path)
+	c.AddArtifact(artifact)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	rcl_interfaces_msg "github.com/tiiuae/mission-data-recorder/msgs/rcl_interfaces/msg"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestArtifacts(t *testing.T) {
+	Convey("Scenario: files in watched directories are collected after they have settled", t, func() {
+		root := t.TempDir()
+		watchDir := filepath.Join(root, "coredumps")
+		So(os.Mkdir(watchDir, 0o700), ShouldBeNil)
+		var collected []*bagMetadata
+		c := &artifactCollector{
+			Dir:         filepath.Join(root, "dest", artifactsDirName),
+			WatchDirs:   []string{watchDir},
+			SettleTime:  time.Minute,
+			AddArtifact: func(a *bagMetadata) { collected = append(collected, a) },
+			logger:      fakeLogger{},
+			files:       make(map[string]*watchedFile),
+		}
+		src := filepath.Join(watchDir, "core.1234")
+		So(os.WriteFile(src, []byte("core"), 0o600), ShouldBeNil)
+		now := time.Now()
+		c.scan(now)
+		c.scan(now.Add(30 * time.Second))
+		So(collected, ShouldBeEmpty)
+		c.scan(now.Add(time.Minute))
+		So(collected, ShouldHaveLength, 1)
+		So(collected[0].artifact, ShouldBeTrue)
+		So(newArtifactMetadata(collected[0].filePath(), true), ShouldResemble, collected[0])
+		_, err := os.Stat(src)
+		So(os.IsNotExist(err), ShouldBeTrue)
+		data, err := os.ReadFile(collected[0].filePath())
+		So(err, ShouldBeNil)
+		So(string(data), ShouldEqual, "core")
+		manifest, err := loadBagManifest(collected[0])
+		So(err, ShouldBeNil)
+		So(manifest.Artifact, ShouldResemble, &artifactInfo{Kind: "coredumps", Name: "core.1234"})
+		So(uploadName(collected[0], manifest), ShouldEqual, manifest.RecordStartTime.Format(timeFormat)+"_core.1234")
+	})
+	Convey("Scenario: submitted files are copied unless they are removed", t, func() {
+		root := t.TempDir()
+		c := &artifactCollector{Dir: filepath.Join(root, artifactsDirName), logger: fakeLogger{}}
+		src := filepath.Join(root, "snapshot.jpg")
+		So(os.WriteFile(src, []byte("jpg"), 0o600), ShouldBeNil)
+		a, err := c.Collect(src, "camera", false)
+		So(err, ShouldBeNil)
+		_, err = os.Stat(src)
+		So(err, ShouldBeNil)
+		_, err = c.Collect(src, "camera", true)
+		So(err, ShouldBeNil)
+		_, err = os.Stat(src)
+		So(os.IsNotExist(err), ShouldBeTrue)
+		_, err = c.Collect(src, "camera", true)
+		So(err, ShouldBeError)
+		entries, err := os.ReadDir(c.Dir)
+		So(err, ShouldBeNil)
+		So(entries, ShouldHaveLength, 2)
+		So(filepath.Dir(a.path), ShouldStartWith, c.Dir)
+	})
+	Convey("Scenario: artifact requests are validated", t, func() {
+		str := func(name, value string) rcl_interfaces_msg.Parameter {
+			return rcl_interfaces_msg.Parameter{Name: name, Value: rcl_interfaces_msg.ParameterValue{
+				Type: rcl_interfaces_msg.ParameterType_PARAMETER_STRING, StringValue: value,
+			}}
+		}
+		req, err := artifactRequestFromParameters([]rcl_interfaces_msg.Parameter{
+			str("path", "/var/log/px4.ulg"),
+			{Name: "remove", Value: rcl_interfaces_msg.ParameterValue{
+				Type: rcl_interfaces_msg.ParameterType_PARAMETER_BOOL, BoolValue: true,
+			}},
+		})
+		So(err, ShouldBeNil)
+		So(*req, ShouldResemble, artifactRequest{Path: "/var/log/px4.ulg", Kind: defaultArtifactKind, Remove: true})
+		_, err = artifactRequestFromParameters([]rcl_interfaces_msg.Parameter{str("path", "px4.ulg")})
+		So(err, ShouldBeError)
+		_, err = artifactRequestFromParameters([]rcl_interfaces_msg.Parameter{str("path", "/a"), str("kind", "../x")})
+		So(err, ShouldBeError)
+		_, err = artifactRequestFromParameters([]rcl_interfaces_msg.Parameter{str("path", "/a"), str("size", "1")})
+		So(err, ShouldBeError)
+	})
+	Convey("Scenario: only files in allowed directories can be submitted", t, func() {
+		root := t.TempDir()
+		serviceDir := filepath.Join(root, "logs")
+		watchDir := filepath.Join(root, "coredumps")
+		for _, dir := range []string{serviceDir, watchDir} {
+			So(os.Mkdir(dir, 0o700), ShouldBeNil)
+			So(os.WriteFile(filepath.Join(dir, "file"), nil, 0o600), ShouldBeNil)
+		}
+		secret := filepath.Join(root, "secret")
+		So(os.WriteFile(secret, nil, 0o600), ShouldBeNil)
+		So(os.Symlink(secret, filepath.Join(serviceDir, "link")), ShouldBeNil)
+		c := &artifactCollector{ServiceDirs: []string{serviceDir}, RemovableDirs: []string{watchDir}}
+
+		req := &artifactRequest{Path: filepath.Join(serviceDir, "file")}
+		So(c.checkRequest(req), ShouldBeNil)
+		req.Remove = true
+		So(c.checkRequest(req), ShouldBeError)
+		req = &artifactRequest{Path: filepath.Join(watchDir, "file"), Remove: true}
+		So(c.checkRequest(req), ShouldBeNil)
+		So(c.checkRequest(&artifactRequest{Path: secret}), ShouldBeError)
+		So(c.checkRequest(&artifactRequest{Path: filepath.Join(serviceDir, "..", "secret")}), ShouldBeError)
+		So(c.checkRequest(&artifactRequest{Path: filepath.Join(serviceDir, "link")}), ShouldBeError)
+		So(c.checkRequest(&artifactRequest{Path: serviceDir}), ShouldBeError)
+	})
+	Convey("Scenario: stored artifacts are uploaded without sessions", t, func() {
+		root := t.TempDir()
+		c := &artifactCollector{Dir: filepath.Join(root, artifactsDirName), logger: fakeLogger{}}
+		src := filepath.Join(t.TempDir(), "crash.log")
+		So(os.WriteFile(src, []byte("crash"), 0o600), ShouldBeNil)
+		a, err := c.Collect(src, "crash", false)
+		So(err, ShouldBeNil)
+
+		uploader := &sessionUploader{}
+		m := newUploadManager(2, uploader, fakeLogger{}, nil)
+		So(m.LoadExistingBags(context.Background(), root), ShouldBeNil)
+		m.StartAllWorkers(context.Background())
+		m.Wait()
+
+		So(uploader.uploaded, ShouldResemble, []string{a.path})
+		So(uploader.sessions, ShouldBeEmpty)
+		entries, err := os.ReadDir(c.Dir)
+		So(err, ShouldBeNil)
+		So(entries, ShouldBeEmpty)
+	})
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/tiiuae/mission-data-recorder/internal/rosbag"
+	"gopkg.in/yaml.v3"
+)
+
+// quarantineDirName is the name of the directory in the destination directory
+// where bags which can't be recovered are moved.
+const quarantineDirName = "quarantine"
+
+// errBagRemoved is returned by bag processors if the bag was removed from the
+// destination directory and must not be uploaded.
+var errBagRemoved = errors.New("bag was removed")
+
+// bagValidator checks the integrity of completed bags. The write-ahead log of a
+// bag is checkpointed in case the recorder was killed before it could do it.
+// Corrupted bags are recovered by copying the readable messages to a new bag.
+// Bags which can't be recovered are moved to the quarantine directory. Missing
+// metadata.yaml files of bags loaded from disk are rebuilt.
+type bagValidator struct {
+	// Dir is the destination directory of the recorder.
+	Dir string
+
+	logger      logger
+	diagnostics *diagnosticsMonitor
+
+	mu sync.Mutex
+	// +checklocks:mu
+	quarantined int
+}
+
+func newBagValidator(dir string, logger logger, diagnostics *diagnosticsMonitor) *bagValidator {
+	return &bagValidator{
+		Dir:         dir,
+		logger:      logger,
+		diagnostics: diagnostics,
+	}
+}
+
+func (v *bagValidator) ProcessBag(ctx context.Context, bag *bagMetadata) error {
+	// Processed bags and other storage formats can't be checked.
+	if bag.ext != "" || bag.storageExt() != storageExtensions[storageSQLite3] {
+		return nil
+	}
+	err := validateBag(ctx, bag.path)
+	if errors.Is(err, rosbag.ErrCorrupt) {
+		v.logger.Errorf("bag '%s' is corrupted, trying to recover it: %v", bag.path, err)
+		if err = v.recoverBag(ctx, bag.path); err == nil {
+			err = validateBag(ctx, bag.path)
+		} else {
+			err = fmt.Errorf("%w: %v", rosbag.ErrCorrupt, err)
+		}
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if errors.Is(err, rosbag.ErrCorrupt) {
+		return v.quarantine(bag, err)
+	} else if err != nil {
+		return err
+	}
+	if !bag.isNew {
+		if err := v.rebuildMetadata(ctx, filepath.Dir(bag.path)); err != nil {
+			v.logger.Errorf("failed to rebuild metadata of '%s': %v", filepath.Dir(bag.path), err)
+		}
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	// Quarantined bags are reported until the recorder is restarted.
+	if v.quarantined == 0 {
+		v.diagnostics.ReportSuccess("bag validator", "ok")
+	}
+	return nil
+}
+
+func validateBag(ctx context.Context, path string) error {
+	bag, err := rosbag.Open(path)
+	if err != nil {
+		return err
+	}
+	defer bag.Close()
+	if err = bag.Checkpoint(ctx); err != nil {
+		return fmt.Errorf("%w: %v", rosbag.ErrCorrupt, err)
+	}
+	return bag.CheckIntegrity(ctx)
+}
+
+func (v *bagValidator) recoverBag(ctx context.Context, path string) error {
+	tmpPath := path + ".recovered"
+	n, err := rosbag.Recover(ctx, path, tmpPath)
+	if n == 0 {
+		os.Remove(tmpPath)
+		if err == nil {
+			err = errors.New("no messages could be recovered")
+		}
+		return fmt.Errorf("failed to recover bag: %w", err)
+	}
+	if err != nil {
+		v.logger.Errorf("recovered %d messages from '%s', the rest were lost: %v", n, path, err)
+	} else {
+		v.logger.Infof("recovered %d messages from '%s'", n, path)
+	}
+	// The journal files of the corrupted bag must not be applied to the
+	// recovered bag.
+	for _, suffix := range []string{"-wal", "-shm", "-journal"} {
+		if err := os.Remove(path + suffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return os.Rename(tmpPath, path)
+}
+
+func (v *bagValidator) quarantine(bag *bagMetadata, reason error) error {
+	rel, err := filepath.Rel(v.Dir, filepath.Dir(bag.path))
+	if err != nil {
+		return err
+	}
+	dst := filepath.Join(v.Dir, quarantineDirName, rel)
+	//#nosec G301 -- The directory doesn't contain secrets.
+	if err = os.MkdirAll(dst, 0755); err != nil {
+		return fmt.Errorf("failed to create quarantine directory: %w", err)
+	}
+	matches, err := filepath.Glob(escapeMatchPattern(bag.path) + "*")
+	if err != nil {
+		return err
+	}
+	for _, match := range matches {
+		if err = os.Rename(match, filepath.Join(dst, filepath.Base(match))); err != nil {
+			return fmt.Errorf("failed to quarantine bag: %w", err)
+		}
+	}
+	v.logger.Errorf("moved bag '%s' to '%s': %v", bag.path, dst, reason)
+	v.mu.Lock()
+	v.quarantined++
+	v.diagnostics.ReportError(
+		"bag validator", v.quarantined, " bags quarantined, latest: ", bag.path, ": ", reason,
+	)
+	v.mu.Unlock()
+	return fmt.Errorf("%w: moved to quarantine: %v", errBagRemoved, reason)
+}
+
+// rebuildMetadata writes metadata.yaml to dir if it doesn't exist. The metadata
+// is written by ros bag record when it exits, so it is missing if the recorder
+// was killed.
+func (v *bagValidator) rebuildMetadata(ctx context.Context, dir string) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	path := filepath.Join(dir, "metadata.yaml")
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	bags, err := filepath.Glob(filepath.Join(escapeMatchPattern(dir), "*"+storageExtensions[storageSQLite3]))
+	if err != nil {
+		return err
+	}
+	sort.Slice(bags, func(i, j int) bool {
+		a, b := newBagMetadata(bags[i], 0, false), newBagMetadata(bags[j], 0, false)
+		if a == nil || b == nil {
+			return bags[i] < bags[j]
+		}
+		return a.number < b.number
+	})
+	metadata, err := rosbag.BuildMetadata(ctx, bags...)
+	if err != nil {
+		return err
+	}
+	data, err := yaml.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
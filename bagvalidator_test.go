@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/tiiuae/mission-data-recorder/internal/rosbag"
+	"gopkg.in/yaml.v3"
+)
+
+func TestBagValidator(t *testing.T) {
+	var (
+		dir       = t.TempDir()
+		bagDir    = filepath.Join(dir, "recording")
+		validator = newBagValidator(dir, fakeLogger{}, nil)
+		ctx       = context.Background()
+	)
+	if err := os.Mkdir(bagDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	Convey("Scenario: valid bags are accepted and their metadata is rebuilt", t, func() {
+		bag := newBagMetadata(filepath.Join(bagDir, "bag_0.db3"), 0, false)
+		createTestBag(t, bag.path, 1e9, 3e9, 2e9)
+		So(validator.ProcessBag(ctx, bag), ShouldBeNil)
+		data, err := os.ReadFile(filepath.Join(bagDir, "metadata.yaml"))
+		So(err, ShouldBeNil)
+		var metadata rosbag.Metadata
+		So(yaml.Unmarshal(data, &metadata), ShouldBeNil)
+		So(metadata.Info.RelativeFilePaths, ShouldResemble, []string{"bag_0.db3"})
+		So(metadata.Info.MessageCount, ShouldEqual, 3)
+		So(metadata.Info.StartingTime.NanosecondsSinceEpoch, ShouldEqual, 1e9)
+		So(metadata.Info.Duration.Nanoseconds, ShouldEqual, 2e9)
+	})
+	Convey("Scenario: truncated bags are recovered", t, func() {
+		bag := newBagMetadata(filepath.Join(bagDir, "bag_1.db3"), 0, true)
+		timestamps := make([]int64, 2000)
+		for i := range timestamps {
+			timestamps[i] = int64(i+1) * 1e6
+		}
+		createTestBag(t, bag.path, timestamps...)
+		info, err := os.Stat(bag.path)
+		So(err, ShouldBeNil)
+		So(os.Truncate(bag.path, info.Size()*2/3), ShouldBeNil)
+		So(validator.ProcessBag(ctx, bag), ShouldBeNil)
+		So(validateBag(ctx, bag.path), ShouldBeNil)
+		start, err := getRecordStartTime(ctx, bag.path)
+		So(err, ShouldBeNil)
+		So(start.UnixNano(), ShouldEqual, 1e6)
+	})
+	Convey("Scenario: unrecoverable bags are quarantined", t, func() {
+		bag := newBagMetadata(filepath.Join(bagDir, "bag_2.db3"), 0, true)
+		So(os.WriteFile(bag.path, []byte("not a database"), 0o600), ShouldBeNil)
+		err := validator.ProcessBag(ctx, bag)
+		So(errors.Is(err, errBagRemoved), ShouldBeTrue)
+		_, err = os.Stat(bag.path)
+		So(os.IsNotExist(err), ShouldBeTrue)
+		_, err = os.Stat(filepath.Join(dir, quarantineDirName, "recording", "bag_2.db3"))
+		So(err, ShouldBeNil)
+	})
+	Convey("Scenario: quarantined bags are not loaded", t, func() {
+		m := newUploadManager(0, nil, fakeLogger{}, nil)
+		So(m.LoadExistingBags(ctx, dir), ShouldBeNil)
+		m.mutex.Lock()
+		defer m.mutex.Unlock()
+		So(m.queue, ShouldHaveLength, 2)
+	})
+}
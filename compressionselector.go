@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	defaultCompressionSampleSize = 1 << 20
+	// Used as the upload rate until the first upload has been measured.
+	defaultUploadRate = 1e6
+	// Weight of the latest measurement in the exponential moving averages.
+	uploadRateWeight = 0.3
+	// The candidates are measured again after this long or if the upload rate
+	// has changed by more than uploadRateChangeFactor since the last
+	// measurement.
+	defaultRemeasureInterval = 10 * time.Minute
+	uploadRateChangeFactor   = 2
+)
+
+type compressionCandidate struct {
+	Mode  compressionMode
+	Level int
+}
+
+func (c compressionCandidate) String() string {
+	if c.Level == 0 {
+		return c.Mode.String()
+	}
+	return fmt.Sprintf("%s (level %d)", c.Mode, c.Level)
+}
+
+// autoCompressionCandidates lists the modes considered by compressionSelector
+// ordered roughly from the fastest to the slowest. xz is too slow to compress
+// bags on the companion computer while uploading them, so it can only be
+// selected explicitly.
+var autoCompressionCandidates = []compressionCandidate{
+	{compressionNone, 0},
+	{compressionLz4, 0},
+	{compressionZstd, 1},
+	{compressionZstd, 3},
+	{compressionGzip, 6},
+	{compressionZstd, 7},
+}
+
+// compressionMeasurement is the compression speed in bytes per second and the
+// compression ratio of a candidate.
+type compressionMeasurement struct {
+	speed, ratio float64
+}
+
+// compressionSelector selects the compression mode which minimizes the expected
+// time to upload a bag. The compression speed and ratio of each candidate mode
+// are measured by compressing a sample of the bag. Because the data is
+// compressed while it is uploaded, the expected upload time is the larger of
+// the compression time and the time to transfer the compressed data using the
+// recently measured upload rate. The measurements are reused for
+// RemeasureInterval or until the upload rate changes materially, so that every
+// candidate isn't run for every bag.
+type compressionSelector struct {
+	SampleSize        int
+	RemeasureInterval time.Duration
+
+	logger      logger
+	diagnostics *diagnosticsMonitor
+
+	mu sync.Mutex
+	// +checklocks:mu
+	uploadRate float64
+	// +checklocks:mu
+	measurements map[compressionCandidate]compressionMeasurement
+	// +checklocks:mu
+	measuredAt time.Time
+	// The upload rate when the candidates were measured.
+	// +checklocks:mu
+	measuredRate float64
+}
+
+func newCompressionSelector(logger logger, diagnostics *diagnosticsMonitor) *compressionSelector {
+	return &compressionSelector{
+		SampleSize:        defaultCompressionSampleSize,
+		RemeasureInterval: defaultRemeasureInterval,
+		logger:            logger,
+		diagnostics:       diagnostics,
+		uploadRate:        defaultUploadRate,
+	}
+}
+
+// RecordUpload updates the upload rate estimate. d should contain only the time
+// spent transferring data and not the time spent waiting for the compressor.
+func (s *compressionSelector) RecordUpload(bytes int64, d time.Duration) {
+	if s == nil || bytes <= 0 || d <= 0 {
+		return
+	}
+	rate := float64(bytes) / d.Seconds()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.uploadRate = uploadRateWeight*rate + (1-uploadRateWeight)*s.uploadRate
+}
+
+func (s *compressionSelector) currentUploadRate() float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.uploadRate
+}
+
+// Select returns the candidate with the lowest expected upload time for a bag
+// of size bytes read from r.
+func (s *compressionSelector) Select(r io.ReaderAt, size int64) (compressionCandidate, error) {
+	uploadRate := s.currentUploadRate()
+	measurements, err := s.measure(r, size, uploadRate, time.Now())
+	if err != nil {
+		return compressionCandidate{}, err
+	}
+	best, bestTime := autoCompressionCandidates[0], math.Inf(1)
+	for _, c := range autoCompressionCandidates {
+		m := measurements[c]
+		t := math.Max(float64(size)/m.speed, float64(size)*m.ratio/uploadRate)
+		if t < bestTime {
+			best, bestTime = c, t
+		}
+	}
+	estimate := time.Duration(bestTime * float64(time.Second)).Round(time.Second)
+	s.logger.Infof(
+		"automatic compression selected %v, estimated upload time %v at %.0f B/s",
+		best, estimate, uploadRate,
+	)
+	s.diagnostics.ReportSuccess("compression", "auto: ", best, ", estimated upload time ", estimate)
+	return best, nil
+}
+
+// measure returns the measurements of the candidates. They are measured using a
+// sample of r if the previous measurements are older than RemeasureInterval or
+// the upload rate has changed by more than uploadRateChangeFactor.
+func (s *compressionSelector) measure(
+	r io.ReaderAt, size int64, uploadRate float64, now time.Time,
+) (map[compressionCandidate]compressionMeasurement, error) {
+	s.mu.Lock()
+	if s.measurements != nil && now.Sub(s.measuredAt) < s.RemeasureInterval &&
+		math.Max(uploadRate/s.measuredRate, s.measuredRate/uploadRate) <= uploadRateChangeFactor {
+		defer s.mu.Unlock()
+		return s.measurements, nil
+	}
+	s.mu.Unlock()
+	// The lock isn't held while compressing, so that RecordUpload isn't
+	// blocked.
+	sample, err := s.readSample(r, size)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read compression sample: %w", err)
+	}
+	measurements := make(map[compressionCandidate]compressionMeasurement, len(autoCompressionCandidates))
+	for _, c := range autoCompressionCandidates {
+		speed, ratio, err := measureCompression(c, sample)
+		if err != nil {
+			return nil, err
+		}
+		measurements[c] = compressionMeasurement{speed: speed, ratio: ratio}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.measurements, s.measuredAt, s.measuredRate = measurements, now, uploadRate
+	return measurements, nil
+}
+
+// readSample reads at most s.SampleSize bytes from the middle of r, which is
+// more representative of the bag contents than the beginning of the file.
+func (s *compressionSelector) readSample(r io.ReaderAt, size int64) ([]byte, error) {
+	n := int64(s.SampleSize)
+	if n > size {
+		n = size
+	}
+	sample := make([]byte, n)
+	_, err := r.ReadAt(sample, (size-n)/2)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return sample, nil
+}
+
+// measureCompression returns the compression speed in bytes per second and the
+// compression ratio of c for sample.
+func measureCompression(c compressionCandidate, sample []byte) (speed, ratio float64, err error) {
+	if c.Mode == compressionNone || len(sample) == 0 {
+		return math.Inf(1), 1, nil
+	}
+	modifier, _, err := compressionModifier(c.Mode, c.Level)
+	if err != nil {
+		return 0, 0, err
+	}
+	var out countingWriter
+	start := time.Now()
+	w, err := modifier(&out)
+	if err != nil {
+		return 0, 0, err
+	}
+	if _, err = w.Write(sample); err != nil {
+		return 0, 0, err
+	}
+	if err = w.Close(); err != nil {
+		return 0, 0, err
+	}
+	elapsed := math.Max(time.Since(start).Seconds(), 1e-9)
+	return float64(len(sample)) / elapsed, float64(out) / float64(len(sample)), nil
+}
+
+type countingWriter int64
+
+func (w *countingWriter) Write(data []byte) (int, error) {
+	*w += countingWriter(len(data))
+	return len(data), nil
+}
+
+// uploadTimer measures how much data is read from r and how much time is spent
+// waiting for r, so that the upload rate can be measured independently of the
+// compression speed.
+type uploadTimer struct {
+	r        io.Reader
+	bytes    int64
+	readTime time.Duration
+}
+
+func (t *uploadTimer) Read(data []byte) (int, error) {
+	start := time.Now()
+	n, err := t.r.Read(data)
+	t.readTime += time.Since(start)
+	t.bytes += int64(n)
+	return n, err
+}
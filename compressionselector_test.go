@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestCompressionSelector(t *testing.T) {
+	data := []byte(strings.Repeat("compressible telemetry ", 50000))
+	Convey("Scenario: compressionSelector adapts to the upload rate", t, func() {
+		Convey("Compressible data is compressed on a slow link", func() {
+			s := newCompressionSelector(fakeLogger{}, nil)
+			s.RecordUpload(1, time.Second)
+			c, err := s.Select(bytes.NewReader(data), int64(len(data)))
+			So(err, ShouldBeNil)
+			So(c.Mode, ShouldNotEqual, compressionNone)
+		})
+		Convey("Data is not compressed on a very fast link", func() {
+			s := newCompressionSelector(fakeLogger{}, nil)
+			for i := 0; i < 100; i++ {
+				s.RecordUpload(1e15, time.Second)
+			}
+			c, err := s.Select(bytes.NewReader(data), int64(len(data)))
+			So(err, ShouldBeNil)
+			So(c.Mode, ShouldEqual, compressionNone)
+		})
+		Convey("Measurements are reused until they are stale or the upload rate changes", func() {
+			s := newCompressionSelector(fakeLogger{}, nil)
+			now := time.Now()
+			first, err := s.measure(bytes.NewReader(data), int64(len(data)), 1e6, now)
+			So(err, ShouldBeNil)
+			So(first, ShouldHaveLength, len(autoCompressionCandidates))
+			So(first, ShouldNotContainKey, compressionCandidate{compressionXz, 0})
+			So(s.measuredAt, ShouldEqual, now)
+
+			_, err = s.measure(bytes.NewReader(data), int64(len(data)), 1.5e6, now.Add(time.Minute))
+			So(err, ShouldBeNil)
+			So(s.measuredAt, ShouldEqual, now)
+
+			_, err = s.measure(bytes.NewReader(data), int64(len(data)), 3e6, now.Add(time.Minute))
+			So(err, ShouldBeNil)
+			So(s.measuredAt, ShouldEqual, now.Add(time.Minute))
+
+			_, err = s.measure(bytes.NewReader(data), int64(len(data)), 3e6, now.Add(time.Minute+s.RemeasureInterval))
+			So(err, ShouldBeNil)
+			So(s.measuredAt, ShouldEqual, now.Add(time.Minute+s.RemeasureInterval))
+		})
+	})
+}
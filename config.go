@@ -84,18 +84,37 @@ func (l *topicList) UnmarshalYAML(val *yaml.Node) error {
 }
 
 type updatableConfig struct {
-	Topics          topicList       `yaml:"topics"`
-	SizeThreshold   int             `yaml:"size_threshold"`
-	ExtraArgs       []string        `yaml:"extra_args"`
-	MaxUploadCount  int             `yaml:"max_upload_count"`
-	CompressionMode compressionMode `yaml:"compression_mode"`
+	Topics                  topicList               `yaml:"topics"`
+	Services                topicList               `yaml:"services"`
+	Actions                 topicList               `yaml:"actions"`
+	ParameterEvents         bool                    `yaml:"parameter_events"`
+	SizeThreshold           int                     `yaml:"size_threshold"`
+	ExtraArgs               []string                `yaml:"extra_args"`
+	RecorderOptions         recorderOptions         `yaml:",inline"`
+	LogCapture              logCaptureOptions       `yaml:",inline"`
+	MaxUploadCount          int                     `yaml:"max_upload_count"`
+	CompressionMode         compressionMode         `yaml:"compression_mode"`
+	CompressionLevel        int                     `yaml:"compression_level"`
+	RecorderCompressionMode recorderCompressionMode `yaml:"recorder_compression_mode"`
+	StorageFormat           storageFormat           `yaml:"storage_format"`
+	// ExpectedTopics maps topic names to the expectations checked by the
+	// topic monitor while the topics are being recorded.
+	ExpectedTopics map[string]topicExpectation `yaml:"expected_topics"`
+	// QoSOverrides maps topic names to the QoS policies used by ros bag
+	// record to subscribe to them.
+	QoSOverrides map[string]topicQoS `yaml:"qos_overrides"`
+	// TelemetryInterval is the interval of sampling system resource usage
+	// while recording. If zero, system resource usage is not recorded.
+	TelemetryInterval time.Duration `yaml:"telemetry_interval"`
 }
 
 func parseUpdatableConfigYAML(s string) (*updatableConfig, error) {
 	config := updatableConfig{
-		SizeThreshold:   defaultSizeThreshold,
-		MaxUploadCount:  defaultMaxUploadCount,
-		CompressionMode: defaultCompressionMode,
+		SizeThreshold:           defaultSizeThreshold,
+		MaxUploadCount:          defaultMaxUploadCount,
+		CompressionMode:         defaultCompressionMode,
+		RecorderCompressionMode: defaultRecorderCompressionMode,
+		StorageFormat:           defaultStorageFormat,
 	}
 	if err := yaml.Unmarshal([]byte(s), &config); err != nil {
 		return nil, err
@@ -103,18 +122,94 @@ func parseUpdatableConfigYAML(s string) (*updatableConfig, error) {
 	if config.MaxUploadCount < 0 {
 		return nil, errors.New("'max-upload-count' must be non-negative")
 	}
+	if err := config.CompressionMode.validateLevel(config.CompressionLevel); err != nil {
+		return nil, err
+	}
+	if err := validateInterfaceNames("service", config.Services); err != nil {
+		return nil, err
+	}
+	if err := validateInterfaceNames("action", config.Actions); err != nil {
+		return nil, err
+	}
+	if err := validateExtraArgs(config.ExtraArgs); err != nil {
+		return nil, err
+	}
+	if err := config.RecorderOptions.validate(config.Topics); err != nil {
+		return nil, err
+	}
+	if err := validateQoSOverrides(config.QoSOverrides); err != nil {
+		return nil, err
+	}
+	if err := config.LogCapture.validate(); err != nil {
+		return nil, err
+	}
+	if config.TelemetryInterval < 0 {
+		return nil, errors.New("'telemetry_interval' must be non-negative")
+	}
+	for name, e := range config.ExpectedTopics {
+		if !strings.HasPrefix(name, "/") {
+			return nil, fmt.Errorf("expected topic '%s' must be an absolute topic name", name)
+		}
+		if err := e.validate(); err != nil {
+			return nil, fmt.Errorf("invalid expectation of topic '%s': %w", name, err)
+		}
+	}
 	return &config, nil
 }
 
 type uploadManagerInterface interface {
 	StartWorker(context.Context)
-	SetConfig(int, compressionMode)
+	SetConfig(int, compressionMode, int)
 	AddBag(context.Context, *bagMetadata)
+	PauseUploads()
+	ResumeUploads(context.Context)
 }
 
 type configWatcher struct {
-	sub        *rclgo.Subscription
-	RetryDelay time.Duration
+	sub *rclgo.Subscription
+
+	// RetryDelay is the delay before the recorder is restarted after it has
+	// failed. The delay is doubled after each consecutive failure up to
+	// MaxRetryDelay. Failures are not consecutive if the recorder ran for
+	// longer than MaxRetryDelay.
+	RetryDelay    time.Duration
+	MaxRetryDelay time.Duration
+
+	// UploadContext is used for processing and uploading bags. It isn't
+	// cancelled when the recorder is stopped, so that the last bag of a
+	// recording can be uploaded. If nil, the context passed to Run is used.
+	UploadContext context.Context
+
+	// If MissionAware is true, the recorder runs only while a mission is
+	// active. Each mission is recorded in a new session. The active mission is
+	// set using SetMission.
+	MissionAware bool
+
+	// If DeferUploads is true, no new uploads are started while a mission is
+	// active. Used only if MissionAware is true.
+	DeferUploads bool
+
+	// TopicMonitor checks the expected topics while the recorder is running.
+	// If nil, the topics are not monitored.
+	TopicMonitor *topicMonitor
+
+	// Snapshotter captures a snapshot of the system at the start of each
+	// session. If nil, snapshots are not captured.
+	Snapshotter *snapshotter
+
+	// Telemetry publishes system resource usage while the recorder is running
+	// and its topic is recorded. If nil, system resource usage is not
+	// recorded.
+	Telemetry *telemetryCollector
+
+	// LogCapture captures logs to the log archives of sessions. If nil, logs
+	// are not captured.
+	LogCapture *logCapture
+
+	missionMutex sync.Mutex
+	// +checklocks:missionMutex
+	mission        *missionState
+	missionChanged chan struct{}
 
 	recorder      *missionDataRecorder
 	uploadManager uploadManagerInterface
@@ -122,12 +217,17 @@ type configWatcher struct {
 
 	nextConfig chan *updatableConfig
 
+	configMutex sync.Mutex
+	// +checklocks:configMutex
+	config *updatableConfig
+
 	// +checklocks:stopRecorderMutex
 	stopRecorder      context.CancelFunc
 	stopRecorderMutex sync.Mutex
 
 	retryTimerActive bool
 	retryTimer       *time.Timer
+	retryCount       int
 }
 
 func newConfigWatcher(
@@ -139,11 +239,13 @@ func newConfigWatcher(
 ) (w *configWatcher, err error) {
 	w = &configWatcher{
 		RetryDelay:    5 * time.Second,
+		MaxRetryDelay: 5 * time.Minute,
 		recorder:      recorder,
 		uploadManager: uploadManager,
 		diagnostics:   diagnostics,
 
-		nextConfig: make(chan *updatableConfig, 1),
+		nextConfig:     make(chan *updatableConfig, 1),
+		missionChanged: make(chan struct{}, 1),
 	}
 	w.retryTimer = time.NewTimer(w.RetryDelay)
 	if !w.retryTimer.Stop() {
@@ -183,36 +285,222 @@ func (w *configWatcher) Run(ctx context.Context) error {
 			w.retryTimerActive = false
 			w.startRecorder(ctx, currentConfig)
 		case currentConfig = <-w.nextConfig:
+			w.setConfig(currentConfig)
 			if w.retryTimerActive && !w.retryTimer.Stop() {
 				<-w.retryTimer.C
 			}
 			w.retryTimerActive = false
 			w.startRecorder(ctx, currentConfig)
+		case <-w.missionChanged:
+			if currentConfig == nil {
+				continue
+			}
+			if w.retryTimerActive && !w.retryTimer.Stop() {
+				<-w.retryTimer.C
+			}
+			w.retryTimerActive = false
+			w.startRecorder(ctx, currentConfig)
+		}
+	}
+}
+
+func (w *configWatcher) setConfig(config *updatableConfig) {
+	w.configMutex.Lock()
+	defer w.configMutex.Unlock()
+	w.config = config
+}
+
+// Config returns the current config.
+func (w *configWatcher) Config() *updatableConfig {
+	w.configMutex.Lock()
+	defer w.configMutex.Unlock()
+	return w.config
+}
+
+// SetMission sets the active mission. If mission is nil, no mission is active.
+// The recorder is restarted when a mission starts or ends. If the ID of the
+// active mission becomes known only after it has started, e.g. when the
+// flight state changes from armed to takeoff, the ID is set on the current
+// session without restarting the recorder.
+func (w *configWatcher) SetMission(mission *missionState) {
+	w.missionMutex.Lock()
+	prev := w.mission
+	idKnown := prev != nil && mission != nil && prev.ID == "" && mission.ID != ""
+	if (prev == nil) != (mission == nil) || idKnown {
+		w.mission = mission
+	}
+	w.missionMutex.Unlock()
+	logger := w.sub.Node().Logger()
+	switch {
+	case prev == nil && mission == nil:
+		return
+	case prev == nil:
+		logger.Infof("mission '%s' started", mission.ID)
+	case mission == nil:
+		logger.Infof("mission '%s' ended", prev.ID)
+	case idKnown:
+		logger.Infof("ID of the active mission is '%s'", mission.ID)
+		if err := w.recorder.SetMissionID(mission.ID); err != nil {
+			logger.Errorf("failed to set mission ID of the current session: %v", err)
+		}
+		return
+	default:
+		if prev.ID != mission.ID {
+			logger.Warnf("ignoring mission ID '%s' while mission '%s' is active", mission.ID, prev.ID)
 		}
+		return
 	}
+	w.stopRecording()
+	select {
+	case w.missionChanged <- struct{}{}:
+	default:
+	}
+}
+
+func (w *configWatcher) currentMission() *missionState {
+	w.missionMutex.Lock()
+	defer w.missionMutex.Unlock()
+	return w.mission
 }
 
 func (w *configWatcher) startRecorder(ctx context.Context, config *updatableConfig) {
-	startRecorder := w.applyConfig(config)
+	selection := w.applyConfig(config)
+	startRecorder := !selection.empty()
+	uploadCtx := w.UploadContext
+	if uploadCtx == nil {
+		uploadCtx = ctx
+	}
 	ctx = w.newRecorderContext(ctx)
-	w.uploadManager.StartWorker(ctx)
+	w.uploadManager.StartWorker(uploadCtx)
+	if w.Snapshotter != nil {
+		w.recorder.CaptureSnapshot = func(dir string) {
+			if err := w.Snapshotter.Capture(uploadCtx, dir, config); err != nil {
+				w.sub.Node().Logger().Errorf("failed to capture session snapshot: %v", err)
+			}
+		}
+	}
+	w.recorder.CaptureLogs = nil
+	if w.LogCapture != nil && config.LogCapture.enabled() {
+		w.recorder.CaptureLogs = func(dir string) func() *bagMetadata {
+			return w.LogCapture.Start(ctx, dir, config.LogCapture)
+		}
+	}
+	if w.MissionAware {
+		mission := w.currentMission()
+		if w.DeferUploads {
+			if mission != nil {
+				w.uploadManager.PauseUploads()
+			} else {
+				w.uploadManager.ResumeUploads(uploadCtx)
+			}
+		}
+		if mission == nil {
+			if startRecorder {
+				w.diagnostics.ReportSuccess("recorder", "waiting for a mission")
+			} else {
+				w.diagnostics.ReportSuccess("recorder", "stopped")
+			}
+			return
+		}
+		if err := w.recorder.SetMissionID(mission.ID); err != nil {
+			w.sub.Node().Logger().Errorf("failed to set mission ID: %v", err)
+		}
+	}
 	if startRecorder {
 		w.diagnostics.ReportSuccess("recorder", "running")
-		err := w.recorder.Start(ctx, w.uploadManager.AddBag)
+		started := time.Now()
+		stopMonitor := w.startTopicMonitor(ctx, config.ExpectedTopics, selection)
+		stopTelemetry := w.startTelemetry(ctx, config.TelemetryInterval)
+		err := w.recorder.Start(ctx, func(_ context.Context, bag *bagMetadata) {
+			w.uploadManager.AddBag(uploadCtx, bag)
+		})
+		stopTelemetry()
+		stopMonitor()
 		//nolint:errorlint // Wrapped errors are deliberately ignored.
 		switch err {
 		case nil, context.Canceled:
+			w.retryCount = 0
 		default:
-			w.sub.Node().Logger().Errorf("recorder stopped with an error, trying again in %v: %v", w.RetryDelay, err)
+			delay := w.nextRetryDelay(time.Since(started))
+			w.sub.Node().Logger().Errorf("recorder stopped with an error, trying again in %v: %v", delay, err)
 			w.diagnostics.ReportError("recorder", "failed: ", err)
 			w.retryTimerActive = true
-			w.retryTimer.Reset(w.RetryDelay)
+			w.retryTimer.Reset(delay)
 		}
 	} else {
 		w.diagnostics.ReportSuccess("recorder", "stopped")
 	}
 }
 
+// startTopicMonitor runs the topic monitor until the returned function is
+// called. If stall detection is enabled, the messages of the expected topics
+// which are recorded in selection are counted by the monitor for the
+// recorder. If none of them are recorded, the recorder assumes that messages
+// are published all the time.
+func (w *configWatcher) startTopicMonitor(
+	ctx context.Context, expectations map[string]topicExpectation, selection topicSelection,
+) (stop func()) {
+	w.recorder.RecordedMessages = nil
+	if w.TopicMonitor == nil || len(expectations) == 0 {
+		return func() {}
+	}
+	var recorded func(string) bool
+	if w.recorder.StallTimeout > 0 {
+		recorded = selection.matcher()
+		for name := range expectations {
+			if recorded(name) {
+				w.recorder.RecordedMessages = w.TopicMonitor.MessageCount
+				break
+			}
+		}
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		w.TopicMonitor.Run(ctx, expectations, recorded)
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// startTelemetry runs the telemetry collector until the returned function is
+// called.
+func (w *configWatcher) startTelemetry(ctx context.Context, interval time.Duration) (stop func()) {
+	if w.Telemetry == nil || interval <= 0 {
+		return func() {}
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		w.Telemetry.Run(ctx, interval)
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// nextRetryDelay returns the delay before restarting a recorder which failed
+// after running for the given duration.
+func (w *configWatcher) nextRetryDelay(ran time.Duration) time.Duration {
+	if ran > w.MaxRetryDelay {
+		w.retryCount = 0
+	}
+	delay := w.RetryDelay
+	for i := 0; i < w.retryCount && delay < w.MaxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > w.MaxRetryDelay {
+		delay = w.MaxRetryDelay
+	}
+	w.retryCount++
+	return delay
+}
+
 func (w *configWatcher) onUpdate(s *rclgo.Subscription) {
 	var configYaml std_msgs_msg.String
 	if _, err := s.TakeMessage(&configYaml); err != nil {
@@ -246,15 +534,26 @@ func (w *configWatcher) stopRecording() {
 	}
 }
 
-func (w *configWatcher) applyConfig(config *updatableConfig) (startRecorder bool) {
+// applyConfig configures the recorder and the uploads and returns the topics
+// recorded. The recorder is started only if the selection isn't empty.
+func (w *configWatcher) applyConfig(config *updatableConfig) topicSelection {
 	defer w.diagnostics.ReportSuccess("config", "applied")
-	w.uploadManager.SetConfig(config.MaxUploadCount, config.CompressionMode)
+	w.uploadManager.SetConfig(config.MaxUploadCount, config.CompressionMode, config.CompressionLevel)
 	w.recorder.SizeThreshold = config.SizeThreshold
 	w.recorder.ExtraArgs = config.ExtraArgs
-	if config.Topics.All {
-		w.recorder.Topics = nil
-		return true
+	w.recorder.Options = config.RecorderOptions
+	selection := selectTopics(config)
+	w.recorder.Options.TopicRegex = selection.Regex
+	if selection.IncludeHidden {
+		w.recorder.Options.IncludeHiddenTopics = true
+	}
+	w.recorder.QoSOverrides = config.QoSOverrides
+	w.recorder.CompressionMode = config.RecorderCompressionMode
+	w.recorder.StorageFormat = config.StorageFormat
+	// Telemetry alone doesn't start the recorder.
+	if !selection.empty() && !selection.All && w.Telemetry != nil && config.TelemetryInterval > 0 {
+		selection.Topics = append(selection.Topics, w.Telemetry.Topic())
 	}
-	w.recorder.Topics = config.Topics.Topics
-	return len(config.Topics.Topics) != 0
+	w.recorder.Topics = selection.Topics
+	return selection
 }
@@ -59,6 +59,59 @@ extra_args: [arg1, arg2]`},
 		{in: `max_upload_count: 7`},
 		{in: `compression_mode: not supported`},
 		{in: `compression_mode: gzip`},
+		{in: `compression_mode: zstd
+compression_level: 19`},
+		{in: `compression_mode: lz4
+compression_level: 10`},
+		{in: `compression_mode: xz
+compression_level: 6`},
+		{in: `recorder_compression_mode: file`},
+		{in: `recorder_compression_mode: zstd`},
+		{in: `storage_format: mcap`},
+		{in: `storage_format: bag`},
+		{in: `expected_topics:
+  /camera:
+    min_rate: 10
+    max_gap: 2s
+    required: true
+  /gps:
+    required: true`},
+		{in: `expected_topics:
+  camera:
+    required: true`},
+		{in: `expected_topics:
+  /camera:
+    min_rate: -1`},
+		{in: `qos_overrides:
+  /camera:
+    reliability: best_effort
+    depth: 5
+  /map:
+    durability: transient_local`},
+		{in: `qos_overrides:
+  /camera:
+    reliability: reliabel`},
+		{in: `qos_overrides:
+  /camera:
+    depth: -1`},
+		{in: `topics: '*'
+polling_interval: 50ms
+include_hidden_topics: true
+max_cache_size: 1000000
+no_discovery: true
+exclude_regex: ^/debug/`},
+		{in: `topic_regex: ^/camera/`},
+		{in: `topics: [/a]
+exclude_regex: ^/debug/`},
+		{in: `topic_regex: '^/(?!debug/).*'`},
+		{in: `extra_args: [--output, /tmp]`},
+		{in: `extra_args: [--out=/tmp]`},
+		{in: `extra_args: [-a]`},
+		{in: `extra_args: [--max-bag-duration, "60"]`},
+		{in: `services: [/set_mode]
+actions: '*'
+parameter_events: true`},
+		{in: `services: [set_mode]`},
 	}
 	for i := range data {
 		data[i].c, data[i].e = parseUpdatableConfigYAML(data[i].in)
@@ -74,14 +127,32 @@ func (m *fakeUploadManager) StartWorker(ctx context.Context) {
 	m.t.Log("worker started")
 }
 
-func (m *fakeUploadManager) SetConfig(n int, mode compressionMode) {
-	m.t.Log("worker count set to", n, "compression mode set to", mode)
+func (m *fakeUploadManager) SetConfig(n int, mode compressionMode, level int) {
+	m.t.Log("worker count set to", n, "compression mode set to", mode, "level", level)
 }
 
+func (m *fakeUploadManager) PauseUploads() {}
+
+func (m *fakeUploadManager) ResumeUploads(ctx context.Context) {}
+
 func (m *fakeUploadManager) AddBag(ctx context.Context, bag *bagMetadata) {
 	m.t.Log("got bag", bag.path)
 }
 
+func TestRetryDelay(t *testing.T) {
+	Convey("Scenario: recorder restarts are backed off", t, func() {
+		w := &configWatcher{RetryDelay: time.Second, MaxRetryDelay: 5 * time.Second}
+		var delays []time.Duration
+		for i := 0; i < 5; i++ {
+			delays = append(delays, w.nextRetryDelay(0))
+		}
+		So(delays, ShouldResemble, []time.Duration{
+			time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second,
+		})
+		So(w.nextRetryDelay(time.Minute), ShouldEqual, time.Second)
+	})
+}
+
 func TestConfigWatcher(t *testing.T) {
 	var (
 		watcherStopped          = make(chan struct{})
@@ -128,7 +199,7 @@ func TestConfigWatcher(t *testing.T) {
 			So(err, ShouldBeNil)
 			watcher, err = newConfigWatcher(
 				recorderNode,
-				&missionDataRecorder{Dir: tempDir},
+				&missionDataRecorder{Dir: tempDir, Logger: fakeLogger{}},
 				&fakeUploadManager{t: t},
 				diagnostics,
 				&updatableConfig{
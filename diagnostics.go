@@ -65,10 +65,41 @@ func (m *diagnosticsMonitor) ReportError(key string, a ...interface{}) {
 	m.set(key, diagnostic_msgs_msg.DiagnosticStatus_ERROR, a)
 }
 
+func (m *diagnosticsMonitor) ReportWarning(key string, a ...interface{}) {
+	m.set(key, diagnostic_msgs_msg.DiagnosticStatus_WARN, a)
+}
+
 func (m *diagnosticsMonitor) ReportSuccess(key string, a ...interface{}) {
 	m.set(key, diagnostic_msgs_msg.DiagnosticStatus_OK, a)
 }
 
+// diagnosticStatus is the status of a diagnostic in a snapshot.
+type diagnosticStatus struct {
+	Level   string `json:"level"`
+	Message string `json:"message"`
+}
+
+// Snapshot returns the current statuses of the diagnostics.
+func (m *diagnosticsMonitor) Snapshot() map[string]diagnosticStatus {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	statuses := make(map[string]diagnosticStatus, len(m.diagnostics))
+	for key, d := range m.diagnostics {
+		level := "ok"
+		switch d.Status {
+		case diagnostic_msgs_msg.DiagnosticStatus_WARN:
+			level = "warning"
+		case diagnostic_msgs_msg.DiagnosticStatus_ERROR:
+			level = "error"
+		}
+		statuses[key] = diagnosticStatus{Level: level, Message: d.Value}
+	}
+	return statuses
+}
+
 func (m *diagnosticsMonitor) Run(ctx context.Context) error {
 	msg := diagnostic_msgs_msg.NewDiagnosticArray()
 	msg.Status = []diagnostic_msgs_msg.DiagnosticStatus{{
@@ -87,7 +118,7 @@ func (m *diagnosticsMonitor) Run(ctx context.Context) error {
 			msg.Header.Stamp.Sec = int32(time.Now().Unix())
 			status.Level = diagnostic_msgs_msg.DiagnosticStatus_OK
 			status.Message = "no problems"
-			errCount := 0
+			problemCount := 0
 			m.mu.Lock()
 			if len(status.Values) != len(m.keys) {
 				status.Values = make([]diagnostic_msgs_msg.KeyValue, len(m.keys))
@@ -96,7 +127,7 @@ func (m *diagnosticsMonitor) Run(ctx context.Context) error {
 				d := m.diagnostics[key]
 				status.Values[i] = d.KeyValue
 				if d.Status > diagnostic_msgs_msg.DiagnosticStatus_OK {
-					errCount++
+					problemCount++
 					status.Message = fmt.Sprintf("%s: %s", d.Key, d.Value)
 				}
 				if d.Status > status.Level {
@@ -104,8 +135,8 @@ func (m *diagnosticsMonitor) Run(ctx context.Context) error {
 				}
 			}
 			m.mu.Unlock()
-			if errCount > 1 {
-				status.Message = fmt.Sprint(errCount, " errors")
+			if problemCount > 1 {
+				status.Message = fmt.Sprint(problemCount, " problems")
 			}
 			if err := m.pub.Publish(msg); err != nil {
 				m.pub.Node().Logger().Errorf("failed to publish diagnostics: %v", err)
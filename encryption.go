@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// Bags are encrypted using a chunked AES-256-GCM stream. Each chunk is sealed
+// with a nonce consisting of a random prefix, a big-endian chunk counter and a
+// flag byte which is set only for the last chunk. This prevents reordering and
+// truncation of the chunks. The random data key is encrypted to the recipient's
+// RSA public key using RSA-OAEP with SHA-256.
+const (
+	encryptionAlgorithm    = "AES-256-GCM-STREAM"
+	keyEncryptionAlgorithm = "RSA-OAEP-SHA256"
+	encryptionChunkSize    = 64 * 1024
+	encryptionKeySize      = 32
+	encryptionNonceSize    = 12
+	encryptionPrefixSize   = encryptionNonceSize - 5
+)
+
+// encryptionHeader contains the information the recipient needs to decrypt a
+// bag in addition to its private key.
+type encryptionHeader struct {
+	Algorithm              string `json:"algorithm"`
+	KeyEncryptionAlgorithm string `json:"keyEncryptionAlgorithm"`
+	EncryptedKey           []byte `json:"encryptedKey"`
+	NoncePrefix            []byte `json:"noncePrefix"`
+	ChunkSize              int    `json:"chunkSize"`
+}
+
+func loadEncryptionKey(path string) (*rsa.PublicKey, error) {
+	rawKey, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(rawKey)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %s", path)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse encryption key: %w", err)
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("unsupported encryption key type: %T", key)
+	}
+	return rsaKey, nil
+}
+
+// newEncryptionHeader generates a new data key, encrypts it to recipient and
+// returns it together with the header describing the encryption.
+func newEncryptionHeader(recipient *rsa.PublicKey) (*encryptionHeader, []byte, error) {
+	key := make([]byte, encryptionKeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, nil, fmt.Errorf("failed to generate data key: %w", err)
+	}
+	prefix := make([]byte, encryptionPrefixSize)
+	if _, err := io.ReadFull(rand.Reader, prefix); err != nil {
+		return nil, nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	encryptedKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, recipient, key, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to encrypt data key: %w", err)
+	}
+	return &encryptionHeader{
+		Algorithm:              encryptionAlgorithm,
+		KeyEncryptionAlgorithm: keyEncryptionAlgorithm,
+		EncryptedKey:           encryptedKey,
+		NoncePrefix:            prefix,
+		ChunkSize:              encryptionChunkSize,
+	}, key, nil
+}
+
+func newStreamCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func streamNonce(nonce, prefix []byte, counter uint32, last bool) {
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[encryptionPrefixSize:], counter)
+	if last {
+		nonce[encryptionNonceSize-1] = 1
+	} else {
+		nonce[encryptionNonceSize-1] = 0
+	}
+}
+
+var errTooManyChunks = errors.New("too many chunks in encrypted stream")
+
+// encryptingWriter encrypts data written to it and writes the ciphertext to w.
+// Close must be called to write the last chunk. Close doesn't close w.
+type encryptingWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	header  *encryptionHeader
+	nonce   []byte
+	counter uint32
+	buf     []byte
+	out     []byte
+}
+
+func newEncryptingWriter(w io.Writer, header *encryptionHeader, key []byte) (*encryptingWriter, error) {
+	aead, err := newStreamCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptingWriter{
+		w:      w,
+		aead:   aead,
+		header: header,
+		nonce:  make([]byte, encryptionNonceSize),
+		buf:    make([]byte, 0, header.ChunkSize),
+	}, nil
+}
+
+func (e *encryptingWriter) Write(data []byte) (n int, err error) {
+	for len(data) > 0 {
+		// The buffer is flushed only when more data arrives so that the last
+		// chunk is always written by Close.
+		if len(e.buf) == e.header.ChunkSize {
+			if err = e.seal(false); err != nil {
+				return n, err
+			}
+		}
+		c := copy(e.buf[len(e.buf):cap(e.buf)], data)
+		e.buf = e.buf[:len(e.buf)+c]
+		data = data[c:]
+		n += c
+	}
+	return n, nil
+}
+
+func (e *encryptingWriter) seal(last bool) error {
+	if e.counter == ^uint32(0) {
+		return errTooManyChunks
+	}
+	streamNonce(e.nonce, e.header.NoncePrefix, e.counter, last)
+	e.counter++
+	e.out = e.aead.Seal(e.out[:0], e.nonce, e.buf, nil)
+	e.buf = e.buf[:0]
+	_, err := e.w.Write(e.out)
+	return err
+}
+
+func (e *encryptingWriter) Close() error {
+	return e.seal(true)
+}
+
+// encryptionWorkers is the number of bags encrypted at rest concurrently.
+// Encrypting is limited by disk throughput, so more workers would only slow
+// down the recorder, e.g. when a backlog of bags is loaded at startup.
+const encryptionWorkers = 2
+
+// bagEncryptor encrypts completed bags on disk so that they aren't stored
+// unencrypted while waiting to be uploaded. The data key is encrypted to Key,
+// which means that the bags can't be decrypted on the device. At most Workers
+// bags are encrypted concurrently.
+type bagEncryptor struct {
+	Key *rsa.PublicKey
+
+	workers *semaphore.Weighted
+}
+
+func newBagEncryptor(workers int, key *rsa.PublicKey) *bagEncryptor {
+	return &bagEncryptor{
+		Key:     key,
+		workers: semaphore.NewWeighted(int64(workers)),
+	}
+}
+
+func (e *bagEncryptor) ProcessBag(ctx context.Context, bag *bagMetadata) (err error) {
+	if bag.isEncrypted() {
+		return nil
+	}
+	if err = e.workers.Acquire(ctx, 1); err != nil {
+		return err
+	}
+	defer e.workers.Release(1)
+	defer wrapErr("failed to encrypt bag: %w", &err)
+	manifest, err := loadBagManifest(bag)
+	if err != nil {
+		return err
+	}
+	// The start time can't be read from the bag after it has been encrypted.
+	if manifest.RecordStartTime.IsZero() {
+		manifest.RecordStartTime, err = getRecordStartTime(ctx, bag.filePath())
+		if errors.Is(err, errEmptyBag) {
+			// Empty bags are removed when they are uploaded.
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+	header, key, err := newEncryptionHeader(e.Key)
+	if err != nil {
+		return err
+	}
+	src, err := os.Open(bag.filePath())
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	var digest *digestWriter
+	err = writeFileAtomic(bag.filePath()+encryptedBagExtension, func(w io.Writer) error {
+		digest = newDigestWriter(w)
+		enc, err := newEncryptingWriter(digest, header, key)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(enc, src); err != nil {
+			return err
+		}
+		return enc.Close()
+	})
+	if err != nil {
+		return err
+	}
+	manifest.Encryption = header
+	digest.setTo(manifest)
+	if err = saveBagManifest(bag, manifest); err != nil {
+		return err
+	}
+	// The plaintext is removed only after the manifest has been saved, so that
+	// an interrupted encryption is restarted from the beginning when the bag is
+	// loaded again.
+	if err = os.Remove(bag.filePath()); err != nil {
+		return err
+	}
+	bag.ext += encryptedBagExtension
+	return nil
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func decryptStream(t *testing.T, priv *rsa.PrivateKey, header *encryptionHeader, ciphertext []byte) ([]byte, error) {
+	t.Helper()
+	key, err := rsa.DecryptOAEP(sha256.New(), nil, priv, header.EncryptedKey, nil)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newStreamCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		plaintext []byte
+		nonce     = make([]byte, encryptionNonceSize)
+		chunkSize = header.ChunkSize + aead.Overhead()
+	)
+	for counter := uint32(0); ; counter++ {
+		n := chunkSize
+		last := len(ciphertext) <= chunkSize
+		if last {
+			n = len(ciphertext)
+		}
+		streamNonce(nonce, header.NoncePrefix, counter, last)
+		plaintext, err = aead.Open(plaintext, nonce, ciphertext[:n], nil)
+		if err != nil || last {
+			return plaintext, err
+		}
+		ciphertext = ciphertext[n:]
+	}
+}
+
+func TestEncryptingWriter(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypt := func(plaintext []byte) (*encryptionHeader, []byte) {
+		header, key, err := newEncryptionHeader(&priv.PublicKey)
+		So(err, ShouldBeNil)
+		var buf bytes.Buffer
+		w, err := newEncryptingWriter(&buf, header, key)
+		So(err, ShouldBeNil)
+		_, err = io.Copy(w, bytes.NewReader(plaintext))
+		So(err, ShouldBeNil)
+		So(w.Close(), ShouldBeNil)
+		return header, buf.Bytes()
+	}
+	Convey("Scenario: encrypted bags can be decrypted with the private key", t, func() {
+		for _, size := range []int{0, 1, encryptionChunkSize, 3*encryptionChunkSize + 17} {
+			plaintext := make([]byte, size)
+			_, err := rand.Read(plaintext)
+			So(err, ShouldBeNil)
+			header, ciphertext := encrypt(plaintext)
+			So(header.Algorithm, ShouldEqual, encryptionAlgorithm)
+			decrypted, err := decryptStream(t, priv, header, ciphertext)
+			So(err, ShouldBeNil)
+			So(bytes.Equal(decrypted, plaintext), ShouldBeTrue)
+		}
+	})
+	Convey("Scenario: truncated ciphertext is rejected", t, func() {
+		header, ciphertext := encrypt(make([]byte, 2*encryptionChunkSize+1))
+		chunkSize := header.ChunkSize + 16
+		_, err := decryptStream(t, priv, header, ciphertext[:2*chunkSize])
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestBagEncryptor(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		dir       = t.TempDir()
+		bag       = newBagMetadata(filepath.Join(dir, "bag_0.db3"), 0, false)
+		encryptor = newBagEncryptor(1, &priv.PublicKey)
+		plaintext []byte
+	)
+	createTestBag(t, bag.path, 2e9, 1e9)
+	Convey("Scenario: bagEncryptor encrypts bags at rest", t, func() {
+		Convey("Encrypt the bag", func() {
+			plaintext, err = os.ReadFile(bag.path)
+			So(err, ShouldBeNil)
+			So(encryptor.ProcessBag(context.Background(), bag), ShouldBeNil)
+		})
+		Convey("The plaintext is replaced with the ciphertext", func() {
+			So(bag.ext, ShouldEqual, encryptedBagExtension)
+			_, err := os.Stat(bag.path)
+			So(os.IsNotExist(err), ShouldBeTrue)
+		})
+		Convey("The manifest contains the start time and encryption header", func() {
+			manifest, err := loadBagManifest(bag)
+			So(err, ShouldBeNil)
+			So(manifest.RecordStartTime.Equal(time.Unix(1, 0)), ShouldBeTrue)
+			ciphertext, err := os.ReadFile(bag.filePath())
+			So(err, ShouldBeNil)
+			decrypted, err := decryptStream(t, priv, manifest.Encryption, ciphertext)
+			So(err, ShouldBeNil)
+			So(bytes.Equal(decrypted, plaintext), ShouldBeTrue)
+		})
+		Convey("Encrypted bags are loaded and not encrypted again", func() {
+			loaded := newBagMetadata(bag.filePath(), 0, false)
+			So(loaded.path, ShouldEqual, bag.path)
+			So(loaded.ext, ShouldEqual, encryptedBagExtension)
+			So(encryptor.ProcessBag(context.Background(), loaded), ShouldBeNil)
+			So(loaded.ext, ShouldEqual, encryptedBagExtension)
+		})
+	})
+}
+
+// encryptionBackend records the manifest and body of an upload. If
+// failSnapshots is true, uploads of session snapshots fail.
+type encryptionBackend struct {
+	manifest      bagManifest
+	name          string
+	body          []byte
+	failSnapshots bool
+}
+
+func (b *encryptionBackend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/generate-url":
+		if err := json.NewDecoder(r.Body).Decode(&b.manifest); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		claims := &tokenClaims{}
+		_, _, err := new(jwt.Parser).ParseUnverified(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "), claims)
+		if err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		b.name = claims.BagName
+		fmt.Fprintf(w, `{"URL": "http://%s/upload"}`, r.Host)
+	case "/upload":
+		if b.failSnapshots && strings.Contains(b.name, ".snapshot.json") {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		b.body, _ = io.ReadAll(r.Body)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestUploadEncryption(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	Convey("Scenario: bags compressed at rest are encrypted when they are uploaded", t, func() {
+		dir := t.TempDir()
+		bag := &bagMetadata{path: filepath.Join(dir, "bag_0.db3"), ext: ".zst"}
+		compressed := []byte("compressed bag")
+		So(os.WriteFile(bag.filePath(), compressed, 0o600), ShouldBeNil)
+		So(saveBagManifest(bag, &bagManifest{RecordStartTime: time.Now()}), ShouldBeNil)
+		backend := &encryptionBackend{}
+		server := httptest.NewServer(backend)
+		defer server.Close()
+		u := &fileUploader{
+			HTTPClient:    server.Client(),
+			SigningMethod: jwt.SigningMethodHS256,
+			SigningKey:    []byte("key"),
+			TokenLifetime: time.Minute,
+			BackendURL:    server.URL,
+			EncryptionKey: &priv.PublicKey,
+		}
+		So(u.UploadBag(context.Background(), bag), ShouldBeNil)
+		So(backend.name, ShouldEndWith, ".db3.zst.enc")
+		So(backend.manifest.Encryption, ShouldNotBeNil)
+		So(bytes.Contains(backend.body, compressed), ShouldBeFalse)
+		decrypted, err := decryptStream(t, priv, backend.manifest.Encryption, backend.body)
+		So(err, ShouldBeNil)
+		So(decrypted, ShouldResemble, compressed)
+	})
+}
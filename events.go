@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	std_msgs_msg "github.com/tiiuae/mission-data-recorder/msgs/std_msgs/msg"
+	"github.com/tiiuae/rclgo/pkg/rclgo"
+)
+
+// recorderEvent is published as a JSON object on the ~/events topic.
+type recorderEvent struct {
+	Time    time.Time `json:"time"`
+	Type    string    `json:"type"`
+	Topic   string    `json:"topic,omitempty"`
+	Message string    `json:"message,omitempty"`
+}
+
+// eventPublisher publishes events which other nodes may react to, e.g. by
+// alerting the operator. All methods are no-ops if the publisher is nil.
+type eventPublisher struct {
+	pub    *std_msgs_msg.StringPublisher
+	logger logger
+}
+
+func newEventPublisher(node *rclgo.Node) (_ *eventPublisher, err error) {
+	p := &eventPublisher{logger: node.Logger()}
+	p.pub, err = std_msgs_msg.NewStringPublisher(node, "~/events", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create publisher: %w", err)
+	}
+	return p, nil
+}
+
+func (p *eventPublisher) Close() error {
+	return p.pub.Close()
+}
+
+// Publish publishes event. If the time of event is not set, the current time
+// is used.
+func (p *eventPublisher) Publish(event recorderEvent) {
+	if p == nil {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		p.logger.Errorf("failed to encode event: %v", err)
+		return
+	}
+	msg := std_msgs_msg.NewString()
+	msg.Data = string(data)
+	if err := p.pub.Publish(msg); err != nil {
+		p.logger.Errorf("failed to publish event: %v", err)
+	}
+}
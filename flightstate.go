@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	std_msgs_msg "github.com/tiiuae/mission-data-recorder/msgs/std_msgs/msg"
+	"github.com/tiiuae/rclgo/pkg/rclgo"
+)
+
+// missionState describes an active mission, i.e. a flight from arming to
+// landing.
+type missionState struct {
+	// ID of the mission. May be empty if the flight state doesn't contain it.
+	ID string
+}
+
+// parseFlightState parses a flight state message of the form
+// "<state>[ <mission-id>]". States armed and takeoff mean that a mission is
+// active. States landed and disarmed end the mission, in which case nil is
+// returned.
+func parseFlightState(s string) (*missionState, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 || len(fields) > 2 {
+		return nil, fmt.Errorf("invalid flight state: %q", s)
+	}
+	switch strings.ToLower(fields[0]) {
+	case "armed", "takeoff":
+		mission := &missionState{}
+		if len(fields) == 2 {
+			mission.ID = fields[1]
+		}
+		return mission, nil
+	case "landed", "disarmed":
+		return nil, nil
+	}
+	return nil, fmt.Errorf("invalid flight state: %q", s)
+}
+
+// flightStateWatcher subscribes to a flight state topic and passes the active
+// mission to onChange whenever a message is received.
+type flightStateWatcher struct {
+	sub         *rclgo.Subscription
+	onChange    func(*missionState)
+	diagnostics *diagnosticsMonitor
+}
+
+func newFlightStateWatcher(
+	node *rclgo.Node,
+	topic string,
+	onChange func(*missionState),
+	diagnostics *diagnosticsMonitor,
+) (w *flightStateWatcher, err error) {
+	w = &flightStateWatcher{
+		onChange:    onChange,
+		diagnostics: diagnostics,
+	}
+	opts := rclgo.NewDefaultSubscriptionOptions()
+	opts.Qos.Durability = rclgo.RmwQosDurabilityPolicyTransientLocal
+	opts.Qos.Reliability = rclgo.RmwQosReliabilityPolicyReliable
+	w.sub, err = node.NewSubscriptionWithOpts(
+		topic,
+		std_msgs_msg.StringTypeSupport,
+		opts,
+		w.onMessage,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *flightStateWatcher) Close() error {
+	if err := w.sub.Close(); err != nil {
+		return fmt.Errorf("failed to close flightStateWatcher: %w", err)
+	}
+	return nil
+}
+
+func (w *flightStateWatcher) onMessage(s *rclgo.Subscription) {
+	var msg std_msgs_msg.String
+	if _, err := s.TakeMessage(&msg); err != nil {
+		w.sub.Node().Logger().Errorln("failed to read flight state from topic:", err)
+		w.diagnostics.ReportError("flight state", err)
+		return
+	}
+	mission, err := parseFlightState(msg.Data)
+	if err != nil {
+		w.sub.Node().Logger().Errorln("failed to parse flight state:", err)
+		w.diagnostics.ReportError("flight state", err)
+		return
+	}
+	w.diagnostics.ReportSuccess("flight state", msg.Data)
+	w.onChange(mission)
+}
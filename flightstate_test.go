@@ -0,0 +1,50 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestParseFlightState(t *testing.T) {
+	Convey("Scenario: flight states are parsed", t, func() {
+		for _, c := range []struct {
+			data    string
+			mission *missionState
+		}{
+			{"armed", &missionState{}},
+			{"armed mission-1", &missionState{ID: "mission-1"}},
+			{" TAKEOFF  mission-1 ", &missionState{ID: "mission-1"}},
+			{"landed mission-1", nil},
+			{"disarmed", nil},
+		} {
+			mission, err := parseFlightState(c.data)
+			So(err, ShouldBeNil)
+			So(mission, ShouldResemble, c.mission)
+		}
+		for _, data := range []string{"", "flying", "armed a b"} {
+			_, err := parseFlightState(data)
+			So(err, ShouldNotBeNil)
+		}
+	})
+	Convey("Scenario: the mission ID is set on the active session when it becomes known", t, func() {
+		root := t.TempDir()
+		start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+		dir := filepath.Join(root, start.Format(timeFormat))
+		So(os.Mkdir(dir, 0o700), ShouldBeNil)
+		history := newSessionHistory(root)
+		r := &missionDataRecorder{Logger: fakeLogger{}, History: history, currentDir: dir}
+		r.startSession()
+		So(r.Status().Session.MissionID, ShouldBeEmpty)
+
+		So(r.SetMissionID("mission-1"), ShouldBeNil)
+		session, err := loadSession(dir)
+		So(err, ShouldBeNil)
+		So(session.MissionID, ShouldEqual, "mission-1")
+		So(r.Status().Session.MissionID, ShouldEqual, "mission-1")
+		So(history.Find(start, start.Add(time.Minute), start.Add(time.Hour)).MissionID, ShouldEqual, "mission-1")
+	})
+}
@@ -7,7 +7,9 @@ require (
 	github.com/fsnotify/fsnotify v1.5.1
 	github.com/golang-jwt/jwt/v4 v4.1.0
 	github.com/hashicorp/go-multierror v1.1.1
+	github.com/klauspost/compress v1.15.15
 	github.com/mattn/go-sqlite3 v1.14.9
+	github.com/pierrec/lz4/v4 v4.1.17
 	github.com/smartystreets/goconvey v1.6.4
 	github.com/spf13/pflag v1.0.5
 	github.com/tiiuae/go-configloader v0.0.0-20211122143239-2c49bf0e469b
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const apiPrefix = "/api/v1/"
+
+// apiServer serves the state of the recorder and controls the uploads over
+// HTTP. Every request must have the header "Authorization: Bearer <Token>".
+//
+// The endpoints are:
+//
+//	GET  /api/v1/status          State of the recorder, uploads and diagnostics
+//	GET  /api/v1/config          Current config
+//	GET  /api/v1/queue           Bags waiting to be uploaded
+//	GET  /api/v1/uploads         Recently finished uploads
+//	POST /api/v1/uploads/trigger Queue the bags whose upload failed again
+//	POST /api/v1/uploads/pause   Stop starting new uploads
+//	POST /api/v1/uploads/resume  Start uploading again
+//	GET  /api/v1/bags/<path>     Download a bag in the destination directory
+//
+// Paths of bags are relative to the destination directory.
+type apiServer struct {
+	// Addr is the address the server listens on. If empty, the server is
+	// not started. If the host is empty and TLS isn't used, the server
+	// listens only on the loopback interface, so that the token isn't sent
+	// over the network in plain text.
+	Addr    string
+	Token   string
+	DestDir string
+	// If both are set, the API is served over HTTPS using the certificate
+	// and key in these files.
+	TLSCertFile string
+	TLSKeyFile  string
+	// UploadContext is used for the uploads started by requests.
+	UploadContext context.Context
+
+	Config      func() *updatableConfig
+	Recorder    *missionDataRecorder
+	Uploads     *uploadManager
+	Diagnostics *diagnosticsMonitor
+
+	logger logger
+}
+
+type apiUploadStatus struct {
+	// Paused is true if uploads are deferred while a mission is active.
+	Paused bool `json:"paused"`
+	// Held is true if uploads have been paused using the API.
+	Held      bool `json:"held"`
+	Queued    int  `json:"queued"`
+	Uploading int  `json:"uploading"`
+	Failed    int  `json:"failed"`
+}
+
+type apiStatus struct {
+	Recorder    *recorderStatus             `json:"recorder"`
+	Uploads     apiUploadStatus             `json:"uploads"`
+	Diagnostics map[string]diagnosticStatus `json:"diagnostics,omitempty"`
+}
+
+// Run serves requests until ctx is done.
+func (s *apiServer) Run(ctx context.Context) error {
+	if s.Addr == "" {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	useTLS := s.TLSCertFile != "" && s.TLSKeyFile != ""
+	addr := apiListenAddr(s.Addr, useTLS)
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           s.Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	// The recorder keeps running if the API can't be served.
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		s.reportError(err)
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	errs := make(chan error, 1)
+	go func() {
+		if useTLS {
+			errs <- server.ServeTLS(ln, s.TLSCertFile, s.TLSKeyFile)
+		} else {
+			errs <- server.Serve(ln)
+		}
+	}()
+	s.logger.Infof("serving the HTTP API on %s", ln.Addr())
+	select {
+	case err := <-errs:
+		s.reportError(err)
+		<-ctx.Done()
+		return ctx.Err()
+	case <-ctx.Done():
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// Downloads of large bags may not finish in time.
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		server.Close()
+	}
+	return ctx.Err()
+}
+
+func (s *apiServer) reportError(err error) {
+	s.logger.Errorf("failed to serve the HTTP API: %v", err)
+	s.Diagnostics.ReportError("http api", err)
+}
+
+// apiListenAddr returns the address the API listens on when configured with
+// addr. Addresses without a host are bound to the loopback interface unless
+// TLS is used.
+func apiListenAddr(addr string, useTLS bool) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || host != "" || useTLS {
+		return addr
+	}
+	return net.JoinHostPort("127.0.0.1", port)
+}
+
+func (s *apiServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(apiPrefix+"status", s.handle(http.MethodGet, s.getStatus))
+	mux.HandleFunc(apiPrefix+"config", s.handle(http.MethodGet, s.getConfig))
+	mux.HandleFunc(apiPrefix+"queue", s.handle(http.MethodGet, s.getQueue))
+	mux.HandleFunc(apiPrefix+"uploads", s.handle(http.MethodGet, s.getUploads))
+	mux.HandleFunc(apiPrefix+"uploads/trigger", s.handle(http.MethodPost, s.triggerUploads))
+	mux.HandleFunc(apiPrefix+"uploads/pause", s.handle(http.MethodPost, s.pauseUploads))
+	mux.HandleFunc(apiPrefix+"uploads/resume", s.handle(http.MethodPost, s.resumeUploads))
+	mux.HandleFunc(apiPrefix+"bags/", s.handle(http.MethodGet, s.downloadBag))
+	return mux
+}
+
+// handle returns a handler which calls h for authorized requests with the
+// given method.
+func (s *apiServer) handle(method string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.authorized(r) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		h(w, r)
+	}
+}
+
+func (s *apiServer) authorized(r *http.Request) bool {
+	const prefix = "Bearer "
+	header := r.Header.Get("Authorization")
+	if s.Token == "" || !strings.HasPrefix(header, prefix) {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(header[len(prefix):]), []byte(s.Token)) == 1
+}
+
+func (s *apiServer) getStatus(w http.ResponseWriter, r *http.Request) {
+	status := apiStatus{
+		Recorder:    s.Recorder.Status(),
+		Diagnostics: s.Diagnostics.Snapshot(),
+	}
+	status.Uploads.Paused, status.Uploads.Held = s.Uploads.UploadState()
+	for _, bag := range s.Uploads.Queue() {
+		switch bag.State {
+		case bagStateQueued:
+			status.Uploads.Queued++
+		case bagStateUploading:
+			status.Uploads.Uploading++
+		case bagStateFailed:
+			status.Uploads.Failed++
+		}
+	}
+	s.writeJSON(w, status)
+}
+
+func (s *apiServer) getConfig(w http.ResponseWriter, r *http.Request) {
+	s.writeJSON(w, s.Config())
+}
+
+func (s *apiServer) getQueue(w http.ResponseWriter, r *http.Request) {
+	bags := s.Uploads.Queue()
+	for i := range bags {
+		bags[i].Path = s.relativePath(bags[i].Path)
+	}
+	s.writeJSON(w, bags)
+}
+
+func (s *apiServer) getUploads(w http.ResponseWriter, r *http.Request) {
+	uploads := s.Uploads.History()
+	for i := range uploads {
+		uploads[i].Path = s.relativePath(uploads[i].Path)
+	}
+	s.writeJSON(w, uploads)
+}
+
+func (s *apiServer) triggerUploads(w http.ResponseWriter, r *http.Request) {
+	s.writeJSON(w, map[string]int{"retried": s.Uploads.RetryFailed(s.UploadContext)})
+}
+
+func (s *apiServer) pauseUploads(w http.ResponseWriter, r *http.Request) {
+	s.logger.Infof("uploads paused using the HTTP API")
+	s.Uploads.HoldUploads()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *apiServer) resumeUploads(w http.ResponseWriter, r *http.Request) {
+	s.logger.Infof("uploads resumed using the HTTP API")
+	s.Uploads.ReleaseUploads(s.UploadContext)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *apiServer) downloadBag(w http.ResponseWriter, r *http.Request) {
+	path := filepath.Join(s.DestDir, filepath.FromSlash(strings.TrimPrefix(r.URL.Path, apiPrefix+"bags/")))
+	if rel, err := filepath.Rel(s.DestDir, path); err != nil ||
+		rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) || !isUploadFile(path) {
+		http.Error(w, "not a bag", http.StatusNotFound)
+		return
+	}
+	//#nosec G304 -- The path is checked to be a bag in the destination directory.
+	f, err := os.Open(path)
+	if err != nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filepath.Base(path)+`"`)
+	http.ServeContent(w, r, filepath.Base(path), info.ModTime(), f)
+}
+
+// isUploadFile reports whether path is a bag, log archive or artifact.
+func isUploadFile(path string) bool {
+	return bagFileRegex.MatchString(filepath.Base(path)) ||
+		newLogArchiveMetadata(path, false) != nil ||
+		newArtifactMetadata(path, false) != nil
+}
+
+// relativePath returns path relative to the destination directory.
+func (s *apiServer) relativePath(path string) string {
+	rel, err := filepath.Rel(s.DestDir, path)
+	if err != nil {
+		return path
+	}
+	return filepath.ToSlash(rel)
+}
+
+func (s *apiServer) writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		s.logger.Errorf("failed to write HTTP response: %v", err)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type failingUploader struct {
+	attempts chan *bagMetadata
+}
+
+func (u *failingUploader) WithCompression(compressionMode, int) uploaderInterface { return u }
+
+func (u *failingUploader) CompleteSession(context.Context, *sessionInfo) error { return nil }
+
+func (u *failingUploader) UploadSnapshot(context.Context, string, *sessionInfo) error { return nil }
+
+func (u *failingUploader) UploadBag(ctx context.Context, bag *bagMetadata) error {
+	u.attempts <- bag
+	return errors.New("no connection")
+}
+
+func TestAPIServer(t *testing.T) {
+	Convey("Scenario: the HTTP API reports the state of the uploads and controls them", t, func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		dir := t.TempDir()
+		bagPath := filepath.Join(dir, "session", "bag_0.db3")
+		So(os.Mkdir(filepath.Dir(bagPath), 0o700), ShouldBeNil)
+		So(os.WriteFile(bagPath, []byte("bag data"), 0o600), ShouldBeNil)
+		So(os.WriteFile(filepath.Join(dir, "session", sessionFileName), []byte("{}"), 0o600), ShouldBeNil)
+		uploader := &failingUploader{attempts: make(chan *bagMetadata, 1)}
+		uploads := newUploadManager(1, uploader, fakeLogger{}, nil)
+		config := &updatableConfig{SizeThreshold: 1000}
+		s := &apiServer{
+			Token:         "secret",
+			DestDir:       dir,
+			UploadContext: ctx,
+			Config:        func() *updatableConfig { return config },
+			Recorder:      &missionDataRecorder{},
+			Uploads:       uploads,
+			logger:        fakeLogger{},
+		}
+		server := httptest.NewServer(s.Handler())
+		defer server.Close()
+		request := func(method, path, token string) *http.Response {
+			req, err := http.NewRequest(method, server.URL+path, nil)
+			So(err, ShouldBeNil)
+			if token != "" {
+				req.Header.Set("Authorization", "Bearer "+token)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			So(err, ShouldBeNil)
+			return resp
+		}
+		get := func(path string, v interface{}) {
+			resp := request(http.MethodGet, path, "secret")
+			defer resp.Body.Close()
+			So(resp.StatusCode, ShouldEqual, http.StatusOK)
+			So(json.NewDecoder(resp.Body).Decode(v), ShouldBeNil)
+		}
+		waitForState := func(state string) {
+			deadline := time.Now().Add(5 * time.Second)
+			for time.Now().Before(deadline) {
+				if q := uploads.Queue(); len(q) == 1 && q[0].State == state {
+					return
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			t.Fatalf("bag didn't reach state %s", state)
+		}
+
+		So(request(http.MethodGet, "/api/v1/status", "").StatusCode, ShouldEqual, http.StatusUnauthorized)
+		So(request(http.MethodGet, "/api/v1/status", "wrong").StatusCode, ShouldEqual, http.StatusUnauthorized)
+		So(request(http.MethodGet, "/api/v1/uploads/pause", "secret").StatusCode, ShouldEqual, http.StatusMethodNotAllowed)
+
+		var gotConfig map[string]interface{}
+		get("/api/v1/config", &gotConfig)
+		So(gotConfig["SizeThreshold"], ShouldEqual, 1000)
+
+		So(request(http.MethodPost, "/api/v1/uploads/pause", "secret").StatusCode, ShouldEqual, http.StatusNoContent)
+		uploads.AddBag(ctx, newBagMetadata(bagPath, 0, true))
+		var queue []queuedBag
+		get("/api/v1/queue", &queue)
+		So(queue, ShouldResemble, []queuedBag{{Path: "session/bag_0.db3", Kind: "bag", Size: 8, State: bagStateQueued}})
+		var status apiStatus
+		get("/api/v1/status", &status)
+		So(status.Uploads, ShouldResemble, apiUploadStatus{Held: true, Queued: 1})
+
+		So(request(http.MethodPost, "/api/v1/uploads/resume", "secret").StatusCode, ShouldEqual, http.StatusNoContent)
+		<-uploader.attempts
+		waitForState(bagStateFailed)
+		var history []uploadRecord
+		get("/api/v1/uploads", &history)
+		So(history, ShouldHaveLength, 1)
+		So(history[0].Path, ShouldEqual, "session/bag_0.db3")
+		So(history[0].Size, ShouldEqual, 8)
+		So(history[0].Error, ShouldEqual, "no connection")
+
+		var retried map[string]int
+		resp := request(http.MethodPost, "/api/v1/uploads/trigger", "secret")
+		So(json.NewDecoder(resp.Body).Decode(&retried), ShouldBeNil)
+		resp.Body.Close()
+		So(retried["retried"], ShouldEqual, 1)
+		<-uploader.attempts
+		waitForState(bagStateFailed)
+
+		resp = request(http.MethodGet, "/api/v1/bags/session/bag_0.db3", "secret")
+		data, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		So(err, ShouldBeNil)
+		So(resp.StatusCode, ShouldEqual, http.StatusOK)
+		So(string(data), ShouldEqual, "bag data")
+		So(request(http.MethodGet, "/api/v1/bags/session/"+sessionFileName, "secret").StatusCode, ShouldEqual, http.StatusNotFound)
+		So(request(http.MethodGet, "/api/v1/bags/session/bag_1.db3", "secret").StatusCode, ShouldEqual, http.StatusNotFound)
+	})
+	Convey("Scenario: a failure to listen is reported without stopping the recorder", t, func() {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		defer ln.Close()
+		diagnostics := &diagnosticsMonitor{diagnostics: make(map[string]*diagnostic)}
+		s := &apiServer{Addr: ln.Addr().String(), Diagnostics: diagnostics, logger: fakeLogger{}}
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		So(errors.Is(s.Run(ctx), context.DeadlineExceeded), ShouldBeTrue)
+		So(diagnostics.Snapshot()["http api"].Level, ShouldEqual, "error")
+	})
+	Convey("Scenario: addresses without a host listen on localhost unless TLS is used", t, func() {
+		So(apiListenAddr(":8080", false), ShouldEqual, "127.0.0.1:8080")
+		So(apiListenAddr(":8080", true), ShouldEqual, ":8080")
+		So(apiListenAddr("0.0.0.0:8080", false), ShouldEqual, "0.0.0.0:8080")
+	})
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	parameterEventsTopic = "/parameter_events"
+	// serviceEventSuffix is appended to the name of a service to get the
+	// topic where its requests and responses are published when service
+	// introspection is enabled. Service introspection is available since ROS
+	// 2 Iron and must be enabled by the node providing the service.
+	serviceEventSuffix = "/_service_event"
+	// actionInfix separates the name of an action from the names of the
+	// topics and services implementing it.
+	actionInfix = "/_action/"
+)
+
+// Regular expressions matching the topics of all services and actions.
+const (
+	allServicesRegex = serviceEventSuffix + "$"
+	allActionsRegex  = actionInfix
+)
+
+func serviceEventTopic(service string) string {
+	return service + serviceEventSuffix
+}
+
+// actionTopics returns the feedback and status topics of action and the event
+// topics of its goal, result and cancel services.
+func actionTopics(action string) []string {
+	prefix := action + actionInfix
+	return []string{
+		prefix + "feedback",
+		prefix + "status",
+		serviceEventTopic(prefix + "send_goal"),
+		serviceEventTopic(prefix + "get_result"),
+		serviceEventTopic(prefix + "cancel_goal"),
+	}
+}
+
+func validateInterfaceNames(kind string, l topicList) error {
+	for _, name := range l.Topics {
+		if !strings.HasPrefix(name, "/") {
+			return fmt.Errorf("%s '%s' must be an absolute name", kind, name)
+		}
+	}
+	return nil
+}
+
+// topicSelection is the set of topics recorded by ros bag record.
+type topicSelection struct {
+	// If All is true, all topics are recorded and Topics and Regex are empty.
+	All    bool
+	Topics []string
+	Regex  string
+	// Service events and action topics are hidden, so they are recorded only
+	// if hidden topics are included.
+	IncludeHidden bool
+}
+
+func (s *topicSelection) empty() bool {
+	return !s.All && len(s.Topics) == 0 && s.Regex == ""
+}
+
+// matcher returns a function reporting whether a topic is recorded. The regular
+// expression must match the whole name like in ros bag record. If it is
+// invalid, only the listed topics are matched.
+func (s *topicSelection) matcher() func(topic string) bool {
+	topics := make(map[string]bool, len(s.Topics))
+	for _, topic := range s.Topics {
+		topics[topic] = true
+	}
+	var regex *regexp.Regexp
+	if s.Regex != "" {
+		regex, _ = regexp.Compile(`^(?:` + s.Regex + `)$`)
+	}
+	all, includeHidden := s.All, s.IncludeHidden
+	return func(topic string) bool {
+		if topics[topic] {
+			return true
+		}
+		if !includeHidden && strings.Contains(topic, "/_") {
+			return false
+		}
+		return all || (regex != nil && regex.MatchString(topic))
+	}
+}
+
+// selectTopics returns the topics recorded to capture the topics, services,
+// actions and parameter events selected in config. If all topics are
+// recorded, all hidden topics are recorded too when any services or actions
+// are selected.
+func selectTopics(config *updatableConfig) topicSelection {
+	sel := topicSelection{
+		All:           config.Topics.All,
+		IncludeHidden: hasInterfaces(config.Services) || hasInterfaces(config.Actions),
+	}
+	if sel.All {
+		return sel
+	}
+	sel.Topics = append(sel.Topics, config.Topics.Topics...)
+	var regexes []string
+	if config.RecorderOptions.TopicRegex != "" {
+		regexes = append(regexes, config.RecorderOptions.TopicRegex)
+	}
+	if config.Services.All {
+		regexes = append(regexes, allServicesRegex)
+	}
+	for _, service := range config.Services.Topics {
+		sel.Topics = append(sel.Topics, serviceEventTopic(service))
+	}
+	if config.Actions.All {
+		regexes = append(regexes, allActionsRegex)
+	}
+	for _, action := range config.Actions.Topics {
+		sel.Topics = append(sel.Topics, actionTopics(action)...)
+	}
+	if config.ParameterEvents {
+		sel.Topics = append(sel.Topics, parameterEventsTopic)
+	}
+	if len(regexes) == 1 {
+		sel.Regex = regexes[0]
+	} else if len(regexes) > 1 {
+		sel.Regex = "(" + strings.Join(regexes, ")|(") + ")"
+	}
+	return sel
+}
+
+func hasInterfaces(l topicList) bool {
+	return l.All || len(l.Topics) > 0
+}
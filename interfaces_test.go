@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestSelectTopics(t *testing.T) {
+	Convey("Scenario: services, actions and parameter events are recorded as topics", t, func() {
+		config := &updatableConfig{
+			Topics:          topicList{Topics: []string{"/a"}},
+			Services:        topicList{Topics: []string{"/set_mode"}},
+			Actions:         topicList{Topics: []string{"/navigate"}},
+			ParameterEvents: true,
+		}
+		So(selectTopics(config), ShouldResemble, topicSelection{
+			Topics: []string{
+				"/a",
+				"/set_mode/_service_event",
+				"/navigate/_action/feedback",
+				"/navigate/_action/status",
+				"/navigate/_action/send_goal/_service_event",
+				"/navigate/_action/get_result/_service_event",
+				"/navigate/_action/cancel_goal/_service_event",
+				"/parameter_events",
+			},
+			IncludeHidden: true,
+		})
+	})
+	Convey("Scenario: all services and actions are matched by a regex", t, func() {
+		config := &updatableConfig{
+			Services:        topicList{All: true},
+			Actions:         topicList{All: true},
+			RecorderOptions: recorderOptions{TopicRegex: "^/camera/"},
+		}
+		sel := selectTopics(config)
+		So(sel.Topics, ShouldBeEmpty)
+		So(sel.Regex, ShouldEqual, "(^/camera/)|(/_service_event$)|(/_action/)")
+		So(sel.IncludeHidden, ShouldBeTrue)
+	})
+	Convey("Scenario: hidden topics are included when all topics are recorded", t, func() {
+		sel := selectTopics(&updatableConfig{
+			Topics:   topicList{All: true},
+			Services: topicList{Topics: []string{"/set_mode"}},
+		})
+		So(sel, ShouldResemble, topicSelection{All: true, IncludeHidden: true})
+		sel = selectTopics(&updatableConfig{})
+		So(sel.empty(), ShouldBeTrue)
+	})
+}
@@ -1,36 +1,45 @@
 package internal
 
-/*
-#cgo CXXFLAGS: -I /opt/ros/galactic/include -std=c++17
-#cgo LDFLAGS: -L /opt/ros/galactic/lib -Wl,-rpath=/opt/ros/galactic/lib
-#cgo LDFLAGS: -lrosbag2_cpp -lrosbag2_storage -lrcutils -lrclcpp
-#cgo LDFLAGS: -lstd_msgs__rosidl_typesupport_cpp
+import (
+	"context"
+	"fmt"
+	"path/filepath"
 
-#include <stdlib.h>
-
-#include "read_rosbag.h"
-*/
-import "C"
-import "unsafe"
+	"github.com/tiiuae/mission-data-recorder/internal/rosbag"
+)
 
 type RosbagData struct {
 	topic, data string
 }
 
+// ReadRosbag reads the std_msgs/String messages from the bag at path. Only bags
+// using the sqlite3 storage format are supported. ReadRosbag panics if the bag
+// can't be read.
 func ReadRosbag(path string) []interface{} {
-	cpath := C.CString(path)
-	defer C.free(unsafe.Pointer(cpath))
-	cdata := C.readRosbag(cpath)
-	defer C.free(unsafe.Pointer(cdata.data))
-	cmsgs := (*[1 << 31]C.RosbagMsg)(unsafe.Pointer(cdata.data))
-	data := make([]interface{}, cdata.len)
-	for i := range data {
-		data[i] = RosbagData{
-			topic: C.GoString(cmsgs[i].topic),
-			data:  C.GoString(cmsgs[i].data),
+	if ext := filepath.Ext(path); ext != ".db3" {
+		panic(fmt.Sprintf("unsupported bag format: %s", ext))
+	}
+	bag, err := rosbag.Open(path)
+	if err != nil {
+		panic(err)
+	}
+	defer bag.Close()
+	msgs, err := bag.Messages(context.Background())
+	if err != nil {
+		panic(err)
+	}
+	defer msgs.Close()
+	var data []interface{}
+	for msgs.Next() {
+		msg := msgs.Message()
+		var s struct{ Data string }
+		if err := rosbag.Unmarshal(msg.Data, &s); err != nil {
+			panic(err)
 		}
-		C.free(unsafe.Pointer(cmsgs[i].topic))
-		C.free(unsafe.Pointer(cmsgs[i].data))
+		data = append(data, RosbagData{topic: msg.Topic, data: s.Data})
+	}
+	if err := msgs.Err(); err != nil {
+		panic(err)
 	}
 	return data
 }
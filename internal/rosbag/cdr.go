@@ -0,0 +1,215 @@
+package rosbag
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+)
+
+// CDR encapsulation kinds. Only plain CDR is supported.
+const (
+	cdrBE = 0x00
+	cdrLE = 0x01
+
+	cdrHeaderSize = 4
+)
+
+var errShortBuffer = errors.New("CDR data is too short")
+
+// Unmarshal decodes a CDR-serialized ROS 2 message into msg, which must be a
+// pointer to a struct generated by rclgo-gen or to a struct with the same
+// layout. Wide strings are not supported, because they can't be distinguished
+// from strings in the generated types.
+func Unmarshal(data []byte, msg interface{}) error {
+	v := reflect.ValueOf(msg)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("rosbag: Unmarshal requires a non-nil struct pointer, got %T", msg)
+	}
+	if len(data) < cdrHeaderSize {
+		return errShortBuffer
+	}
+	d := &cdrDecoder{data: data[cdrHeaderSize:]}
+	switch data[1] {
+	case cdrBE:
+		d.order = binary.BigEndian
+	case cdrLE:
+		d.order = binary.LittleEndian
+	default:
+		return fmt.Errorf("unsupported CDR encapsulation: %#x", data[:2])
+	}
+	if err := d.decode(v.Elem()); err != nil {
+		return fmt.Errorf("failed to decode %s: %w", v.Elem().Type(), err)
+	}
+	return nil
+}
+
+type cdrDecoder struct {
+	data  []byte
+	pos   int
+	order binary.ByteOrder
+}
+
+// read returns the next n bytes after aligning the position to align bytes.
+// The alignment is relative to the end of the encapsulation header.
+func (d *cdrDecoder) read(n, align int) ([]byte, error) {
+	if rem := d.pos % align; rem != 0 {
+		d.pos += align - rem
+	}
+	if n < 0 || d.pos+n > len(d.data) {
+		return nil, errShortBuffer
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+func (d *cdrDecoder) uint32() (uint32, error) {
+	b, err := d.read(4, 4)
+	if err != nil {
+		return 0, err
+	}
+	return d.order.Uint32(b), nil
+}
+
+func (d *cdrDecoder) decode(v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Bool:
+		b, err := d.read(1, 1)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b[0] != 0)
+	case reflect.Int8:
+		b, err := d.read(1, 1)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(int8(b[0])))
+	case reflect.Uint8:
+		b, err := d.read(1, 1)
+		if err != nil {
+			return err
+		}
+		v.SetUint(uint64(b[0]))
+	case reflect.Int16:
+		b, err := d.read(2, 2)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(int16(d.order.Uint16(b))))
+	case reflect.Uint16:
+		b, err := d.read(2, 2)
+		if err != nil {
+			return err
+		}
+		v.SetUint(uint64(d.order.Uint16(b)))
+	case reflect.Int32:
+		x, err := d.uint32()
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(int32(x)))
+	case reflect.Uint32:
+		x, err := d.uint32()
+		if err != nil {
+			return err
+		}
+		v.SetUint(uint64(x))
+	case reflect.Float32:
+		x, err := d.uint32()
+		if err != nil {
+			return err
+		}
+		v.SetFloat(float64(math.Float32frombits(x)))
+	case reflect.Int64:
+		b, err := d.read(8, 8)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d.order.Uint64(b)))
+	case reflect.Uint64:
+		b, err := d.read(8, 8)
+		if err != nil {
+			return err
+		}
+		v.SetUint(d.order.Uint64(b))
+	case reflect.Float64:
+		b, err := d.read(8, 8)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(math.Float64frombits(d.order.Uint64(b)))
+	case reflect.String:
+		n, err := d.uint32()
+		if err != nil {
+			return err
+		}
+		b, err := d.read(int(n), 1)
+		if err != nil {
+			return err
+		}
+		// The length includes the terminating null character.
+		if len(b) > 0 && b[len(b)-1] == 0 {
+			b = b[:len(b)-1]
+		}
+		v.SetString(string(b))
+	case reflect.Slice:
+		n, err := d.uint32()
+		if err != nil {
+			return err
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			b, err := d.read(int(n), 1)
+			if err != nil {
+				return err
+			}
+			v.SetBytes(append([]byte(nil), b...))
+			return nil
+		}
+		// Every element takes at least one byte, which prevents allocating
+		// huge slices for corrupted data.
+		if int(n) > len(d.data)-d.pos {
+			return errShortBuffer
+		}
+		v.Set(reflect.MakeSlice(v.Type(), int(n), int(n)))
+		return d.decodeElems(v)
+	case reflect.Array:
+		return d.decodeElems(v)
+	case reflect.Struct:
+		return d.decodeStruct(v)
+	default:
+		return fmt.Errorf("unsupported type: %s", v.Type())
+	}
+	return nil
+}
+
+func (d *cdrDecoder) decodeElems(v reflect.Value) error {
+	for i := 0; i < v.Len(); i++ {
+		if err := d.decode(v.Index(i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *cdrDecoder) decodeStruct(v reflect.Value) error {
+	t := v.Type()
+	decoded := 0
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).PkgPath != "" {
+			continue
+		}
+		if err := d.decode(v.Field(i)); err != nil {
+			return fmt.Errorf("field %s: %w", t.Field(i).Name, err)
+		}
+		decoded++
+	}
+	// Messages without fields are serialized with a single placeholder byte.
+	if decoded == 0 {
+		_, err := d.read(1, 1)
+		return err
+	}
+	return nil
+}
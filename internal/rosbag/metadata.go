@@ -0,0 +1,138 @@
+package rosbag
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"path/filepath"
+)
+
+// metadataVersion is the newest metadata version whose fields are all
+// supported by BuildMetadata.
+const metadataVersion = 4
+
+// Metadata is the contents of the metadata.yaml file of a bag directory.
+type Metadata struct {
+	Info MetadataInfo `yaml:"rosbag2_bagfile_information"`
+}
+
+type MetadataInfo struct {
+	Version                int                `yaml:"version"`
+	StorageIdentifier      string             `yaml:"storage_identifier"`
+	RelativeFilePaths      []string           `yaml:"relative_file_paths"`
+	Duration               MetadataDuration   `yaml:"duration"`
+	StartingTime           MetadataTime       `yaml:"starting_time"`
+	MessageCount           int64              `yaml:"message_count"`
+	TopicsWithMessageCount []TopicMessageInfo `yaml:"topics_with_message_count"`
+	CompressionFormat      string             `yaml:"compression_format"`
+	CompressionMode        string             `yaml:"compression_mode"`
+}
+
+type MetadataDuration struct {
+	Nanoseconds int64 `yaml:"nanoseconds"`
+}
+
+type MetadataTime struct {
+	NanosecondsSinceEpoch int64 `yaml:"nanoseconds_since_epoch"`
+}
+
+type TopicMessageInfo struct {
+	TopicMetadata TopicMetadata `yaml:"topic_metadata"`
+	MessageCount  int64         `yaml:"message_count"`
+}
+
+type TopicMetadata struct {
+	Name                string `yaml:"name"`
+	Type                string `yaml:"type"`
+	SerializationFormat string `yaml:"serialization_format"`
+	OfferedQoSProfiles  string `yaml:"offered_qos_profiles"`
+}
+
+// BuildMetadata builds the metadata of the bag consisting of the files at
+// paths by reading the files.
+func BuildMetadata(ctx context.Context, paths ...string) (*Metadata, error) {
+	info := MetadataInfo{
+		Version:           metadataVersion,
+		StorageIdentifier: "sqlite3",
+	}
+	var (
+		start, end = int64(math.MaxInt64), int64(math.MinInt64)
+		topicIndex = make(map[string]int)
+	)
+	for _, path := range paths {
+		bag, err := Open(path)
+		if err != nil {
+			return nil, err
+		}
+		stats, err := bag.topicStats(ctx)
+		bag.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		info.RelativeFilePaths = append(info.RelativeFilePaths, filepath.Base(path))
+		for _, s := range stats {
+			i, ok := topicIndex[s.Name]
+			if !ok {
+				i = len(info.TopicsWithMessageCount)
+				topicIndex[s.Name] = i
+				info.TopicsWithMessageCount = append(info.TopicsWithMessageCount, TopicMessageInfo{
+					TopicMetadata: TopicMetadata{
+						Name:                s.Name,
+						Type:                s.Type,
+						SerializationFormat: s.SerializationFormat,
+						OfferedQoSProfiles:  s.OfferedQoSProfiles,
+					},
+				})
+			}
+			info.TopicsWithMessageCount[i].MessageCount += s.count
+			info.MessageCount += s.count
+			if s.count > 0 {
+				if s.start < start {
+					start = s.start
+				}
+				if s.end > end {
+					end = s.end
+				}
+			}
+		}
+	}
+	if info.MessageCount > 0 {
+		info.StartingTime.NanosecondsSinceEpoch = start
+		info.Duration.Nanoseconds = end - start
+	}
+	return &Metadata{Info: info}, nil
+}
+
+type topicStats struct {
+	Topic
+	count, start, end int64
+}
+
+func (b *Bag) topicStats(ctx context.Context) ([]topicStats, error) {
+	topics, err := b.Topics(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := b.db.QueryContext(ctx, `SELECT topic_id, COUNT(*), MIN(timestamp), MAX(timestamp)
+		FROM messages GROUP BY topic_id`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query messages: %w", err)
+	}
+	defer rows.Close()
+	stats := make([]topicStats, len(topics))
+	index := make(map[int64]int, len(topics))
+	for i, t := range topics {
+		stats[i].Topic = t
+		index[t.ID] = i
+	}
+	for rows.Next() {
+		var id, count, start, end int64
+		if err = rows.Scan(&id, &count, &start, &end); err != nil {
+			return nil, err
+		}
+		if i, ok := index[id]; ok {
+			stats[i].count, stats[i].start, stats[i].end = count, start, end
+		}
+	}
+	return stats, rows.Err()
+}
@@ -0,0 +1,212 @@
+package rosbag
+
+import (
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// ErrCorrupt is returned by CheckIntegrity if the bag is corrupted.
+var ErrCorrupt = errors.New("bag is corrupted")
+
+// Checkpoint moves the contents of the write-ahead log, if any, to the bag
+// file. This is needed if the recorder was stopped before it could do it.
+func (b *Bag) Checkpoint(ctx context.Context) error {
+	if _, err := b.db.ExecContext(ctx, "PRAGMA wal_checkpoint(TRUNCATE)"); err != nil {
+		return fmt.Errorf("failed to checkpoint write-ahead log: %w", err)
+	}
+	return nil
+}
+
+// CheckIntegrity runs the SQLite integrity check and verifies that the messages
+// of the bag can be read. The returned error wraps ErrCorrupt if the check
+// found problems.
+func (b *Bag) CheckIntegrity(ctx context.Context) error {
+	rows, err := b.db.QueryContext(ctx, "PRAGMA integrity_check")
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrCorrupt, err)
+	}
+	defer rows.Close()
+	var problems []string
+	for rows.Next() {
+		var problem string
+		if err = rows.Scan(&problem); err != nil {
+			return fmt.Errorf("%w: %v", ErrCorrupt, err)
+		}
+		if problem != "ok" {
+			problems = append(problems, problem)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("%w: %v", ErrCorrupt, err)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%w: %s", ErrCorrupt, strings.Join(problems, "; "))
+	}
+	if _, err = b.Topics(ctx); err != nil {
+		return fmt.Errorf("%w: %v", ErrCorrupt, err)
+	}
+	if _, err = b.StartTime(ctx); err != nil && !errors.Is(err, ErrEmpty) {
+		return fmt.Errorf("%w: %v", ErrCorrupt, err)
+	}
+	return nil
+}
+
+// Recover copies the schema, the topics and as many messages as can be read
+// from the bag at src to a new bag at dst. Messages are copied in the order
+// they were written until the first unreadable row. The number of recovered
+// messages is returned. If some messages were recovered, the returned error
+// describes why the rest were lost. The write-ahead log of src is ignored.
+func Recover(ctx context.Context, src, dst string) (recovered int64, err error) {
+	work := dst + ".tmp"
+	if err = copyWithRepairedHeader(src, work); err != nil {
+		return 0, fmt.Errorf("failed to copy bag: %w", err)
+	}
+	defer os.Remove(work)
+	bag, err := Open(work)
+	if err != nil {
+		return 0, err
+	}
+	defer bag.Close()
+	if err = os.Remove(dst); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return 0, err
+	}
+	out, err := sql.Open("sqlite3", dst)
+	if err != nil {
+		return 0, err
+	}
+	defer out.Close()
+	if err = copySchema(ctx, bag.db, out); err != nil {
+		return 0, err
+	}
+	if err = copyTopics(ctx, bag, out); err != nil {
+		return 0, err
+	}
+	tx, err := out.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if commitErr := tx.Commit(); commitErr != nil && err == nil {
+			recovered, err = 0, commitErr
+		}
+	}()
+	rows, err := bag.db.QueryContext(ctx, "SELECT id, topic_id, timestamp, data FROM messages ORDER BY id")
+	if err != nil {
+		return 0, fmt.Errorf("failed to query messages: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			id, topicID, timestamp int64
+			data                   []byte
+		)
+		if err = rows.Scan(&id, &topicID, &timestamp, &data); err != nil {
+			return recovered, err
+		}
+		_, err = tx.ExecContext(ctx,
+			"INSERT INTO messages(id, topic_id, timestamp, data) VALUES(?, ?, ?, ?)",
+			id, topicID, timestamp, data,
+		)
+		if err != nil {
+			return recovered, err
+		}
+		recovered++
+	}
+	return recovered, rows.Err()
+}
+
+func copySchema(ctx context.Context, src, dst *sql.DB) error {
+	rows, err := src.QueryContext(ctx, `SELECT sql FROM sqlite_master
+		WHERE sql IS NOT NULL AND name NOT LIKE 'sqlite_%' ORDER BY rowid`)
+	if err != nil {
+		return fmt.Errorf("failed to read schema: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var stmt string
+		if err = rows.Scan(&stmt); err != nil {
+			return fmt.Errorf("failed to read schema: %w", err)
+		}
+		if _, err = dst.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("failed to create schema: %w", err)
+		}
+	}
+	return rows.Err()
+}
+
+func copyTopics(ctx context.Context, src *Bag, dst *sql.DB) error {
+	topics, err := src.Topics(ctx)
+	if err != nil {
+		return err
+	}
+	for _, t := range topics {
+		_, err = dst.ExecContext(ctx,
+			`INSERT INTO topics(id, name, type, serialization_format, offered_qos_profiles)
+			VALUES(?, ?, ?, ?, ?)`,
+			t.ID, t.Name, t.Type, t.SerializationFormat, t.OfferedQoSProfiles,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to copy topic: %w", err)
+		}
+	}
+	return nil
+}
+
+// SQLite database header fields. See https://www.sqlite.org/fileformat.html.
+const (
+	sqliteHeaderSize       = 100
+	sqlitePageSizeOffset   = 16
+	sqlitePageCountOffset  = 28
+	sqliteMaxPageSizeValue = 1
+)
+
+// copyWithRepairedHeader copies the database at src to dst. If src has been
+// truncated, the database size in the header of the copy is set to the actual
+// size, because SQLite refuses to read databases which are smaller than their
+// header claims.
+func copyWithRepairedHeader(src, dst string) error {
+	//#nosec G304 -- The path is given by the caller.
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	//#nosec G304 -- The path is given by the caller.
+	out, err := os.OpenFile(dst, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	size, err := io.Copy(out, in)
+	if err != nil {
+		return err
+	}
+	if size < sqliteHeaderSize {
+		return ErrCorrupt
+	}
+	header := make([]byte, sqliteHeaderSize)
+	if _, err = out.ReadAt(header, 0); err != nil {
+		return err
+	}
+	pageSize := int64(binary.BigEndian.Uint16(header[sqlitePageSizeOffset:]))
+	if pageSize == sqliteMaxPageSizeValue {
+		pageSize = 1 << 16
+	}
+	if pageSize == 0 {
+		return ErrCorrupt
+	}
+	pageCount := uint32(size / pageSize)
+	if binary.BigEndian.Uint32(header[sqlitePageCountOffset:]) > pageCount {
+		binary.BigEndian.PutUint32(header[sqlitePageCountOffset:], pageCount)
+		if _, err = out.WriteAt(header[sqlitePageCountOffset:sqlitePageCountOffset+4], sqlitePageCountOffset); err != nil {
+			return err
+		}
+	}
+	return out.Close()
+}
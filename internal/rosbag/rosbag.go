@@ -0,0 +1,146 @@
+// Package rosbag reads rosbag2 bags stored using the sqlite3 storage plugin
+// without depending on a ROS 2 installation.
+package rosbag
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3" // Registers the sqlite3 driver.
+)
+
+// ErrEmpty is returned by StartTime if the bag contains no messages.
+var ErrEmpty = errors.New("bag is empty")
+
+// Bag is a rosbag2 SQLite database.
+type Bag struct {
+	db *sql.DB
+}
+
+// Topic describes a topic recorded in a bag.
+type Topic struct {
+	ID                  int64
+	Name                string
+	Type                string
+	SerializationFormat string
+	OfferedQoSProfiles  string
+}
+
+// Message is a serialized message recorded in a bag.
+type Message struct {
+	Topic     string
+	Timestamp time.Time
+	Data      []byte
+}
+
+// Open opens the bag file at path. The file must exist.
+func Open(path string) (*Bag, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+	return &Bag{db: db}, nil
+}
+
+func (b *Bag) Close() error {
+	return b.db.Close()
+}
+
+// Topics returns the topics recorded in the bag ordered by their IDs.
+func (b *Bag) Topics(ctx context.Context) ([]Topic, error) {
+	rows, err := b.db.QueryContext(ctx, `SELECT id, name, type, serialization_format, offered_qos_profiles
+		FROM topics ORDER BY id`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query topics: %w", err)
+	}
+	defer rows.Close()
+	var topics []Topic
+	for rows.Next() {
+		var t Topic
+		if err = rows.Scan(&t.ID, &t.Name, &t.Type, &t.SerializationFormat, &t.OfferedQoSProfiles); err != nil {
+			return nil, fmt.Errorf("failed to read topic: %w", err)
+		}
+		topics = append(topics, t)
+	}
+	return topics, rows.Err()
+}
+
+// StartTime returns the timestamp of the first message in the bag.
+func (b *Bag) StartTime(ctx context.Context) (time.Time, error) {
+	var timestamp int64
+	err := b.db.QueryRowContext(ctx, "SELECT timestamp FROM messages ORDER BY timestamp LIMIT 1").Scan(&timestamp)
+	if errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, ErrEmpty
+	} else if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, timestamp).UTC(), nil
+}
+
+// Messages returns an iterator over the messages in the bag ordered by their
+// timestamps. If topics is non-empty, only the messages of the given topics
+// are returned. The iterator must be closed after use.
+func (b *Bag) Messages(ctx context.Context, topics ...string) (*Messages, error) {
+	query := `SELECT topics.name, messages.timestamp, messages.data
+		FROM messages JOIN topics ON messages.topic_id = topics.id`
+	args := make([]interface{}, len(topics))
+	if len(topics) > 0 {
+		query += " WHERE topics.name IN (?" + strings.Repeat(", ?", len(topics)-1) + ")"
+		for i, t := range topics {
+			args[i] = t
+		}
+	}
+	query += " ORDER BY messages.timestamp, messages.id"
+	rows, err := b.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query messages: %w", err)
+	}
+	return &Messages{rows: rows}, nil
+}
+
+// Messages iterates over the messages of a bag.
+type Messages struct {
+	rows *sql.Rows
+	msg  Message
+	err  error
+}
+
+// Next advances the iterator to the next message. It returns false when there
+// are no more messages or an error occurred.
+func (m *Messages) Next() bool {
+	if m.err != nil || !m.rows.Next() {
+		return false
+	}
+	var timestamp int64
+	m.msg = Message{}
+	if m.err = m.rows.Scan(&m.msg.Topic, &timestamp, &m.msg.Data); m.err != nil {
+		return false
+	}
+	m.msg.Timestamp = time.Unix(0, timestamp).UTC()
+	return true
+}
+
+// Message returns the current message.
+func (m *Messages) Message() Message {
+	return m.msg
+}
+
+// Err returns the error which stopped the iteration, if any.
+func (m *Messages) Err() error {
+	if m.err != nil {
+		return m.err
+	}
+	return m.rows.Err()
+}
+
+func (m *Messages) Close() error {
+	return m.rows.Close()
+}
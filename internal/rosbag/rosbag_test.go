@@ -0,0 +1,228 @@
+package rosbag
+
+import (
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type cdrEncoder struct {
+	data []byte
+}
+
+func newCDREncoder() *cdrEncoder {
+	return &cdrEncoder{data: []byte{0, cdrLE, 0, 0}}
+}
+
+func (e *cdrEncoder) write(align int, b ...byte) {
+	for (len(e.data)-cdrHeaderSize)%align != 0 {
+		e.data = append(e.data, 0)
+	}
+	e.data = append(e.data, b...)
+}
+
+func (e *cdrEncoder) uint32(x uint32) {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, x)
+	e.write(4, b...)
+}
+
+func (e *cdrEncoder) float64(x float64) {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, math.Float64bits(x))
+	e.write(8, b...)
+}
+
+func (e *cdrEncoder) string(s string) {
+	e.uint32(uint32(len(s) + 1))
+	e.write(1, append([]byte(s), 0)...)
+}
+
+type testTime struct {
+	Sec     int32
+	Nanosec uint32
+}
+
+type testEmpty struct{}
+
+type testMessage struct {
+	Flag   bool
+	Count  int32
+	Name   string
+	Stamp  testTime
+	Values []float64
+	Raw    []byte
+	Fixed  [2]int16
+	Names  []string
+	Empty  testEmpty
+	Last   uint8
+}
+
+func encodeTestMessage() []byte {
+	e := newCDREncoder()
+	e.write(1, 1)
+	e.uint32(math.MaxUint32 - 1)
+	e.string("hello")
+	e.uint32(3)
+	e.uint32(4)
+	e.uint32(2)
+	e.float64(1.5)
+	e.float64(-2)
+	e.uint32(3)
+	e.write(1, 7, 8, 9)
+	e.write(2, 0xff, 0xff)
+	e.write(2, 5, 0)
+	e.uint32(2)
+	e.string("a")
+	e.string("")
+	e.write(1, 0)
+	e.write(1, 42)
+	return e.data
+}
+
+func createBag(t *testing.T, path string) {
+	t.Helper()
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	_, err = db.Exec(`
+		CREATE TABLE topics(id INTEGER PRIMARY KEY, name TEXT NOT NULL, type TEXT NOT NULL, serialization_format TEXT NOT NULL, offered_qos_profiles TEXT NOT NULL);
+		CREATE TABLE messages(id INTEGER PRIMARY KEY, topic_id INTEGER NOT NULL, timestamp INTEGER NOT NULL, data BLOB NOT NULL);
+		INSERT INTO topics VALUES(1, '/a', 'test_msgs/msg/Test', 'cdr', '');
+		INSERT INTO topics VALUES(2, '/b', 'std_msgs/msg/String', 'cdr', '');
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := newCDREncoder()
+	msg.string("b")
+	for _, m := range []struct {
+		topic int
+		ts    int64
+		data  []byte
+	}{
+		{1, 3e9, encodeTestMessage()},
+		{2, 2e9, msg.data},
+		{1, 4e9, encodeTestMessage()},
+	} {
+		if _, err = db.Exec(`INSERT INTO messages(topic_id, timestamp, data) VALUES(?, ?, ?)`, m.topic, m.ts, m.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestBag(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bag_0.db3")
+	createBag(t, path)
+	ctx := context.Background()
+	Convey("Scenario: bags can be read", t, func() {
+		bag, err := Open(path)
+		So(err, ShouldBeNil)
+		defer bag.Close()
+		Convey("Topics are listed", func() {
+			topics, err := bag.Topics(ctx)
+			So(err, ShouldBeNil)
+			So(topics, ShouldResemble, []Topic{
+				{1, "/a", "test_msgs/msg/Test", "cdr", ""},
+				{2, "/b", "std_msgs/msg/String", "cdr", ""},
+			})
+		})
+		Convey("The start time is the earliest timestamp", func() {
+			start, err := bag.StartTime(ctx)
+			So(err, ShouldBeNil)
+			So(start.Equal(time.Unix(2, 0)), ShouldBeTrue)
+		})
+		Convey("Messages are iterated in timestamp order", func() {
+			msgs, err := bag.Messages(ctx)
+			So(err, ShouldBeNil)
+			defer msgs.Close()
+			var topics []string
+			for msgs.Next() {
+				topics = append(topics, msgs.Message().Topic)
+			}
+			So(msgs.Err(), ShouldBeNil)
+			So(topics, ShouldResemble, []string{"/b", "/a", "/a"})
+		})
+		Convey("Messages can be filtered by topic and decoded", func() {
+			msgs, err := bag.Messages(ctx, "/a")
+			So(err, ShouldBeNil)
+			defer msgs.Close()
+			So(msgs.Next(), ShouldBeTrue)
+			So(msgs.Message().Timestamp.Equal(time.Unix(3, 0)), ShouldBeTrue)
+			var msg testMessage
+			So(Unmarshal(msgs.Message().Data, &msg), ShouldBeNil)
+			So(msg, ShouldResemble, testMessage{
+				Flag:   true,
+				Count:  -2,
+				Name:   "hello",
+				Stamp:  testTime{3, 4},
+				Values: []float64{1.5, -2},
+				Raw:    []byte{7, 8, 9},
+				Fixed:  [2]int16{-1, 5},
+				Names:  []string{"a", ""},
+				Last:   42,
+			})
+			So(msgs.Next(), ShouldBeTrue)
+			So(msgs.Next(), ShouldBeFalse)
+		})
+	})
+	Convey("Scenario: the start time is scanned from a stream", t, func() {
+		path := filepath.Join(t.TempDir(), "large.db3")
+		createBag(t, path)
+		db, err := sql.Open("sqlite3", path)
+		So(err, ShouldBeNil)
+		defer db.Close()
+		// Large messages are stored on overflow pages and the earliest
+		// message is written last.
+		for i := 0; i < 200; i++ {
+			_, err = db.Exec(`INSERT INTO messages(topic_id, timestamp, data) VALUES(1, ?, ?)`, 5e9+i, make([]byte, 10000))
+			So(err, ShouldBeNil)
+		}
+		_, err = db.Exec(`INSERT INTO messages(topic_id, timestamp, data) VALUES(2, 1500000000, x'00')`)
+		So(err, ShouldBeNil)
+		So(db.Close(), ShouldBeNil)
+		f, err := os.Open(path)
+		So(err, ShouldBeNil)
+		defer f.Close()
+		start, err := ScanStartTime(f)
+		So(err, ShouldBeNil)
+		So(start.Equal(time.Unix(1, 5e8)), ShouldBeTrue)
+
+		Convey("Bags without messages are empty", func() {
+			path := filepath.Join(t.TempDir(), "empty.db3")
+			db, err := sql.Open("sqlite3", path)
+			So(err, ShouldBeNil)
+			defer db.Close()
+			_, err = db.Exec(`CREATE TABLE messages(id INTEGER PRIMARY KEY, topic_id INTEGER NOT NULL, timestamp INTEGER NOT NULL, data BLOB NOT NULL)`)
+			So(err, ShouldBeNil)
+			So(db.Close(), ShouldBeNil)
+			f, err := os.Open(path)
+			So(err, ShouldBeNil)
+			defer f.Close()
+			_, err = ScanStartTime(f)
+			So(err, ShouldEqual, ErrEmpty)
+		})
+		Convey("Other files are rejected", func() {
+			_, err := ScanStartTime(strings.NewReader("not a bag"))
+			So(err, ShouldBeError)
+		})
+	})
+	Convey("Scenario: invalid input is rejected", t, func() {
+		_, err := Open(filepath.Join(t.TempDir(), "missing.db3"))
+		So(err, ShouldNotBeNil)
+		var msg testMessage
+		So(Unmarshal(encodeTestMessage()[:20], &msg), ShouldNotBeNil)
+		So(Unmarshal([]byte{0, 0x10, 0, 0}, &msg), ShouldNotBeNil)
+		So(Unmarshal(encodeTestMessage(), msg), ShouldNotBeNil)
+	})
+}
@@ -0,0 +1,199 @@
+package rosbag
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"time"
+)
+
+const (
+	sqliteHeader      = "SQLite format 3\x00"
+	sqliteLeafTable   = 0x0D
+	serialTypeNull    = 0
+	serialTypeMinBlob = 12
+)
+
+var errNotSQLite = errors.New("not an SQLite database")
+
+// ScanStartTime returns the earliest message timestamp of the bag file read
+// from r. The pages of the database are parsed as they are read, so the start
+// time of a compressed bag can be read without writing the decompressed bag
+// to disk. The rows of the messages table are recognized by their columns,
+// which are the id stored as NULL because it is the rowid, the topic ID, the
+// timestamp and the data. rosbag2 never deletes messages, so the pages of the
+// database don't contain stale rows.
+func ScanStartTime(r io.Reader) (time.Time, error) {
+	header := make([]byte, sqliteHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil || string(header[:len(sqliteHeader)]) != sqliteHeader {
+		return time.Time{}, errNotSQLite
+	}
+	pageSize := int(binary.BigEndian.Uint16(header[sqlitePageSizeOffset:]))
+	if pageSize == sqliteMaxPageSizeValue {
+		pageSize = 65536
+	}
+	if pageSize < 512 || pageSize&(pageSize-1) != 0 {
+		return time.Time{}, errNotSQLite
+	}
+	usable := pageSize - int(header[20])
+	page := make([]byte, pageSize)
+	copy(page, header)
+	start := int64(math.MaxInt64)
+	found := false
+	for offset := sqliteHeaderSize; ; offset = 0 {
+		if _, err := io.ReadFull(r, page[offset:]); errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		} else if err != nil {
+			return time.Time{}, err
+		}
+		// The b-tree header of the first page follows the database header.
+		hdr := 0
+		if offset > 0 {
+			hdr = sqliteHeaderSize
+		}
+		scanLeafPage(page, hdr, usable, func(ts int64) {
+			found = true
+			if ts < start {
+				start = ts
+			}
+		})
+	}
+	if !found {
+		return time.Time{}, ErrEmpty
+	}
+	return time.Unix(0, start).UTC(), nil
+}
+
+// scanLeafPage calls onMessage with the timestamps of the message rows in page
+// if it is a leaf page of a table. Malformed cells are skipped.
+func scanLeafPage(page []byte, hdr, usable int, onMessage func(int64)) {
+	if hdr+8 > len(page) || page[hdr] != sqliteLeafTable {
+		return
+	}
+	cells := int(binary.BigEndian.Uint16(page[hdr+3:]))
+	for i := 0; i < cells; i++ {
+		ptr := hdr + 8 + 2*i
+		if ptr+2 > len(page) {
+			return
+		}
+		p := int(binary.BigEndian.Uint16(page[ptr:]))
+		if p >= len(page) {
+			continue
+		}
+		payloadSize, n := readVarint(page[p:])
+		if n == 0 {
+			continue
+		}
+		p += n
+		if _, n = readVarint(page[p:]); n == 0 {
+			continue
+		}
+		p += n
+		end := p + localPayloadSize(payloadSize, usable)
+		if end > len(page) {
+			end = len(page)
+		}
+		if ts, ok := messageTimestamp(page[p:end]); ok {
+			onMessage(ts)
+		}
+	}
+}
+
+// localPayloadSize returns the number of bytes of a payload of size n stored
+// on a leaf table page. The rest is stored on overflow pages.
+func localPayloadSize(n uint64, usable int) int {
+	maxLocal := uint64(usable - 35)
+	if n <= maxLocal {
+		return int(n)
+	}
+	minLocal := uint64((usable-12)*32/255 - 23)
+	k := minLocal + (n-minLocal)%uint64(usable-4)
+	if k <= maxLocal {
+		return int(k)
+	}
+	return int(minLocal)
+}
+
+// messageTimestamp returns the timestamp of record if it is a row of the
+// messages table.
+func messageTimestamp(record []byte) (int64, bool) {
+	headerSize, n := readVarint(record)
+	if n == 0 || headerSize > uint64(len(record)) {
+		return 0, false
+	}
+	var types []uint64
+	for p := n; p < int(headerSize); {
+		t, n := readVarint(record[p:int(headerSize)])
+		if n == 0 {
+			return 0, false
+		}
+		types = append(types, t)
+		p += n
+	}
+	if len(types) != 4 || types[0] != serialTypeNull || types[3] < serialTypeMinBlob || types[3]%2 != 0 {
+		return 0, false
+	}
+	topicSize, ok := intSize(types[1])
+	if !ok {
+		return 0, false
+	}
+	tsSize, ok := intSize(types[2])
+	if !ok {
+		return 0, false
+	}
+	p := int(headerSize) + topicSize
+	if p+tsSize > len(record) {
+		return 0, false
+	}
+	return readInt(record[p:p+tsSize], types[2]), true
+}
+
+// intSize returns the size of an integer with the given serial type.
+func intSize(serialType uint64) (int, bool) {
+	switch serialType {
+	case 1, 2, 3, 4:
+		return int(serialType), true
+	case 5:
+		return 6, true
+	case 6:
+		return 8, true
+	case 8, 9:
+		return 0, true
+	}
+	return 0, false
+}
+
+func readInt(b []byte, serialType uint64) int64 {
+	switch serialType {
+	case 8:
+		return 0
+	case 9:
+		return 1
+	}
+	// Integers are stored as big-endian two's complement.
+	x := int64(int8(b[0]))
+	for _, c := range b[1:] {
+		x = x<<8 | int64(c)
+	}
+	return x
+}
+
+// readVarint reads an SQLite variable-length integer from b. It returns the
+// value and the number of bytes read, which is zero if b is too short.
+func readVarint(b []byte) (uint64, int) {
+	var x uint64
+	for i := 0; i < 9; i++ {
+		if i >= len(b) {
+			return 0, 0
+		}
+		if i == 8 {
+			return x<<8 | uint64(b[i]), 9
+		}
+		x = x<<7 | uint64(b[i]&0x7F)
+		if b[i]&0x80 == 0 {
+			return x, i + 1
+		}
+	}
+	return x, 9
+}
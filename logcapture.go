@@ -0,0 +1,543 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	rcl_interfaces_msg "github.com/tiiuae/mission-data-recorder/msgs/rcl_interfaces/msg"
+	"github.com/tiiuae/rclgo/pkg/rclgo"
+)
+
+// logArchiveFileName is the name of the file in the directory of a recording
+// session where the logs captured during the session are written as gzipped
+// JSON lines. The archive is queued for uploading like a bag when the session
+// ends. Its path in bagMetadata doesn't include the ".gz" extension, so that
+// it is uploaded as it is.
+const logArchiveFileName = "logs.jsonl.gz"
+
+// logArchiveExtension is used in place of the storage extension in the names
+// of uploaded log archives.
+const logArchiveExtension = ".logs.jsonl"
+
+var logArchiveRegex = regexp.MustCompile(`^logs\.jsonl(` + bagExtensionsPattern() + `)$`)
+
+func logArchivePath(dir string) string {
+	return filepath.Join(dir, logArchiveFileName)
+}
+
+// newLogArchiveMetadata returns the metadata of the log archive at path or nil
+// if path isn't a log archive.
+func newLogArchiveMetadata(path string, isNew bool) *bagMetadata {
+	matches := logArchiveRegex.FindStringSubmatch(filepath.Base(path))
+	if matches == nil {
+		return nil
+	}
+	return &bagMetadata{
+		path:       filepath.Join(filepath.Dir(path), "logs.jsonl"),
+		ext:        matches[1],
+		isNew:      isNew,
+		logArchive: true,
+	}
+}
+
+// logEntry is a line of a log archive.
+type logEntry struct {
+	Time time.Time `json:"time"`
+	// Source is rosout, journal or the path of a log file.
+	Source  string `json:"source"`
+	Level   string `json:"level,omitempty"`
+	Name    string `json:"name,omitempty"`
+	Message string `json:"message"`
+}
+
+// Sources of log entries which are not files.
+const (
+	logSourceRosout  = "rosout"
+	logSourceJournal = "journal"
+)
+
+// logCaptureOptions select the logs captured during recording sessions.
+type logCaptureOptions struct {
+	// If CaptureRosout is true, the messages published on /rosout are
+	// captured.
+	CaptureRosout bool `yaml:"capture_rosout"`
+	// If CaptureJournal is true, the systemd journal is captured.
+	CaptureJournal bool `yaml:"capture_journal"`
+	// LogFiles are the paths of log files whose new lines are captured.
+	LogFiles []string `yaml:"capture_log_files"`
+}
+
+func (o *logCaptureOptions) enabled() bool {
+	return o.CaptureRosout || o.CaptureJournal || len(o.LogFiles) > 0
+}
+
+func (o *logCaptureOptions) validate() error {
+	for _, path := range o.LogFiles {
+		if !filepath.IsAbs(path) {
+			return fmt.Errorf("log file '%s' must be an absolute path", path)
+		}
+	}
+	return nil
+}
+
+// logArchiveWriter writes log entries to a log archive. It is safe for
+// concurrent use.
+type logArchiveWriter struct {
+	mu sync.Mutex
+	// +checklocks:mu
+	file *os.File
+	// +checklocks:mu
+	gz *gzip.Writer
+	// +checklocks:mu
+	enc *json.Encoder
+	// +checklocks:mu
+	entries int
+	// +checklocks:mu
+	err error
+}
+
+func createLogArchive(path string) (*logArchiveWriter, error) {
+	//#nosec G304 -- The path is constructed by this program.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	w := &logArchiveWriter{file: f, gz: gzip.NewWriter(f)}
+	w.enc = json.NewEncoder(w.gz)
+	return w, nil
+}
+
+// Write appends entry to the archive. Entries are not written after an error.
+func (w *logArchiveWriter) Write(entry *logEntry) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return
+	}
+	if w.err = w.enc.Encode(entry); w.err == nil {
+		w.entries++
+	}
+}
+
+// Flush writes the buffered entries to the file, so that they are not lost if
+// the program is interrupted.
+func (w *logArchiveWriter) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err == nil {
+		w.err = w.gz.Flush()
+	}
+	return w.err
+}
+
+// Close closes the archive and returns the number of entries written to it.
+func (w *logArchiveWriter) Close() (entries int, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	err = w.err
+	if closeErr := w.gz.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	return w.entries, err
+}
+
+// logCapture captures logs to the log archives of recording sessions.
+type logCapture struct {
+	// JournalCommand writes new journal entries to stdout in the JSON format
+	// of journalctl until it is killed.
+	JournalCommand []string
+	// PollInterval is the interval of checking log files for new lines. Lines
+	// of log files are timestamped when they are read.
+	PollInterval time.Duration
+	// FlushInterval is the interval of flushing the archive to disk.
+	FlushInterval time.Duration
+
+	logger logger
+	sub    *rclgo.Subscription
+
+	mu sync.Mutex
+	// The archive where /rosout is captured or nil if it isn't captured.
+	// +checklocks:mu
+	rosout *logArchiveWriter
+}
+
+// newLogCapture creates a log capture which subscribes to /rosout. The
+// subscription is created immediately, because subscriptions created after
+// the context has started spinning are not served.
+func newLogCapture(node *rclgo.Node) (c *logCapture, err error) {
+	c = &logCapture{
+		JournalCommand: []string{"journalctl", "--follow", "--lines=0", "--output=json"},
+		PollInterval:   time.Second,
+		FlushInterval:  time.Second,
+		logger:         node.Logger(),
+	}
+	opts := rclgo.NewDefaultSubscriptionOptions()
+	opts.Qos.Reliability = rclgo.RmwQosReliabilityPolicyReliable
+	c.sub, err = node.NewSubscriptionWithOpts(
+		"/rosout",
+		rcl_interfaces_msg.LogTypeSupport,
+		opts,
+		c.onRosout,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to subscribe to /rosout: %w", err)
+	}
+	return c, nil
+}
+
+func (c *logCapture) Close() error {
+	return c.sub.Close()
+}
+
+func (c *logCapture) onRosout(s *rclgo.Subscription) {
+	var msg rcl_interfaces_msg.Log
+	if _, err := s.TakeMessage(&msg); err != nil {
+		c.logger.Errorf("failed to read /rosout: %v", err)
+		return
+	}
+	c.mu.Lock()
+	w := c.rosout
+	c.mu.Unlock()
+	if w != nil {
+		w.Write(rosoutEntry(&msg))
+	}
+}
+
+func (c *logCapture) setRosoutArchive(w *logArchiveWriter) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rosout = w
+}
+
+func rosoutEntry(msg *rcl_interfaces_msg.Log) *logEntry {
+	return &logEntry{
+		Time:    time.Unix(int64(msg.Stamp.Sec), int64(msg.Stamp.Nanosec)).UTC(),
+		Source:  logSourceRosout,
+		Level:   rosoutLevel(msg.Level),
+		Name:    msg.Name,
+		Message: msg.Msg,
+	}
+}
+
+func rosoutLevel(level uint8) string {
+	switch {
+	case level >= rcl_interfaces_msg.Log_FATAL:
+		return "fatal"
+	case level >= rcl_interfaces_msg.Log_ERROR:
+		return "error"
+	case level >= rcl_interfaces_msg.Log_WARN:
+		return "warn"
+	case level >= rcl_interfaces_msg.Log_INFO:
+		return "info"
+	}
+	return "debug"
+}
+
+// Start starts capturing logs to the log archive of the session in dir. The
+// returned function stops capturing and returns the archive or nil if nothing
+// was captured.
+func (c *logCapture) Start(ctx context.Context, dir string, opts logCaptureOptions) (stop func() *bagMetadata) {
+	noArchive := func() *bagMetadata { return nil }
+	if !opts.enabled() {
+		return noArchive
+	}
+	archive := newLogArchiveMetadata(logArchivePath(dir), true)
+	// The start time of the session is stored before capturing starts, so
+	// that it is known if the program is interrupted.
+	err := saveBagManifest(archive, &bagManifest{RecordStartTime: time.Now().UTC()})
+	if err != nil {
+		c.logger.Errorf("failed to start log capture: %v", err)
+		return noArchive
+	}
+	w, err := createLogArchive(archive.filePath())
+	if err != nil {
+		c.logger.Errorf("failed to start log capture: %v", err)
+		return noArchive
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	run := func(f func()) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f()
+		}()
+	}
+	if opts.CaptureRosout {
+		c.setRosoutArchive(w)
+	}
+	if opts.CaptureJournal {
+		run(func() { c.followJournal(ctx, w) })
+	}
+	for _, path := range opts.LogFiles {
+		path := path
+		run(func() { c.tailFile(ctx, path, w) })
+	}
+	run(func() { c.flushPeriodically(ctx, w) })
+	return func() *bagMetadata {
+		if opts.CaptureRosout {
+			c.setRosoutArchive(nil)
+		}
+		cancel()
+		wg.Wait()
+		entries, err := w.Close()
+		if err != nil {
+			c.logger.Errorf("failed to write log archive: %v", err)
+		}
+		if entries == 0 {
+			for _, path := range []string{archive.filePath(), manifestPath(archive)} {
+				if err := os.Remove(path); err != nil {
+					c.logger.Errorf("failed to remove '%s': %v", path, err)
+				}
+			}
+			return nil
+		}
+		return archive
+	}
+}
+
+func (c *logCapture) flushPeriodically(ctx context.Context, w *logArchiveWriter) {
+	ticker := time.NewTicker(c.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := w.Flush(); err != nil {
+				c.logger.Errorf("failed to write log archive: %v", err)
+				return
+			}
+		}
+	}
+}
+
+// tailFile captures the lines appended to the file at path until ctx is done.
+// Lines written before capturing started are skipped unless the file is
+// created or replaced during capturing.
+func (c *logCapture) tailFile(ctx context.Context, path string, w *logArchiveWriter) {
+	t := &fileTail{path: path}
+	defer t.close()
+	ticker := time.NewTicker(c.PollInterval)
+	defer ticker.Stop()
+	done := false
+	for {
+		err := t.readLines(func(line string) {
+			w.Write(&logEntry{Time: time.Now().UTC(), Source: path, Message: line})
+		})
+		if err != nil && !t.failed {
+			t.failed = true
+			c.logger.Errorf("failed to read log file '%s': %v", path, err)
+		} else if err == nil {
+			t.failed = false
+		}
+		if done {
+			return
+		}
+		// The file is read once more after ctx is done to capture the lines
+		// written since the previous poll.
+		select {
+		case <-ctx.Done():
+			done = true
+		case <-ticker.C:
+		}
+	}
+}
+
+// fileTail reads the lines appended to a file. Rotated and truncated files
+// are read from the start.
+type fileTail struct {
+	path      string
+	fromStart bool
+	failed    bool
+
+	file    *os.File
+	reader  *bufio.Reader
+	partial []byte
+}
+
+func (t *fileTail) close() {
+	if t.file != nil {
+		t.file.Close()
+		t.file = nil
+	}
+}
+
+// readLines passes the complete lines appended to the file since the previous
+// call to handleLine.
+func (t *fileTail) readLines(handleLine func(string)) error {
+	if t.file == nil {
+		//#nosec G304 -- The path is configured by the user.
+		f, err := os.Open(t.path)
+		if errors.Is(err, os.ErrNotExist) {
+			// The file is read from the start when it is created.
+			t.fromStart = true
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if !t.fromStart {
+			if _, err = f.Seek(0, io.SeekEnd); err != nil {
+				f.Close()
+				return err
+			}
+		}
+		t.file = f
+		t.reader = bufio.NewReader(f)
+		t.partial = t.partial[:0]
+	}
+	for {
+		line, err := t.reader.ReadBytes('\n')
+		t.partial = append(t.partial, line...)
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return err
+		}
+		handleLine(string(bytes.TrimRight(t.partial, "\r\n")))
+		t.partial = t.partial[:0]
+	}
+	return t.checkRotation()
+}
+
+// checkRotation reopens the file from the start on the next read if it has
+// been replaced and rewinds it if it has been truncated.
+func (t *fileTail) checkRotation() error {
+	info, err := os.Stat(t.path)
+	if errors.Is(err, os.ErrNotExist) {
+		t.close()
+		t.fromStart = true
+		return nil
+	} else if err != nil {
+		return err
+	}
+	current, err := t.file.Stat()
+	if err != nil {
+		return err
+	}
+	if !os.SameFile(info, current) {
+		t.close()
+		t.fromStart = true
+		return nil
+	}
+	offset, err := t.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if info.Size() < offset-int64(t.reader.Buffered()) {
+		if _, err = t.file.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		t.reader.Reset(t.file)
+		t.partial = t.partial[:0]
+	}
+	return nil
+}
+
+// followJournal captures the output of JournalCommand until ctx is done.
+func (c *logCapture) followJournal(ctx context.Context, w *logArchiveWriter) {
+	//#nosec G204 -- The command needs to be configurable.
+	cmd := exec.CommandContext(ctx, c.JournalCommand[0], c.JournalCommand[1:]...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		c.logger.Errorf("failed to capture journal: %v", err)
+		return
+	}
+	if err = cmd.Start(); err != nil {
+		c.logger.Errorf("failed to capture journal: %v", err)
+		return
+	}
+	scanner := bufio.NewScanner(stdout)
+	// Journal entries may contain long messages.
+	scanner.Buffer(nil, 1024*1024)
+	invalid := 0
+	for scanner.Scan() {
+		entry, err := parseJournalEntry(scanner.Bytes())
+		if err != nil {
+			invalid++
+			continue
+		}
+		w.Write(entry)
+	}
+	if invalid > 0 {
+		c.logger.Errorf("skipped %d invalid journal entries", invalid)
+	}
+	if err = scanner.Err(); err != nil && ctx.Err() == nil {
+		c.logger.Errorf("failed to read journal: %v", err)
+	}
+	if err = cmd.Wait(); err != nil && ctx.Err() == nil {
+		c.logger.Errorf("journal command failed: %v", err)
+	}
+}
+
+// journalEntry contains the fields of a journal entry in the JSON format of
+// journalctl which are captured. Messages which are not valid UTF-8 are
+// encoded as arrays of bytes.
+type journalEntry struct {
+	RealtimeTimestamp string          `json:"__REALTIME_TIMESTAMP"`
+	Priority          string          `json:"PRIORITY"`
+	SyslogIdentifier  string          `json:"SYSLOG_IDENTIFIER"`
+	SystemdUnit       string          `json:"_SYSTEMD_UNIT"`
+	Message           json.RawMessage `json:"MESSAGE"`
+}
+
+func parseJournalEntry(line []byte) (*logEntry, error) {
+	var je journalEntry
+	if err := json.Unmarshal(line, &je); err != nil {
+		return nil, err
+	}
+	usec, err := strconv.ParseInt(je.RealtimeTimestamp, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timestamp: %w", err)
+	}
+	entry := &logEntry{
+		Time:   time.UnixMicro(usec).UTC(),
+		Source: logSourceJournal,
+		Name:   je.SyslogIdentifier,
+	}
+	if entry.Name == "" {
+		entry.Name = je.SystemdUnit
+	}
+	if p, err := strconv.Atoi(je.Priority); err == nil {
+		entry.Level = journalLevel(p)
+	}
+	if err = json.Unmarshal(je.Message, &entry.Message); err != nil {
+		var raw []byte
+		if json.Unmarshal(je.Message, &raw) != nil {
+			return nil, fmt.Errorf("invalid message: %w", err)
+		}
+		entry.Message = string(raw)
+	}
+	return entry, nil
+}
+
+// journalLevel converts syslog priorities to the levels of rosout.
+func journalLevel(priority int) string {
+	switch {
+	case priority <= 2:
+		return "fatal"
+	case priority == 3:
+		return "error"
+	case priority == 4:
+		return "warn"
+	case priority <= 6:
+		return "info"
+	}
+	return "debug"
+}
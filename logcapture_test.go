@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func readLogArchive(path string) []logEntry {
+	f, err := os.Open(path)
+	So(err, ShouldBeNil)
+	defer f.Close()
+	r, err := gzip.NewReader(f)
+	So(err, ShouldBeNil)
+	var entries []logEntry
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		var e logEntry
+		So(json.Unmarshal(scanner.Bytes(), &e), ShouldBeNil)
+		entries = append(entries, e)
+	}
+	So(scanner.Err(), ShouldBeNil)
+	return entries
+}
+
+func TestLogCapture(t *testing.T) {
+	Convey("Journal entries are parsed from the JSON output of journalctl", t, func() {
+		e, err := parseJournalEntry([]byte(`{"__REALTIME_TIMESTAMP":"1700000000000001","PRIORITY":"3","SYSLOG_IDENTIFIER":"px4","_SYSTEMD_UNIT":"px4.service","MESSAGE":"failed"}`))
+		So(err, ShouldBeNil)
+		So(*e, ShouldResemble, logEntry{
+			Time:    time.UnixMicro(1700000000000001).UTC(),
+			Source:  logSourceJournal,
+			Level:   "error",
+			Name:    "px4",
+			Message: "failed",
+		})
+		e, err = parseJournalEntry([]byte(`{"__REALTIME_TIMESTAMP":"1","_SYSTEMD_UNIT":"a.service","MESSAGE":[104,105]}`))
+		So(err, ShouldBeNil)
+		So(e.Name, ShouldEqual, "a.service")
+		So(e.Message, ShouldEqual, "hi")
+		_, err = parseJournalEntry([]byte(`{"MESSAGE":"no timestamp"}`))
+		So(err, ShouldBeError)
+	})
+	Convey("New lines of log files are read and rotated files are reopened", t, func() {
+		path := filepath.Join(t.TempDir(), "app.log")
+		So(os.WriteFile(path, []byte("old\n"), 0o600), ShouldBeNil)
+		tail := &fileTail{path: path}
+		defer tail.close()
+		var lines []string
+		read := func() {
+			So(tail.readLines(func(l string) { lines = append(lines, l) }), ShouldBeNil)
+		}
+		read()
+		So(lines, ShouldBeEmpty)
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o600)
+		So(err, ShouldBeNil)
+		_, err = f.WriteString("first\nsec")
+		So(err, ShouldBeNil)
+		read()
+		So(lines, ShouldResemble, []string{"first"})
+		_, err = f.WriteString("ond\r\n")
+		So(err, ShouldBeNil)
+		So(f.Close(), ShouldBeNil)
+		read()
+		So(lines, ShouldResemble, []string{"first", "second"})
+		So(os.Rename(path, path+".1"), ShouldBeNil)
+		So(os.WriteFile(path, []byte("rotated\n"), 0o600), ShouldBeNil)
+		read()
+		read()
+		So(lines, ShouldResemble, []string{"first", "second", "rotated"})
+		So(os.Truncate(path, 0), ShouldBeNil)
+		read()
+		So(os.WriteFile(path, []byte("truncated\n"), 0o600), ShouldBeNil)
+		read()
+		So(lines, ShouldResemble, []string{"first", "second", "rotated", "truncated"})
+	})
+	Convey("Logs are captured to the log archive of the session", t, func() {
+		dir := t.TempDir()
+		journal := filepath.Join(dir, "journal.json")
+		So(os.WriteFile(journal, []byte(`{"__REALTIME_TIMESTAMP":"1","PRIORITY":"6","MESSAGE":"started"}`+"\ninvalid\n"), 0o600), ShouldBeNil)
+		c := &logCapture{
+			JournalCommand: []string{"cat", journal},
+			PollInterval:   10 * time.Millisecond,
+			FlushInterval:  10 * time.Millisecond,
+			logger:         fakeLogger{},
+		}
+		stop := c.Start(context.Background(), dir, logCaptureOptions{CaptureJournal: true, CaptureRosout: true})
+		// The journal command is killed when capturing stops.
+		time.Sleep(200 * time.Millisecond)
+		archive := stop()
+		So(archive, ShouldNotBeNil)
+		So(archive.filePath(), ShouldEqual, logArchivePath(dir))
+		So(archive.storageExt(), ShouldEqual, logArchiveExtension)
+		entries := readLogArchive(archive.filePath())
+		So(entries, ShouldHaveLength, 1)
+		So(entries[0].Message, ShouldEqual, "started")
+		manifest, err := loadBagManifest(archive)
+		So(err, ShouldBeNil)
+		So(manifest.RecordStartTime.IsZero(), ShouldBeFalse)
+		So(newLogArchiveMetadata(archive.filePath()+".enc", false), ShouldResemble, &bagMetadata{
+			path: archive.path, ext: ".gz.enc", logArchive: true,
+		})
+	})
+	Convey("Empty log archives are removed", t, func() {
+		dir := t.TempDir()
+		c := &logCapture{PollInterval: time.Hour, FlushInterval: time.Hour, logger: fakeLogger{}}
+		stop := c.Start(context.Background(), dir, logCaptureOptions{LogFiles: []string{filepath.Join(dir, "missing.log")}})
+		So(stop(), ShouldBeNil)
+		entries, err := os.ReadDir(dir)
+		So(err, ShouldBeNil)
+		So(entries, ShouldBeEmpty)
+	})
+	Convey("Log files must be absolute paths", t, func() {
+		So((&logCaptureOptions{LogFiles: []string{"/var/log/syslog"}}).validate(), ShouldBeNil)
+		So((&logCaptureOptions{LogFiles: []string{"syslog"}}).validate(), ShouldBeError)
+	})
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"crypto/rsa"
 	"errors"
 	"fmt"
 	"log"
@@ -25,6 +26,7 @@ import (
 
 type logger interface {
 	Infof(string, ...interface{}) error
+	Warnf(string, ...interface{}) error
 	Errorf(string, ...interface{}) error
 	Errorln(...interface{}) error
 }
@@ -32,39 +34,81 @@ type logger interface {
 const timeFormat = "2006-01-02T15:04:05.000000000Z07:00"
 
 const (
-	defaultSizeThreshold   = 10_000_000
-	defaultMaxUploadCount  = 5
-	defaultCompressionMode = compressionNone
+	defaultSizeThreshold           = 10_000_000
+	defaultMaxUploadCount          = 5
+	defaultCompressionMode         = compressionNone
+	defaultRecorderCompressionMode = recorderCompressionNone
+	defaultStorageFormat           = storageSQLite3
+	defaultShutdownGracePeriod     = 30 * time.Second
 )
 
 type configuration struct {
-	DeviceID        string          `env:"DRONE_DEVICE_ID" usage:"The provisioned device id (required)"`
-	TenantID        string          `env:"DRONE_TENANT_ID" usage:"The tenant this drone belongs to"`
-	BackendURL      string          `usage:"URL to the backend server (required)"`
-	PrivateKeyPath  string          `config:"private_key" flag:"private-key" env:"MISSION_DATA_RECORDER_PRIVATE_KEY" usage:"The private key used for authentication"`
-	KeyAlgorithm    string          `usage:"Supported values are RS256 and ES256"`
-	Topics          topicList       `usage:"Comma-separated list of topics to record. Special value \"*\" means everything. If empty, recording is not started."`
-	DestDir         string          `usage:"The directory where recordings are stored"`
-	SizeThreshold   int             `usage:"Rosbags will be split when this size in bytes is reached"`
-	ExtraArgs       []string        `usage:"Comma-separated list of extra arguments passed to ros bag record command after all other arguments passed to the command by this program."`
-	MaxUploadCount  int             `usage:"Maximum number of concurrent file uploads. If zero, file uploading is disabled."`
-	CompressionMode compressionMode `usage:"Compression mode to use"`
-
-	privateKey interface{}
-	rosArgs    *rclgo.Args
+	DeviceID                string                  `env:"DRONE_DEVICE_ID" usage:"The provisioned device id (required)"`
+	TenantID                string                  `env:"DRONE_TENANT_ID" usage:"The tenant this drone belongs to"`
+	BackendURL              string                  `usage:"URL to the backend server (required)"`
+	PrivateKeyPath          string                  `config:"private_key" flag:"private-key" env:"MISSION_DATA_RECORDER_PRIVATE_KEY" usage:"The private key used for authentication"`
+	KeyAlgorithm            string                  `usage:"Supported values are RS256 and ES256"`
+	Topics                  topicList               `usage:"Comma-separated list of topics to record. Special value \"*\" means everything. If empty and no services, actions or parameter events are recorded, recording is not started."`
+	Services                topicList               `usage:"Comma-separated list of services whose requests and responses are recorded. Special value \"*\" means every service. Requires service introspection to be enabled for the services."`
+	Actions                 topicList               `usage:"Comma-separated list of actions whose goals, results, feedback and status are recorded. Special value \"*\" means every action. Goals and results require service introspection."`
+	ParameterEvents         bool                    `usage:"Record the parameter changes of all nodes"`
+	DestDir                 string                  `usage:"The directory where recordings are stored"`
+	SizeThreshold           int                     `usage:"Rosbags will be split when this size in bytes is reached"`
+	ExtraArgs               []string                `usage:"Comma-separated list of extra arguments passed to ros bag record command after all other arguments passed to the command by this program. Flags set by this program, such as --output, are rejected."`
+	PollingInterval         time.Duration           `usage:"Interval of polling for new topics in ros bag record. If zero, the default of ros bag record is used."`
+	IncludeHiddenTopics     bool                    `usage:"Record hidden topics too"`
+	MaxCacheSize            int                     `usage:"Size of the message cache of ros bag record in bytes. If zero, the default of ros bag record is used."`
+	NoDiscovery             bool                    `usage:"Record only the topics which exist when the recording starts"`
+	TopicRegex              string                  `usage:"Record also the topics matching this regular expression. The regular expressions use the ECMAScript syntax of ros bag record. If set and the list of topics is empty, only the matching topics are recorded."`
+	ExcludeRegex            string                  `usage:"Don't record the topics matching this regular expression. Requires all topics to be recorded or the topic regex to be set."`
+	MaxUploadCount          int                     `usage:"Maximum number of concurrent file uploads. If zero, file uploading is disabled."`
+	CompressionMode         compressionMode         `usage:"Compression mode to use. Supported values are none, gzip, xz, zstd, lz4 and auto, which selects the mode minimizing the expected upload time of each bag. auto never selects xz."`
+	CompressionLevel        int                     `usage:"Compression level to use. If zero, the default level of the compression mode is used."`
+	RecorderCompressionMode recorderCompressionMode `usage:"Compression mode used by ros bag record. Supported values are none, file and message. Bags are compressed using zstd."`
+	StorageFormat           storageFormat           `usage:"Storage format used by ros bag record. Supported values are sqlite3 and mcap."`
+	EncryptionKeyPath       string                  `config:"encryption_key" flag:"encryption-key" env:"MISSION_DATA_RECORDER_ENCRYPTION_KEY" usage:"PEM-encoded RSA public key. If set, bags are encrypted to this key before they are uploaded."`
+	EncryptAtRest           bool                    `usage:"Encrypt completed bags in the destination directory using the encryption key. Bags encrypted at rest are compressed only if precompression is enabled."`
+	PrecompressionWorkers   int                     `usage:"Maximum number of completed bags compressed concurrently in the destination directory before they are uploaded. The compression mode and level given at startup are used. If zero, bags are compressed while they are uploaded."`
+	ValidateBags            bool                    `usage:"Check the integrity of completed bags before they are uploaded. Corrupted bags are recovered if possible and moved to the quarantine subdirectory of the destination directory otherwise."`
+	ShutdownGracePeriod     time.Duration           `usage:"Time given to bag processing and uploads to finish after a shutdown signal is received. The last bag of the recording is queued for uploading before the recorder exits. A second signal cancels the uploads immediately."`
+	FlightStateTopic        string                  `usage:"Topic of type std_msgs/String publishing the flight state as \"<state>[ <mission-id>]\", where state is armed, takeoff, landed or disarmed. If set, recording is started when the vehicle is armed and stopped when it has landed, and the bags are tagged with the mission ID."`
+	DeferUploads            bool                    `usage:"Don't start new uploads while the vehicle is flying. Used only if the flight state topic is set."`
+	StallTimeout            time.Duration           `usage:"If positive, ros bag record is restarted if it doesn't write anything for this long while messages are published on the recorded topics. Messages are counted only on the recorded expected topics; without them, messages are assumed to be published all the time."`
+	TelemetryInterval       time.Duration           `usage:"Interval of sampling the CPU load, memory usage, temperatures and disk I/O of the system while recording. The samples are published on the ~/telemetry topic, which is recorded with the other topics. If zero, system resource usage is not recorded."`
+	CaptureRosout           bool                    `usage:"Capture the messages published on /rosout to the log archive of each recording session"`
+	CaptureJournal          bool                    `usage:"Capture the systemd journal to the log archive of each recording session"`
+	CaptureLogFiles         []string                `usage:"Comma-separated list of absolute paths of log files whose new lines are captured to the log archive of each recording session"`
+	ArtifactDirs            []string                `usage:"Comma-separated list of directories watched for artifacts, such as core dumps. Files which haven't changed for 10 seconds are moved to the destination directory and uploaded. The name of the directory is used as the kind of its artifacts."`
+	ArtifactServiceDirs     []string                `usage:"Comma-separated list of directories from which files can be submitted for upload using the ~/upload_artifact service. Files in the artifact directories and the ULog directory can always be submitted. Only they can be moved instead of copied."`
+	ULogDir                 string                  `config:"ulog_dir" flag:"ulog-dir" usage:"Directory where PX4 writes ULog files. It is searched recursively for .ulg files, which are copied to the destination directory and uploaded after they haven't changed for 30 seconds. Files which existed when the recorder was first started are not uploaded. Each file is associated with the recording session overlapping it most in time."`
+	SnapshotNodes           []string                `usage:"Comma-separated list of nodes whose parameters are included in the snapshot captured at the start of each recording session"`
+	HTTPAddr                string                  `config:"http_addr" flag:"http-addr" usage:"Address of the HTTP API serving the status of the recorder and controlling the uploads, e.g. :8080. Without TLS, an address without a host, such as :8080, listens only on localhost. Use e.g. 0.0.0.0:8080 to serve the API over plain HTTP on all interfaces. If empty, the API is disabled."`
+	HTTPToken               string                  `config:"http_token" flag:"http-token" env:"MISSION_DATA_RECORDER_HTTP_TOKEN" usage:"Bearer token required by the HTTP API"`
+	HTTPTLSCert             string                  `config:"http_tls_cert" flag:"http-tls-cert" usage:"Path of the TLS certificate of the HTTP API. If set with the TLS key, the API is served over HTTPS."`
+	HTTPTLSKey              string                  `config:"http_tls_key" flag:"http-tls-key" usage:"Path of the TLS key of the HTTP API"`
+	DrainPolicy             drainPolicy             `usage:"Uploads allowed to finish during the shutdown grace period. Supported values are all, which uploads the whole queue, in-flight, which finishes only the uploads in progress, and none. Bags which are not uploaded are uploaded on the next start."`
+
+	privateKey    interface{}
+	encryptionKey *rsa.PublicKey
+	rosArgs       *rclgo.Args
 }
 
 func loadConfig() (*configuration, error) {
 	config := &configuration{
-		DeviceID:        "",
-		TenantID:        "fleet-registry",
-		BackendURL:      "",
-		PrivateKeyPath:  "/enclave/rsa_private.pem",
-		KeyAlgorithm:    "RS256",
-		DestDir:         ".",
-		SizeThreshold:   defaultSizeThreshold,
-		MaxUploadCount:  defaultMaxUploadCount,
-		CompressionMode: defaultCompressionMode,
+		DeviceID:                "",
+		TenantID:                "fleet-registry",
+		BackendURL:              "",
+		PrivateKeyPath:          "/enclave/rsa_private.pem",
+		KeyAlgorithm:            "RS256",
+		DestDir:                 ".",
+		SizeThreshold:           defaultSizeThreshold,
+		MaxUploadCount:          defaultMaxUploadCount,
+		CompressionMode:         defaultCompressionMode,
+		RecorderCompressionMode: defaultRecorderCompressionMode,
+		StorageFormat:           defaultStorageFormat,
+		ValidateBags:            true,
+		ShutdownGracePeriod:     defaultShutdownGracePeriod,
+		DrainPolicy:             drainAll,
 	}
 	rosArgs, restArgs, err := rclgo.ParseArgs(os.Args)
 	if err != nil {
@@ -92,12 +136,65 @@ func loadConfig() (*configuration, error) {
 	if config.BackendURL == "" {
 		return nil, errors.New("backed URL is required")
 	}
+	if err := config.CompressionMode.validateLevel(config.CompressionLevel); err != nil {
+		return nil, err
+	}
+	if err := validateInterfaceNames("service", config.Services); err != nil {
+		return nil, err
+	}
+	if err := validateInterfaceNames("action", config.Actions); err != nil {
+		return nil, err
+	}
+	if err := validateExtraArgs(config.ExtraArgs); err != nil {
+		return nil, err
+	}
+	if err := config.recorderOptions().validate(config.Topics); err != nil {
+		return nil, err
+	}
+	if err := config.logCaptureOptions().validate(); err != nil {
+		return nil, err
+	}
+	if config.TelemetryInterval < 0 {
+		return nil, errors.New("telemetry interval must be non-negative")
+	}
+	if config.HTTPAddr != "" && config.HTTPToken == "" {
+		return nil, errors.New("HTTP token is required for the HTTP API")
+	}
+	if (config.HTTPTLSCert == "") != (config.HTTPTLSKey == "") {
+		return nil, errors.New("both the TLS certificate and key of the HTTP API must be set")
+	}
 	if err := config.loadPrivateKey(); err != nil {
 		return nil, err
 	}
+	if config.EncryptionKeyPath != "" {
+		if config.encryptionKey, err = loadEncryptionKey(config.EncryptionKeyPath); err != nil {
+			return nil, err
+		}
+	} else if config.EncryptAtRest {
+		return nil, errors.New("encryption key is required for encryption at rest")
+	}
 	return config, nil
 }
 
+func (config *configuration) recorderOptions() *recorderOptions {
+	return &recorderOptions{
+		PollingInterval:     config.PollingInterval,
+		IncludeHiddenTopics: config.IncludeHiddenTopics,
+		MaxCacheSize:        config.MaxCacheSize,
+		NoDiscovery:         config.NoDiscovery,
+		TopicRegex:          config.TopicRegex,
+		ExcludeRegex:        config.ExcludeRegex,
+	}
+}
+
+func (config *configuration) logCaptureOptions() *logCaptureOptions {
+	return &logCaptureOptions{
+		CaptureRosout:  config.CaptureRosout,
+		CaptureJournal: config.CaptureJournal,
+		LogFiles:       config.CaptureLogFiles,
+	}
+}
+
 func (config *configuration) loadPrivateKey() error {
 	rawKey, err := os.ReadFile(config.PrivateKeyPath)
 	if err != nil {
@@ -141,8 +238,11 @@ func run() (err error) {
 		return nil
 	}
 
-	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	ctx, stop := context.WithCancel(context.Background())
 	defer stop()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
 
 	rclctx, err := rclgo.NewContext(0, config.rosArgs)
 	if err != nil {
@@ -162,36 +262,97 @@ func run() (err error) {
 	defer diagnostics.Close()
 
 	initialConfig := &updatableConfig{
-		Topics:          config.Topics,
-		SizeThreshold:   config.SizeThreshold,
-		ExtraArgs:       config.ExtraArgs,
-		MaxUploadCount:  config.MaxUploadCount,
-		CompressionMode: config.CompressionMode,
+		Topics:                  config.Topics,
+		Services:                config.Services,
+		Actions:                 config.Actions,
+		ParameterEvents:         config.ParameterEvents,
+		SizeThreshold:           config.SizeThreshold,
+		ExtraArgs:               config.ExtraArgs,
+		RecorderOptions:         *config.recorderOptions(),
+		LogCapture:              *config.logCaptureOptions(),
+		MaxUploadCount:          config.MaxUploadCount,
+		CompressionMode:         config.CompressionMode,
+		CompressionLevel:        config.CompressionLevel,
+		RecorderCompressionMode: config.RecorderCompressionMode,
+		StorageFormat:           config.StorageFormat,
+		TelemetryInterval:       config.TelemetryInterval,
 	}
 
 	uploader := &fileUploader{
-		HTTPClient:      http.DefaultClient,
-		SigningMethod:   jwt.GetSigningMethod(config.KeyAlgorithm),
-		SigningKey:      config.privateKey,
-		TokenLifetime:   2 * time.Minute,
-		DeviceID:        config.DeviceID,
-		TenantID:        config.TenantID,
-		CompressionMode: config.CompressionMode,
-		BackendURL:      config.BackendURL,
+		HTTPClient:       http.DefaultClient,
+		SigningMethod:    jwt.GetSigningMethod(config.KeyAlgorithm),
+		SigningKey:       config.privateKey,
+		TokenLifetime:    2 * time.Minute,
+		DeviceID:         config.DeviceID,
+		TenantID:         config.TenantID,
+		CompressionMode:  config.CompressionMode,
+		CompressionLevel: config.CompressionLevel,
+		BackendURL:       config.BackendURL,
+		EncryptionKey:    config.encryptionKey,
+
+		CompressionSelector: newCompressionSelector(node.Logger(), diagnostics),
+		Logger:              node.Logger(),
+	}
+	var bagProcessors []bagProcessor
+	if config.ValidateBags {
+		bagProcessors = append(bagProcessors, newBagValidator(config.DestDir, node.Logger(), diagnostics))
+	}
+	if config.PrecompressionWorkers > 0 {
+		bagProcessors = append(bagProcessors, newBagCompressor(
+			config.PrecompressionWorkers,
+			config.CompressionMode,
+			config.CompressionLevel,
+			uploader.CompressionSelector,
+		))
+	}
+	if config.EncryptAtRest {
+		bagProcessors = append(bagProcessors, newBagEncryptor(encryptionWorkers, config.encryptionKey))
 	}
 	uploadMan := newUploadManager(
 		config.MaxUploadCount,
 		uploader,
 		node.Logger(),
 		diagnostics,
+		bagProcessors...,
 	)
 
+	shutdown := newShutdownHandler(
+		config.DrainPolicy,
+		config.ShutdownGracePeriod,
+		node.Logger(),
+		uploadMan,
+		stop,
+	)
+	defer shutdown.Close()
+	go shutdown.Run(ctx, signals)
+
+	history := newSessionHistory(config.DestDir)
+	if err = history.Load(time.Now()); err != nil {
+		node.Logger().Errorf("failed to load session history: %v", err)
+	}
+	recorder := &missionDataRecorder{
+		Dir:          config.DestDir,
+		Logger:       node.Logger(),
+		StallTimeout: config.StallTimeout,
+		Diagnostics:  diagnostics,
+		ForceStop:    shutdown.ForceStop(),
+		History:      history,
+	}
+	events, err := newEventPublisher(node)
+	if err != nil {
+		return fmt.Errorf("failed to create event publisher: %w", err)
+	}
+	defer events.Close()
+
+	tagsWatcher, err := newTagsWatcher(node, recorder.SetTags, diagnostics)
+	if err != nil {
+		return fmt.Errorf("failed to create tags watcher: %w", err)
+	}
+	defer tagsWatcher.Close()
+
 	configWatcher, err := newConfigWatcher(
 		node,
-		&missionDataRecorder{
-			Dir:    config.DestDir,
-			Logger: node.Logger(),
-		},
+		recorder,
 		uploadMan,
 		diagnostics,
 		initialConfig,
@@ -200,14 +361,70 @@ func run() (err error) {
 		return fmt.Errorf("failed to create config watcher: %w", err)
 	}
 	defer configWatcher.Close()
+	configWatcher.TopicMonitor = newTopicMonitor(node, node.Logger(), diagnostics, events)
+	telemetry, err := newTelemetryCollector(node)
+	if err != nil {
+		return fmt.Errorf("failed to create telemetry collector: %w", err)
+	}
+	defer telemetry.Close()
+	configWatcher.Telemetry = telemetry
+	logCapture, err := newLogCapture(node)
+	if err != nil {
+		return fmt.Errorf("failed to create log capture: %w", err)
+	}
+	defer logCapture.Close()
+	configWatcher.LogCapture = logCapture
+	configWatcher.Snapshotter = newSnapshotter(node, node.Logger(), config.DeviceID, config.SnapshotNodes)
+	if config.FlightStateTopic != "" {
+		configWatcher.MissionAware = true
+		configWatcher.DeferUploads = config.DeferUploads
+		flightStateWatcher, err := newFlightStateWatcher(
+			node, config.FlightStateTopic, configWatcher.SetMission, diagnostics,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to create flight state watcher: %w", err)
+		}
+		defer flightStateWatcher.Close()
+	}
 
-	if err = uploadMan.LoadExistingBags(config.DestDir); err != nil {
+	// Bags are processed and uploaded using a separate context, so that they
+	// are drained after a shutdown signal.
+	uploadCtx := shutdown.UploadContext()
+	configWatcher.UploadContext = uploadCtx
+	artifacts, err := newArtifactCollector(
+		node,
+		config.DestDir,
+		config.ArtifactDirs,
+		config.ArtifactServiceDirs,
+		config.ULogDir,
+		func(artifact *bagMetadata) { uploadMan.AddBag(uploadCtx, artifact) },
+		diagnostics,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create artifact collector: %w", err)
+	}
+	defer artifacts.Close()
+	ulogs := newULogCollector(config.ULogDir, config.DestDir, history, artifacts, node.Logger(), diagnostics)
+	api := &apiServer{
+		Addr:          config.HTTPAddr,
+		Token:         config.HTTPToken,
+		TLSCertFile:   config.HTTPTLSCert,
+		TLSKeyFile:    config.HTTPTLSKey,
+		DestDir:       config.DestDir,
+		UploadContext: uploadCtx,
+		Config:        configWatcher.Config,
+		Recorder:      recorder,
+		Uploads:       uploadMan,
+		Diagnostics:   diagnostics,
+		logger:        node.Logger(),
+	}
+	if err = uploadMan.LoadExistingBags(uploadCtx, config.DestDir); err != nil {
 		node.Logger().Errorln("failed to load existing bags:", err)
 	}
-	uploadMan.StartAllWorkers(ctx)
+	uploadMan.StartAllWorkers(uploadCtx)
 	defer uploadMan.Wait()
 
-	errs := make(chan error, 3)
+	errs := make(chan error, 6)
 	runJob := func(name string, job func(ctx context.Context) error) (err error) {
 		defer func() {
 			if r := recover(); r != nil {
@@ -227,7 +444,10 @@ func run() (err error) {
 	go runJob("rclgo", rclctx.Spin)
 	go runJob("diagnostics", diagnostics.Run)
 	go runJob("config watcher", configWatcher.Run)
-	return multierror.Append(<-errs, <-errs, <-errs).ErrorOrNil()
+	go runJob("artifact collector", artifacts.Run)
+	go runJob("ULog collector", ulogs.Run)
+	go runJob("HTTP API", api.Run)
+	return multierror.Append(<-errs, <-errs, <-errs, <-errs, <-errs, <-errs).ErrorOrNil()
 }
 
 func main() {
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"time"
+)
+
+// Only the parts of the MCAP format needed to find the start time of a bag are
+// implemented. See https://mcap.dev/spec for the specification.
+const (
+	mcapMagic = "\x89MCAP0\r\n"
+
+	mcapOpFooter     = 0x02
+	mcapOpMessage    = 0x05
+	mcapOpChunk      = 0x06
+	mcapOpDataEnd    = 0x0F
+	mcapOpStatistics = 0x0B
+
+	// Opcode, record length, summary start, summary offset start and summary
+	// CRC.
+	mcapFooterSize = 1 + 8 + 8 + 8 + 4
+
+	// Chunks can be large and only their headers are needed, so at most this
+	// many bytes of each record are kept in memory.
+	maxMCAPRecordPrefix = 1024
+)
+
+var errInvalidMCAP = errors.New("invalid MCAP file")
+
+// getMCAPStartTime returns the log time of the first message in the MCAP file
+// at path. The time is read from the statistics record in the summary section
+// if it exists. Otherwise, the data section is scanned, which also works for
+// files which were not closed properly.
+func getMCAPStartTime(path string) (time.Time, error) {
+	//#nosec G304 -- The path is constructed by this program.
+	f, err := os.Open(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer f.Close()
+	magic := make([]byte, len(mcapMagic))
+	if _, err = io.ReadFull(f, magic); err != nil || string(magic) != mcapMagic {
+		return time.Time{}, errInvalidMCAP
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return time.Time{}, err
+	}
+	start, ok, err := readMCAPStatistics(f, info.Size())
+	if err != nil {
+		return time.Time{}, err
+	}
+	if !ok {
+		if _, err = f.Seek(int64(len(mcapMagic)), io.SeekStart); err != nil {
+			return time.Time{}, err
+		}
+		if start, err = scanMCAPStartTime(bufio.NewReader(f)); err != nil {
+			return time.Time{}, err
+		}
+	}
+	return time.Unix(0, int64(start)).UTC(), nil
+}
+
+// readMCAPStartTime returns the log time of the first message in the MCAP file
+// read from r by scanning its data section. It is used for streams which can't
+// be seeked, such as compressed files.
+func readMCAPStartTime(r *bufio.Reader) (time.Time, error) {
+	magic := make([]byte, len(mcapMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != mcapMagic {
+		return time.Time{}, errInvalidMCAP
+	}
+	start, err := scanMCAPStartTime(r)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, int64(start)).UTC(), nil
+}
+
+// readMCAPStatistics reads the message start time from the statistics record.
+// ok is false if the file has no footer or statistics record.
+func readMCAPStatistics(f io.ReaderAt, size int64) (start uint64, ok bool, err error) {
+	footerStart := size - int64(len(mcapMagic)) - mcapFooterSize
+	if footerStart < int64(len(mcapMagic)) {
+		return 0, false, nil
+	}
+	footer := make([]byte, mcapFooterSize+len(mcapMagic))
+	if _, err = f.ReadAt(footer, footerStart); err != nil {
+		return 0, false, err
+	}
+	if footer[0] != mcapOpFooter || string(footer[mcapFooterSize:]) != mcapMagic {
+		return 0, false, nil
+	}
+	summaryStart := int64(binary.LittleEndian.Uint64(footer[9:]))
+	if summaryStart == 0 || summaryStart >= footerStart {
+		return 0, false, nil
+	}
+	summary := io.NewSectionReader(f, summaryStart, footerStart-summaryStart)
+	r := bufio.NewReader(summary)
+	for {
+		op, content, err := readMCAPRecord(r)
+		if errors.Is(err, io.EOF) {
+			return 0, false, nil
+		} else if err != nil {
+			return 0, false, err
+		}
+		if op != mcapOpStatistics {
+			continue
+		}
+		// Message count, schema count, channel count, attachment count,
+		// metadata count, chunk count and message start time.
+		const startOffset = 8 + 2 + 4 + 4 + 4 + 4
+		if len(content) < startOffset+8 {
+			return 0, false, errInvalidMCAP
+		}
+		if binary.LittleEndian.Uint64(content) == 0 {
+			return 0, false, errEmptyBag
+		}
+		return binary.LittleEndian.Uint64(content[startOffset:]), true, nil
+	}
+}
+
+// scanMCAPStartTime returns the smallest message log time in the data section
+// read from r. Chunks are not decompressed, because their records contain the
+// start time of the messages in them.
+func scanMCAPStartTime(r *bufio.Reader) (uint64, error) {
+	var (
+		start uint64 = math.MaxUint64
+		found bool
+	)
+	for {
+		op, content, err := readMCAPRecord(r)
+		// A truncated record means that the file was not closed properly.
+		// The messages before it are still valid.
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		} else if err != nil {
+			return 0, err
+		}
+		var t uint64
+		switch op {
+		case mcapOpMessage:
+			// Channel ID, sequence and log time.
+			if len(content) < 2+4+8 {
+				return 0, errInvalidMCAP
+			}
+			t = binary.LittleEndian.Uint64(content[6:])
+		case mcapOpChunk:
+			// Message start time, message end time and uncompressed size.
+			if len(content) < 8+8+8 {
+				return 0, errInvalidMCAP
+			}
+			if binary.LittleEndian.Uint64(content[16:]) == 0 {
+				continue
+			}
+			t = binary.LittleEndian.Uint64(content)
+		case mcapOpDataEnd, mcapOpFooter:
+			return finishMCAPScan(start, found)
+		default:
+			continue
+		}
+		found = true
+		if t < start {
+			start = t
+		}
+	}
+	return finishMCAPScan(start, found)
+}
+
+func finishMCAPScan(start uint64, found bool) (uint64, error) {
+	if !found {
+		return 0, errEmptyBag
+	}
+	return start, nil
+}
+
+func readMCAPRecord(r *bufio.Reader) (op byte, content []byte, err error) {
+	op, err = r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	var length uint64
+	if err = binary.Read(r, binary.LittleEndian, &length); err != nil {
+		return 0, nil, noEOF(err)
+	}
+	n := length
+	if n > maxMCAPRecordPrefix {
+		n = maxMCAPRecordPrefix
+	}
+	var buf bytes.Buffer
+	if _, err = io.CopyN(&buf, r, int64(n)); err != nil {
+		return 0, nil, noEOF(err)
+	}
+	if _, err = r.Discard(int(length - n)); err != nil {
+		return 0, nil, noEOF(err)
+	}
+	return op, buf.Bytes(), nil
+}
+
+// noEOF converts io.EOF to io.ErrUnexpectedEOF, because a record was
+// partially read.
+func noEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return fmt.Errorf("%w: truncated record", io.ErrUnexpectedEOF)
+	}
+	return err
+}
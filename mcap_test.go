@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type mcapBuilder struct {
+	bytes.Buffer
+}
+
+func (b *mcapBuilder) record(op byte, fields ...interface{}) {
+	var content bytes.Buffer
+	for _, f := range fields {
+		if err := binary.Write(&content, binary.LittleEndian, f); err != nil {
+			panic(err)
+		}
+	}
+	b.WriteByte(op)
+	_ = binary.Write(b, binary.LittleEndian, uint64(content.Len()))
+	b.Write(content.Bytes())
+}
+
+func (b *mcapBuilder) message(logTime uint64) {
+	b.record(mcapOpMessage, uint16(1), uint32(0), logTime, logTime, []byte("data"))
+}
+
+func (b *mcapBuilder) chunk(start, end, size uint64) {
+	b.record(mcapOpChunk, start, end, size, uint32(0), uint32(4), []byte("zstd"), uint64(1), []byte{0})
+}
+
+func (b *mcapBuilder) finish(statistics bool, messageCount, start uint64) {
+	b.record(mcapOpDataEnd, uint32(0))
+	var summaryStart uint64
+	if statistics {
+		summaryStart = uint64(b.Len())
+		b.record(mcapOpStatistics,
+			messageCount, uint16(1), uint32(1), uint32(0), uint32(0), uint32(1),
+			start, start+1, uint32(0),
+		)
+	}
+	b.record(mcapOpFooter, summaryStart, uint64(0), uint32(0))
+	b.WriteString(mcapMagic)
+}
+
+func newMCAPBuilder() *mcapBuilder {
+	b := &mcapBuilder{}
+	b.WriteString(mcapMagic)
+	b.record(0x01, uint32(4), []byte("ros2"), uint32(0))
+	return b
+}
+
+func TestMCAPStartTime(t *testing.T) {
+	dir := t.TempDir()
+	startTime := func(b *mcapBuilder) (time.Time, error) {
+		path := filepath.Join(dir, "bag_0.mcap")
+		So(os.WriteFile(path, b.Bytes(), 0o600), ShouldBeNil)
+		return getRecordStartTime(context.Background(), path)
+	}
+	Convey("Scenario: the start time is read from the statistics record", t, func() {
+		b := newMCAPBuilder()
+		b.message(5e9)
+		b.finish(true, 1, 4e9)
+		start, err := startTime(b)
+		So(err, ShouldBeNil)
+		So(start.Equal(time.Unix(4, 0)), ShouldBeTrue)
+	})
+	Convey("Scenario: the data section is scanned if there are no statistics", t, func() {
+		b := newMCAPBuilder()
+		b.chunk(7e9, 8e9, 100)
+		b.chunk(1e9, 1e9, 0)
+		b.message(6e9)
+		b.finish(false, 0, 0)
+		start, err := startTime(b)
+		So(err, ShouldBeNil)
+		So(start.Equal(time.Unix(6, 0)), ShouldBeTrue)
+	})
+	Convey("Scenario: truncated files are scanned until the truncated record", t, func() {
+		b := newMCAPBuilder()
+		b.message(3e9)
+		b.message(2e9)
+		data := b.Bytes()
+		b.Truncate(len(data) - 3)
+		start, err := startTime(b)
+		So(err, ShouldBeNil)
+		So(start.Equal(time.Unix(3, 0)), ShouldBeTrue)
+	})
+	Convey("Scenario: empty bags are detected", t, func() {
+		b := newMCAPBuilder()
+		b.finish(true, 0, 0)
+		_, err := startTime(b)
+		So(err, ShouldEqual, errEmptyBag)
+		b = newMCAPBuilder()
+		b.finish(false, 0, 0)
+		_, err = startTime(b)
+		So(err, ShouldEqual, errEmptyBag)
+	})
+	Convey("Scenario: MCAP bags are recognized", t, func() {
+		bag := newBagMetadata(filepath.Join(dir, "bag_3.mcap.zst"), -1, true)
+		So(bag.path, ShouldEqual, filepath.Join(dir, "bag_2.mcap"))
+		So(bag.ext, ShouldEqual, ".zst")
+		So(bag.storageExt(), ShouldEqual, ".mcap")
+		So(globRegex.MatchString("/x/bag_3.mcap"), ShouldBeTrue)
+	})
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"os"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// bagCompressor compresses completed bags in the destination directory so that
+// they don't need to be compressed again if an upload is retried and so that
+// their size and checksum are known before uploading. At most Workers bags are
+// compressed concurrently.
+type bagCompressor struct {
+	Mode  compressionMode
+	Level int
+
+	// Used to select the compression mode if Mode is compressionAuto.
+	Selector *compressionSelector
+
+	workers *semaphore.Weighted
+}
+
+func newBagCompressor(
+	workers int, mode compressionMode, level int, selector *compressionSelector,
+) *bagCompressor {
+	return &bagCompressor{
+		Mode:     mode,
+		Level:    level,
+		Selector: selector,
+		workers:  semaphore.NewWeighted(int64(workers)),
+	}
+}
+
+func (c *bagCompressor) ProcessBag(ctx context.Context, bag *bagMetadata) (err error) {
+	// Bags with extensions have already been compressed or encrypted.
+	if bag.ext != "" || c.Mode == compressionNone {
+		return nil
+	}
+	if err = c.workers.Acquire(ctx, 1); err != nil {
+		return err
+	}
+	defer c.workers.Release(1)
+	defer wrapErr("failed to compress bag: %w", &err)
+	manifest, err := loadBagManifest(bag)
+	if err != nil {
+		return err
+	}
+	// The start time can't be read from the bag after it has been compressed.
+	if manifest.RecordStartTime.IsZero() {
+		manifest.RecordStartTime, err = getRecordStartTime(ctx, bag.filePath())
+		if errors.Is(err, errEmptyBag) {
+			// Empty bags are removed when they are uploaded.
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+	src, err := os.Open(bag.filePath())
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	mode, level, err := c.compressionFor(src)
+	if err != nil {
+		return err
+	}
+	modifier, ext, err := compressionModifier(mode, level)
+	if err != nil || modifier == nil {
+		return err
+	}
+	var digest *digestWriter
+	err = writeFileAtomic(bag.filePath()+ext, func(w io.Writer) error {
+		digest = newDigestWriter(w)
+		zw, err := modifier(digest)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(zw, &contextReader{ctx: ctx, r: src}); err != nil {
+			zw.Close()
+			return err
+		}
+		return zw.Close()
+	})
+	if err != nil {
+		return err
+	}
+	digest.setTo(manifest)
+	if err = saveBagManifest(bag, manifest); err != nil {
+		return err
+	}
+	// The uncompressed bag is removed only after the manifest has been saved,
+	// so that an interrupted compression is restarted from the beginning when
+	// the bag is loaded again.
+	if err = os.Remove(bag.filePath()); err != nil {
+		return err
+	}
+	bag.ext += ext
+	return nil
+}
+
+func (c *bagCompressor) compressionFor(f *os.File) (compressionMode, int, error) {
+	if c.Mode != compressionAuto {
+		return c.Mode, c.Level, nil
+	}
+	if c.Selector == nil {
+		return compressionNone, 0, nil
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return "", 0, err
+	}
+	candidate, err := c.Selector.Select(f, info.Size())
+	if err != nil {
+		return "", 0, err
+	}
+	return candidate.Mode, candidate.Level, nil
+}
+
+// contextReader stops reading from r when ctx is cancelled so that compressing
+// a large bag doesn't delay shutdown.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *contextReader) Read(data []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(data)
+}
+
+// digestWriter computes the size and the SHA-256 checksum of the data written
+// through it.
+type digestWriter struct {
+	w    io.Writer
+	hash hash.Hash
+	size int64
+}
+
+func newDigestWriter(w io.Writer) *digestWriter {
+	return &digestWriter{w: w, hash: sha256.New()}
+}
+
+func (d *digestWriter) Write(data []byte) (int, error) {
+	n, err := d.w.Write(data)
+	d.hash.Write(data[:n])
+	d.size += int64(n)
+	return n, err
+}
+
+func (d *digestWriter) setTo(manifest *bagManifest) {
+	manifest.Size = d.size
+	manifest.SHA256 = hex.EncodeToString(d.hash.Sum(nil))
+}
+
+// fileDigest stores the size and the SHA-256 checksum of the file at path to
+// manifest.
+func fileDigest(path string, manifest *bagManifest) error {
+	//#nosec G304 -- The path is constructed by this program.
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	digest := newDigestWriter(io.Discard)
+	if _, err = io.Copy(digest, f); err != nil {
+		return err
+	}
+	digest.setTo(manifest)
+	return nil
+}
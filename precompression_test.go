@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestBagCompressor(t *testing.T) {
+	var (
+		dir        = t.TempDir()
+		bag        = newBagMetadata(filepath.Join(dir, "bag_0.db3"), 0, false)
+		compressor = newBagCompressor(1, compressionZstd, 3, nil)
+		original   []byte
+	)
+	createTestBag(t, bag.path, 2e9, 1e9)
+	Convey("Scenario: bagCompressor compresses bags at rest", t, func() {
+		Convey("Compress the bag", func() {
+			var err error
+			original, err = os.ReadFile(bag.path)
+			So(err, ShouldBeNil)
+			So(compressor.ProcessBag(context.Background(), bag), ShouldBeNil)
+		})
+		Convey("The bag is replaced with the compressed bag", func() {
+			So(bag.ext, ShouldEqual, ".zst")
+			_, err := os.Stat(bag.path)
+			So(os.IsNotExist(err), ShouldBeTrue)
+			f, err := os.Open(bag.filePath())
+			So(err, ShouldBeNil)
+			defer f.Close()
+			r, err := zstd.NewReader(f)
+			So(err, ShouldBeNil)
+			defer r.Close()
+			decompressed, err := io.ReadAll(r)
+			So(err, ShouldBeNil)
+			So(bytes.Equal(decompressed, original), ShouldBeTrue)
+		})
+		Convey("The manifest contains the start time, size and checksum", func() {
+			manifest, err := loadBagManifest(bag)
+			So(err, ShouldBeNil)
+			So(manifest.RecordStartTime.Equal(time.Unix(1, 0)), ShouldBeTrue)
+			compressed, err := os.ReadFile(bag.filePath())
+			So(err, ShouldBeNil)
+			sum := sha256.Sum256(compressed)
+			So(manifest.Size, ShouldEqual, len(compressed))
+			So(manifest.SHA256, ShouldEqual, hex.EncodeToString(sum[:]))
+		})
+		Convey("Compressed bags are loaded and not compressed again", func() {
+			loaded := newBagMetadata(bag.filePath(), 0, false)
+			So(loaded.ext, ShouldEqual, ".zst")
+			So(compressor.ProcessBag(context.Background(), loaded), ShouldBeNil)
+			So(loaded.ext, ShouldEqual, ".zst")
+		})
+	})
+}
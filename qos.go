@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// defaultQoSDepth is the history depth used in QoS overrides which don't set
+// it. It is the same as the default depth of ros bag record.
+const defaultQoSDepth = 10
+
+var (
+	qosReliabilities = map[string]bool{"system_default": true, "reliable": true, "best_effort": true}
+	qosDurabilities  = map[string]bool{"system_default": true, "volatile": true, "transient_local": true}
+)
+
+// topicQoS overrides the QoS policies ros bag record uses to subscribe to a
+// topic. Empty policies are detected by ros bag record from the publishers of
+// the topic.
+type topicQoS struct {
+	// Reliability is system_default, reliable or best_effort.
+	Reliability string `yaml:"reliability"`
+	// Durability is system_default, volatile or transient_local.
+	Durability string `yaml:"durability"`
+	// Depth is the depth of the keep last history. If zero, defaultQoSDepth
+	// is used.
+	Depth int `yaml:"depth"`
+}
+
+func (q *topicQoS) validate() error {
+	if q.Reliability != "" && !qosReliabilities[q.Reliability] {
+		return fmt.Errorf("invalid reliability: %s", q.Reliability)
+	}
+	if q.Durability != "" && !qosDurabilities[q.Durability] {
+		return fmt.Errorf("invalid durability: %s", q.Durability)
+	}
+	if q.Depth < 0 {
+		return errors.New("'depth' must be non-negative")
+	}
+	return nil
+}
+
+func validateQoSOverrides(overrides map[string]topicQoS) error {
+	for name, q := range overrides {
+		if !strings.HasPrefix(name, "/") {
+			return fmt.Errorf("QoS override topic '%s' must be an absolute topic name", name)
+		}
+		if err := q.validate(); err != nil {
+			return fmt.Errorf("invalid QoS override of topic '%s': %w", name, err)
+		}
+	}
+	return nil
+}
+
+// qosProfileOverride is the format of a topic in the QoS profile overrides
+// file of ros bag record.
+type qosProfileOverride struct {
+	History     string `yaml:"history"`
+	Depth       int    `yaml:"depth"`
+	Reliability string `yaml:"reliability,omitempty"`
+	Durability  string `yaml:"durability,omitempty"`
+}
+
+func writeQoSOverrides(w io.Writer, overrides map[string]topicQoS) error {
+	profiles := make(map[string]qosProfileOverride, len(overrides))
+	for name, q := range overrides {
+		p := qosProfileOverride{
+			History:     "keep_last",
+			Depth:       q.Depth,
+			Reliability: q.Reliability,
+			Durability:  q.Durability,
+		}
+		if p.Depth == 0 {
+			p.Depth = defaultQoSDepth
+		}
+		profiles[name] = p
+	}
+	enc := yaml.NewEncoder(w)
+	if err := enc.Encode(profiles); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// createQoSOverridesFile writes overrides to a temporary file, which must be
+// removed by the caller.
+func createQoSOverridesFile(overrides map[string]topicQoS) (path string, err error) {
+	f, err := os.CreateTemp("", "qos-overrides-*.yaml")
+	if err != nil {
+		return "", fmt.Errorf("failed to create QoS overrides file: %w", err)
+	}
+	defer f.Close()
+	if err = writeQoSOverrides(f, overrides); err == nil {
+		err = f.Close()
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("failed to write QoS overrides file: %w", err)
+	}
+	return f.Name(), nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestQoSOverrides(t *testing.T) {
+	Convey("QoS overrides are written in the format of ros bag record", t, func() {
+		var out strings.Builder
+		So(writeQoSOverrides(&out, map[string]topicQoS{
+			"/camera": {Reliability: "best_effort", Depth: 5},
+			"/map":    {Durability: "transient_local"},
+		}), ShouldBeNil)
+		So(out.String(), ShouldEqual, `/camera:
+    history: keep_last
+    depth: 5
+    reliability: best_effort
+/map:
+    history: keep_last
+    depth: 10
+    durability: transient_local
+`)
+	})
+	Convey("The QoS overrides file is passed to ros bag record", t, func() {
+		r := &missionDataRecorder{Topics: []string{"/camera"}}
+		path, err := createQoSOverridesFile(map[string]topicQoS{"/camera": {Reliability: "reliable"}})
+		So(err, ShouldBeNil)
+		defer os.Remove(path)
+		So(r.newCommand(path).Args, ShouldContain, "--qos-profile-overrides-path")
+		So(r.newCommand("").Args, ShouldNotContain, "--qos-profile-overrides-path")
+	})
+	Convey("Invalid QoS overrides are rejected", t, func() {
+		So(validateQoSOverrides(map[string]topicQoS{"/a": {Reliability: "reliable"}}), ShouldBeNil)
+		So(validateQoSOverrides(map[string]topicQoS{"a": {}}), ShouldBeError)
+		So(validateQoSOverrides(map[string]topicQoS{"/a": {Durability: "persistent"}}), ShouldBeError)
+	})
+}
@@ -8,14 +8,136 @@ import (
 	"os/exec"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
+	"gopkg.in/yaml.v3"
 )
 
 type onBagReady = func(context.Context, *bagMetadata)
 
+// storageFormat is the storage plugin used by ros2 bag record.
+type storageFormat string
+
+const (
+	storageSQLite3 storageFormat = "sqlite3"
+	storageMCAP    storageFormat = "mcap"
+)
+
+// storageExtensions maps the storage formats to the extensions of the bag files
+// they create.
+var storageExtensions = map[storageFormat]string{
+	storageSQLite3: ".db3",
+	storageMCAP:    ".mcap",
+}
+
+func (f storageFormat) String() string {
+	return string(f)
+}
+
+func (f storageFormat) Type() string {
+	return "storage format"
+}
+
+func (f *storageFormat) Set(val string) error {
+	format, err := f.Parse(val)
+	if err != nil {
+		return err
+	}
+	*f = format.(storageFormat)
+	return nil
+}
+
+func (f storageFormat) Parse(val interface{}) (interface{}, error) {
+	if val, ok := val.(string); ok {
+		switch val {
+		case "sqlite3":
+			return storageSQLite3, nil
+		case "mcap":
+			return storageMCAP, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid storage format: %v", val)
+}
+
+func (f *storageFormat) UnmarshalYAML(val *yaml.Node) error {
+	var decoded interface{}
+	if err := val.Decode(&decoded); err != nil {
+		return err
+	}
+	format, err := f.Parse(decoded)
+	if err != nil {
+		return err
+	}
+	*f = format.(storageFormat)
+	return nil
+}
+
+// recorderCompressionMode is the compression mode used by ros2 bag record.
+type recorderCompressionMode string
+
+const (
+	recorderCompressionNone    recorderCompressionMode = "none"
+	recorderCompressionFile    recorderCompressionMode = "file"
+	recorderCompressionMessage recorderCompressionMode = "message"
+)
+
+// recorderCompressionFormat is the only compression format supported by
+// rosbag2.
+const recorderCompressionFormat = "zstd"
+
+// recorderCompressedBagExtension is appended to the bags compressed by ros2 bag
+// record when recorderCompressionFile is used.
+const recorderCompressedBagExtension = "." + recorderCompressionFormat
+
+func (m recorderCompressionMode) String() string {
+	return string(m)
+}
+
+func (m recorderCompressionMode) Type() string {
+	return "recorder compression mode"
+}
+
+func (m *recorderCompressionMode) Set(val string) error {
+	mode, err := m.Parse(val)
+	if err != nil {
+		return err
+	}
+	*m = mode.(recorderCompressionMode)
+	return nil
+}
+
+func (m recorderCompressionMode) Parse(val interface{}) (interface{}, error) {
+	if val, ok := val.(string); ok {
+		switch val {
+		case "none":
+			return recorderCompressionNone, nil
+		case "file":
+			return recorderCompressionFile, nil
+		case "message":
+			return recorderCompressionMessage, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid recorder compression mode: %v", val)
+}
+
+func (m *recorderCompressionMode) UnmarshalYAML(val *yaml.Node) error {
+	var decoded interface{}
+	if err := val.Decode(&decoded); err != nil {
+		return err
+	}
+	mode, err := m.Parse(decoded)
+	if err != nil {
+		return err
+	}
+	*m = mode.(recorderCompressionMode)
+	return nil
+}
+
 type missionDataRecorder struct {
 	// If empty defaults to "ros2".
 	ROSCommand string
@@ -30,55 +152,200 @@ type missionDataRecorder struct {
 	// Extra arguments passed to ros bag record command.
 	ExtraArgs []string
 
+	// Options of ros bag record. If Options.TopicRegex is set and Topics is
+	// empty, only the topics matching the regex are recorded.
+	Options recorderOptions
+
+	// QoS policies overriding the ones detected by ros bag record for the
+	// given topics.
+	QoSOverrides map[string]topicQoS
+
+	// Storage format used by ros bag record. If empty, the default format of
+	// ros bag record is used.
+	StorageFormat storageFormat
+
+	// Compression mode used by ros bag record. If empty, bags are not
+	// compressed during recording. When recorderCompressionFile is used, a bag
+	// is ready when ros bag record has compressed it and removed the
+	// uncompressed file.
+	CompressionMode recorderCompressionMode
+
 	// Directory where bags will be stored. This field must not be empty.
 	Dir string
 
+	// ID of the mission stored in the session of the recording. If empty, the
+	// recording doesn't belong to a mission. Must be changed using
+	// SetMissionID while the recorder is running.
+	MissionID string
+
 	Logger logger
 
+	// If StallTimeout is positive, ros bag record is killed if nothing is
+	// written for StallTimeout while messages are published on the recorded
+	// topics according to RecordedMessages, which returns the number of
+	// messages published so far on the expected topics which are recorded. If RecordedMessages is nil, messages are
+	// assumed to be published all the time.
+	StallTimeout     time.Duration
+	RecordedMessages func() int64
+
+	Diagnostics *diagnosticsMonitor
+
+	// If ForceStop is closed while ros bag record is being stopped, it is
+	// killed immediately instead of after recorderStopTimeout.
+	ForceStop <-chan struct{}
+
+	// If non-nil, CaptureSnapshot is called with the directory of a session
+	// when the session starts. Bags are passed to onBagReady after
+	// CaptureSnapshot has returned, because the snapshot is uploaded with the
+	// first bag of the session which isn't empty.
+	CaptureSnapshot func(dir string)
+	snapshots       sync.WaitGroup
+
+	// If non-nil, CaptureLogs is called with the directory of a session when
+	// the session starts. The returned function is called after ros bag record
+	// has exited and returns the log archive of the session, which is passed
+	// to onBagReady after the bags, or nil if there is no archive.
+	CaptureLogs func(dir string) (stop func() *bagMetadata)
+	// +checklocks:sessionMutex
+	stopLogs func() *bagMetadata
+
+	// If non-nil, the start and end times of sessions are recorded in History.
+	History *sessionHistory
+
 	// This is the subdirectory of Dir currently used by the recorder.
 	currentDir string
+
+	sessionMutex sync.Mutex
+	// Tags stored in the sessions of recordings.
+	// +checklocks:sessionMutex
+	tags map[string]string
+	// True if the session file of the current recording may be updated.
+	// +checklocks:sessionMutex
+	sessionActive bool
+	// The current session. It is nil if no session is active.
+	// +checklocks:sessionMutex
+	session *sessionRecord
+
+	// Paths of the bags of the current recording passed to onBagReady.
+	readyMutex sync.Mutex
+	// +checklocks:readyMutex
+	readyBags map[string]bool
+	pending   sync.WaitGroup
 }
 
+// recorderStopTimeout is the time ros bag record is given to exit after it has
+// been interrupted before it is killed.
+const recorderStopTimeout = 10 * time.Second
+
+// recorderOutputTimeout is the time the output of ros bag record is read after
+// it has exited.
+const recorderOutputTimeout = time.Second
+
 func (r *missionDataRecorder) Start(ctx context.Context, onBagReady onBagReady) error {
 	//#nosec G301 -- The directory doesn't contain secrets.
 	if err := os.MkdirAll(r.Dir, 0755); err != nil {
 		return fmt.Errorf("failed to create directory %s: %w", r.Dir, err)
 	}
 	r.currentDir = filepath.Join(r.Dir, time.Now().UTC().Format(timeFormat))
+	r.readyMutex.Lock()
+	r.readyBags = make(map[string]bool)
+	r.readyMutex.Unlock()
+	r.sessionMutex.Lock()
+	r.sessionActive = false
+	r.sessionMutex.Unlock()
 	watcher, err := r.startWatcher(ctx, onBagReady)
 	if err != nil {
 		return fmt.Errorf("failed to start file watching: %w", err)
 	}
 	defer watcher.Close()
-	cmd := r.newCommand(ctx)
-	if err := cmd.Start(); err != nil {
+	var qosOverridesPath string
+	if len(r.QoSOverrides) > 0 {
+		if qosOverridesPath, err = createQoSOverridesFile(r.QoSOverrides); err != nil {
+			return err
+		}
+		defer os.Remove(qosOverridesPath)
+	}
+	cmd := r.newCommand(qosOverridesPath)
+	supervisor := newRecorderSupervisor(r.currentDir, r.StallTimeout, r.Logger, r.Diagnostics)
+	supervisor.RecordedMessages = r.RecordedMessages
+	// The output is read from a pipe which isn't closed by Wait, so that it
+	// can be read concurrently with Wait. Processes started by ros bag record
+	// may keep the pipe open after it has exited.
+	stderr, stderrWriter, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("failed to start recorder: %w", err)
+	}
+	defer stderr.Close()
+	cmd.Stderr = stderrWriter
+	err = cmd.Start()
+	stderrWriter.Close()
+	if err != nil {
 		return fmt.Errorf("failed to start recorder: %w", err)
 	}
+	outputDone := make(chan struct{})
+	go func() {
+		defer close(outputDone)
+		supervisor.CaptureOutput(stderr)
+	}()
+	// The last bag is never followed by a new bag, so it is detected after
+	// the recorder has exited. Deferred calls are run in reverse order, so
+	// this is run after the recorder has been killed.
+	defer r.finalizeBags(ctx, onBagReady)
+	monitorCtx, stopMonitor := context.WithCancel(ctx)
+	defer stopMonitor()
+	stalled := make(chan error, 1)
+	go func() {
+		err := supervisor.Monitor(monitorCtx, cmd.Process.Pid)
+		if err != nil {
+			r.Logger.Errorf("killing recorder: %v", err)
+			r.kill(cmd)
+		}
+		stalled <- err
+	}()
 	stopped := make(chan struct{}, 2)
 	defer func() { stopped <- struct{}{} }()
 	stopErr := make(chan error, 1)
 	go func() {
 		select {
 		case <-stopped:
-			if err := cmd.Process.Kill(); err != nil {
-				r.Logger.Errorf("failed to kill recorder process: %v", err)
-			}
+			r.kill(cmd)
 			stopErr <- nil
 		case <-ctx.Done():
 			if err := cmd.Process.Signal(os.Interrupt); err != nil {
-				if killErr := cmd.Process.Kill(); killErr != nil {
-					r.Logger.Errorf("failed to kill recorder process: %v", killErr)
-				}
+				r.kill(cmd)
 				stopErr <- err
-			} else {
+				return
+			}
+			select {
+			case <-stopped:
 				stopErr <- nil
+				return
+			case <-time.After(recorderStopTimeout):
+				r.Logger.Errorf("recorder didn't stop in %v, killing it", recorderStopTimeout)
+			case <-r.ForceStop:
 			}
+			r.kill(cmd)
+			stopErr <- nil
 		}
 	}()
 	var exitErr *exec.ExitError
 	err = cmd.Wait()
+	// The output written just before exiting is usually the reason for the
+	// exit, so it is read before returning unless the pipe is kept open.
+	select {
+	case <-outputDone:
+	case <-time.After(recorderOutputTimeout):
+		stderr.Close()
+		<-outputDone
+	}
+	stopMonitor()
+	if stallErr := <-stalled; stallErr != nil {
+		return fmt.Errorf("%w%s", stallErr, errorLinesSuffix(supervisor.ErrorLines()))
+	}
 	if err != nil && !(errors.As(err, &exitErr) && exitErr.ExitCode() == 2) {
-		return fmt.Errorf("an error occurred during recording: %w", err)
+		return fmt.Errorf(
+			"an error occurred during recording: %w%s", err, errorLinesSuffix(supervisor.ErrorLines()),
+		)
 	}
 	stopped <- struct{}{}
 	if err := <-stopErr; err != nil {
@@ -87,7 +354,17 @@ func (r *missionDataRecorder) Start(ctx context.Context, onBagReady onBagReady)
 	return nil
 }
 
-func (r *missionDataRecorder) newCommand(ctx context.Context) *exec.Cmd {
+func (r *missionDataRecorder) kill(cmd *exec.Cmd) {
+	if err := cmd.Process.Kill(); err != nil && !errors.Is(err, os.ErrProcessDone) {
+		r.Logger.Errorf("failed to kill recorder process: %v", err)
+	}
+}
+
+// newCommand creates the ros bag record command. The command isn't bound to a
+// context, because it must be interrupted instead of killed to let it finish
+// writing the last bag. If qosOverridesPath is not empty, the QoS profile
+// overrides are read from it.
+func (r *missionDataRecorder) newCommand(qosOverridesPath string) *exec.Cmd {
 	rosCmd := r.ROSCommand
 	if rosCmd == "" {
 		rosCmd = "ros2"
@@ -96,17 +373,37 @@ func (r *missionDataRecorder) newCommand(ctx context.Context) *exec.Cmd {
 	if r.SizeThreshold > 0 {
 		args = append(args, "--max-bag-size", strconv.Itoa(r.SizeThreshold))
 	}
+	if r.StorageFormat != "" {
+		args = append(args, "--storage", string(r.StorageFormat))
+	}
+	if r.CompressionMode != "" && r.CompressionMode != recorderCompressionNone {
+		args = append(args,
+			"--compression-mode", string(r.CompressionMode),
+			"--compression-format", recorderCompressionFormat,
+		)
+	}
+	if qosOverridesPath != "" {
+		args = append(args, "--qos-profile-overrides-path", qosOverridesPath)
+	}
+	args = append(args, r.Options.args()...)
 	args = append(args, r.ExtraArgs...)
+	if r.Options.TopicRegex != "" {
+		args = append(args, "--regex", r.Options.TopicRegex)
+	}
+	if r.Options.ExcludeRegex != "" {
+		args = append(args, "--exclude", r.Options.ExcludeRegex)
+	}
 	if len(r.Topics) == 0 {
-		args = append(args, "--all")
+		if r.Options.TopicRegex == "" {
+			args = append(args, "--all")
+		}
 	} else {
 		args = append(args, "--")
 		args = append(args, r.Topics...)
 	}
 	//#nosec G204 -- The command needs to be configurable.
-	cmd := exec.CommandContext(ctx, rosCmd, args...)
+	cmd := exec.Command(rosCmd, args...)
 	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
 	return cmd
 }
 
@@ -132,9 +429,14 @@ func (r *missionDataRecorder) startWatcher(
 					if filepath.Clean(event.Name) == cleanedDir {
 						r.logFileWatchErr(watcher.Remove(filepath.Dir(r.currentDir)))
 						r.logFileWatchErr(watcher.Add(r.currentDir))
+						r.startSession()
+						r.startSnapshot()
+						r.startLogCapture()
 					} else {
 						r.notifyIfBagReady(ctx, onBagReady, event.Name)
 					}
+				} else if event.Op&fsnotify.Remove == fsnotify.Remove {
+					r.notifyIfCompressedBagReady(ctx, onBagReady, event.Name)
 				}
 			case err, ok := <-watcher.Errors:
 				if !ok {
@@ -164,19 +466,269 @@ func (r *missionDataRecorder) notifyIfBagReady(
 	// A notification for bag number n means bag number n-1 is ready, because
 	// the file creation notification is emitted when the bag is created and is
 	// initially empty.
-	if bag := newBagMetadata(bagPath, -1, true); bag != nil && bag.number >= 0 {
-		go onBagReady(ctx, bag)
+	if r.CompressionMode == recorderCompressionFile {
+		return
+	}
+	bag := newBagMetadata(bagPath, -1, true)
+	if bag != nil && bag.number >= 0 && bag.ext == "" {
+		r.notifyBagReady(ctx, onBagReady, bag)
+	}
+}
+
+func (r *missionDataRecorder) notifyIfCompressedBagReady(
+	ctx context.Context, onBagReady onBagReady, bagPath string,
+) {
+	// When file compression is used, ros bag record removes the uncompressed
+	// bag after it has been compressed.
+	if r.CompressionMode != recorderCompressionFile {
+		return
+	}
+	if bag := newBagMetadata(bagPath, 0, true); bag != nil && bag.ext == "" {
+		bag.ext = recorderCompressedBagExtension
+		r.notifyBagReady(ctx, onBagReady, bag)
+	}
+}
+
+// startSession saves the mission and tags of the session when the recording
+// directory has been created, so that the bags uploaded before the session ends
+// can be tagged with them.
+func (r *missionDataRecorder) startSession() {
+	r.sessionMutex.Lock()
+	defer r.sessionMutex.Unlock()
+	r.sessionActive = true
+	id := filepath.Base(r.currentDir)
+	start, err := time.Parse(timeFormat, id)
+	if err != nil {
+		start = time.Now()
+	}
+	if err = r.History.Started(id, r.MissionID, start); err != nil {
+		r.Logger.Errorf("failed to update session history: %v", err)
+	}
+	r.session = &sessionRecord{ID: id, MissionID: r.MissionID, Start: start}
+	if r.MissionID == "" && len(r.tags) == 0 {
+		return
+	}
+	if err := r.saveSession(0); err != nil {
+		r.Logger.Errorf("failed to save session: %v", err)
+	}
+}
+
+func (r *missionDataRecorder) startSnapshot() {
+	if r.CaptureSnapshot == nil {
+		return
+	}
+	r.snapshots.Add(1)
+	go func(dir string) {
+		defer r.snapshots.Done()
+		r.CaptureSnapshot(dir)
+	}(r.currentDir)
+}
+
+func (r *missionDataRecorder) startLogCapture() {
+	if r.CaptureLogs == nil {
+		return
+	}
+	stop := r.CaptureLogs(r.currentDir)
+	r.sessionMutex.Lock()
+	defer r.sessionMutex.Unlock()
+	r.stopLogs = stop
+}
+
+// stopLogCapture stops capturing the logs of the current session and returns
+// its log archive or nil if there is none.
+func (r *missionDataRecorder) stopLogCapture() *bagMetadata {
+	r.sessionMutex.Lock()
+	stop := r.stopLogs
+	r.stopLogs = nil
+	r.sessionMutex.Unlock()
+	if stop == nil {
+		return nil
+	}
+	return stop()
+}
+
+// recorderStatus describes the state of the recorder.
+type recorderStatus struct {
+	// Session is the session being recorded or nil if the recorder isn't
+	// recording.
+	Session *sessionRecord    `json:"session,omitempty"`
+	Tags    map[string]string `json:"tags,omitempty"`
+}
+
+func (r *missionDataRecorder) Status() *recorderStatus {
+	r.sessionMutex.Lock()
+	defer r.sessionMutex.Unlock()
+	status := &recorderStatus{Tags: r.tags}
+	if r.session != nil {
+		session := *r.session
+		status.Session = &session
+	}
+	return status
+}
+
+// SetTags updates the tags of the current session and the following sessions.
+// Tags with empty values are removed.
+func (r *missionDataRecorder) SetTags(update map[string]string) error {
+	r.sessionMutex.Lock()
+	defer r.sessionMutex.Unlock()
+	tags, err := mergeTags(r.tags, update)
+	if err != nil {
+		return err
+	}
+	r.tags = tags
+	if r.sessionActive {
+		return r.saveSession(0)
+	}
+	return nil
+}
+
+// SetMissionID sets the ID of the mission of the current session and the
+// following sessions. It is used when the ID of a mission becomes known after
+// the mission has started.
+func (r *missionDataRecorder) SetMissionID(id string) error {
+	r.sessionMutex.Lock()
+	defer r.sessionMutex.Unlock()
+	r.MissionID = id
+	if r.session != nil {
+		r.session.MissionID = id
+		if err := r.History.SetMissionID(r.session.ID, id); err != nil {
+			r.Logger.Errorf("failed to update session history: %v", err)
+		}
+	}
+	if r.sessionActive {
+		return r.saveSession(0)
+	}
+	return nil
+}
+
+// +checklocks:r.sessionMutex
+func (r *missionDataRecorder) saveSession(splitCount int) error {
+	return saveSession(r.currentDir, &sessionInfo{
+		ID:         filepath.Base(r.currentDir),
+		MissionID:  r.MissionID,
+		Tags:       r.tags,
+		SplitCount: splitCount,
+	})
+}
+
+// markReady returns true if bag hasn't been passed to onBagReady yet and marks
+// it as passed.
+func (r *missionDataRecorder) markReady(bag *bagMetadata) bool {
+	r.readyMutex.Lock()
+	defer r.readyMutex.Unlock()
+	if r.readyBags == nil {
+		r.readyBags = make(map[string]bool)
+	}
+	if r.readyBags[bag.path] {
+		return false
+	}
+	r.readyBags[bag.path] = true
+	return true
+}
+
+func (r *missionDataRecorder) notifyBagReady(
+	ctx context.Context, onBagReady onBagReady, bag *bagMetadata,
+) {
+	if r.markReady(bag) {
+		r.pending.Add(1)
+		go func() {
+			defer r.pending.Done()
+			r.snapshots.Wait()
+			onBagReady(ctx, bag)
+		}()
+	}
+}
+
+// finalizeBags passes the bags of the current recording which haven't been
+// passed to onBagReady yet to it after ros bag record has exited. Returns after
+// onBagReady has returned for all bags of the recording.
+func (r *missionDataRecorder) finalizeBags(ctx context.Context, onBagReady onBagReady) {
+	defer r.pending.Wait()
+	logArchive := r.stopLogCapture()
+	if err := r.History.Ended(filepath.Base(r.currentDir), time.Now()); err != nil {
+		r.Logger.Errorf("failed to update session history: %v", err)
+	}
+	entries, err := os.ReadDir(r.currentDir)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			r.Logger.Errorf("failed to find the last bag: %v", err)
+		}
+		return
+	}
+	bags := make(map[string]*bagMetadata)
+	for _, e := range entries {
+		bag := newBagMetadata(filepath.Join(r.currentDir, e.Name()), 0, true)
+		if bag == nil || (bag.ext != "" && bag.ext != recorderCompressedBagExtension) {
+			continue
+		}
+		// If compression was interrupted, the uncompressed bag is used.
+		if prev := bags[bag.path]; prev == nil || len(bag.ext) < len(prev.ext) {
+			bags[bag.path] = bag
+		}
+	}
+	sorted := make([]*bagMetadata, 0, len(bags))
+	for _, bag := range bags {
+		sorted = append(sorted, bag)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].number < sorted[j].number })
+	// The session must be saved before the last bag is queued so that the
+	// bag is uploaded as the last one of the session.
+	r.sessionMutex.Lock()
+	r.sessionActive = false
+	r.session = nil
+	if len(sorted) > 0 {
+		if err := r.saveSession(sorted[len(sorted)-1].number + 1); err != nil {
+			r.Logger.Errorf("failed to save session: %v", err)
+		}
+	}
+	r.sessionMutex.Unlock()
+	r.snapshots.Wait()
+	if logArchive != nil {
+		sorted = append(sorted, logArchive)
+	}
+	for _, bag := range sorted {
+		if r.markReady(bag) {
+			onBagReady(ctx, bag)
+		}
 	}
 }
 
 type bagMetadata struct {
-	path   string
+	// Path of the bag as written by ros2 bag record. The extension of path is
+	// the extension of the storage format.
+	path string
+	// Extensions appended to path by processing, e.g. ".enc". The bag is
+	// stored on disk at path+ext.
+	ext    string
 	number int
 	isNew  bool
 	index  int
+	// If logArchive is true, the file is the log archive of a session instead
+	// of a bag.
+	logArchive bool
+	// If artifact is true, the file is an artifact which doesn't belong to a
+	// session.
+	artifact bool
+}
+
+func (b *bagMetadata) filePath() string {
+	return b.path + b.ext
+}
+
+func (b *bagMetadata) storageExt() string {
+	if b.logArchive {
+		return logArchiveExtension
+	}
+	return filepath.Ext(b.path)
 }
 
-var bagNumberRegex = regexp.MustCompile(`^(.*)_(\d+)\.db3$`)
+func (b *bagMetadata) isEncrypted() bool {
+	return strings.HasSuffix(b.ext, encryptedBagExtension)
+}
+
+var bagNumberRegex = regexp.MustCompile(
+	`^(.*)_(\d+)(` + storageExtensionsPattern() + `)(` + bagExtensionsPattern() + `)$`,
+)
 
 func newBagMetadata(path string, delta int, isNew bool) *bagMetadata {
 	dir := filepath.Dir(path)
@@ -193,9 +745,10 @@ func newBagMetadata(path string, delta int, isNew bool) *bagMetadata {
 		panic(err)
 	}
 	bagNumber += delta
-	base = fmt.Sprintf("%s_%d.db3", matches[1], bagNumber)
+	base = fmt.Sprintf("%s_%d%s", matches[1], bagNumber, matches[3])
 	return &bagMetadata{
 		path:   filepath.Join(dir, base),
+		ext:    matches[4],
 		number: bagNumber,
 		isNew:  isNew,
 	}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRecorderCompression(t *testing.T) {
+	dir := t.TempDir()
+	Convey("Scenario: bags compressed by ros bag record are detected", t, func() {
+		r := &missionDataRecorder{CompressionMode: recorderCompressionFile, Logger: fakeLogger{}}
+		ready := make(chan *bagMetadata, 1)
+		onBagReady := func(ctx context.Context, bag *bagMetadata) { ready <- bag }
+		r.notifyIfBagReady(context.Background(), onBagReady, filepath.Join(dir, "bag_1.db3"))
+		r.notifyIfBagReady(context.Background(), onBagReady, filepath.Join(dir, "bag_0.db3.zstd"))
+		r.notifyIfCompressedBagReady(context.Background(), onBagReady, filepath.Join(dir, "bag_0.db3"))
+		bag := <-ready
+		So(bag.path, ShouldEqual, filepath.Join(dir, "bag_0.db3"))
+		So(bag.ext, ShouldEqual, recorderCompressedBagExtension)
+		So(bag.number, ShouldEqual, 0)
+		So(ready, ShouldBeEmpty)
+	})
+	Convey("Scenario: the start time of a compressed bag can be read", t, func() {
+		bagPath := filepath.Join(dir, "bag_2.db3")
+		createTestBag(t, bagPath, 3e9, 2e9)
+		So(compressZstdFile(bagPath+recorderCompressedBagExtension, bagPath), ShouldBeNil)
+		So(os.Remove(bagPath), ShouldBeNil)
+		loaded := newBagMetadata(bagPath+recorderCompressedBagExtension, 0, false)
+		So(loaded.ext, ShouldEqual, recorderCompressedBagExtension)
+		before, err := os.ReadDir(dir)
+		So(err, ShouldBeNil)
+		start, err := getRecordStartTime(context.Background(), loaded.filePath())
+		So(err, ShouldBeNil)
+		So(start.Equal(time.Unix(2, 0)), ShouldBeTrue)
+		// The decompressed bag is never written to disk.
+		after, err := os.ReadDir(dir)
+		So(err, ShouldBeNil)
+		So(after, ShouldResemble, before)
+
+		emptyPath := filepath.Join(dir, "bag_3.db3")
+		createTestBag(t, emptyPath)
+		So(compressZstdFile(emptyPath+recorderCompressedBagExtension, emptyPath), ShouldBeNil)
+		_, err = getRecordStartTime(context.Background(), emptyPath+recorderCompressedBagExtension)
+		So(err, ShouldEqual, errEmptyBag)
+	})
+}
+
+func TestRecorderFinalizeBags(t *testing.T) {
+	Convey("Scenario: the remaining bags are notified when the recorder stops", t, func() {
+		dir := t.TempDir()
+		for _, name := range []string{
+			"bag_2.db3", "bag_0.db3", "bag_1.db3", "bag_1.db3.zstd", "bag_3.db3.zstd", "bag_4.db3.enc", "metadata.yaml",
+		} {
+			So(os.WriteFile(filepath.Join(dir, name), nil, 0600), ShouldBeNil)
+		}
+		r := &missionDataRecorder{Logger: fakeLogger{}, currentDir: dir}
+		So(r.markReady(newBagMetadata(filepath.Join(dir, "bag_0.db3"), 0, true)), ShouldBeTrue)
+		var ready []*bagMetadata
+		r.finalizeBags(context.Background(), func(ctx context.Context, bag *bagMetadata) {
+			ready = append(ready, bag)
+		})
+		So(ready, ShouldHaveLength, 3)
+		So(ready[0].filePath(), ShouldEqual, filepath.Join(dir, "bag_1.db3"))
+		So(ready[1].filePath(), ShouldEqual, filepath.Join(dir, "bag_2.db3"))
+		So(ready[2].filePath(), ShouldEqual, filepath.Join(dir, "bag_3.db3.zstd"))
+	})
+}
+
+func compressZstdFile(dst, src string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	w, err := zstd.NewWriter(out)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(w, in); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+func TestRecorderOptions(t *testing.T) {
+	Convey("Scenario: typed options are passed to ros bag record", t, func() {
+		r := &missionDataRecorder{
+			Options: recorderOptions{
+				PollingInterval: 50 * time.Millisecond,
+				NoDiscovery:     true,
+				TopicRegex:      "^/camera/",
+				ExcludeRegex:    "/debug",
+			},
+			currentDir: "out",
+		}
+		So(r.newCommand("").Args[1:], ShouldResemble, []string{
+			"bag", "record", "--output", "out",
+			"--polling-interval", "50", "--no-discovery",
+			"--regex", "^/camera/", "--exclude", "/debug",
+		})
+		r.Options = recorderOptions{}
+		So(r.newCommand("").Args, ShouldContain, "--all")
+	})
+	Convey("Scenario: extra arguments conflicting with managed flags are rejected", t, func() {
+		So(validateExtraArgs([]string{"--max-bag-duration", "60", "--storage-config-file", "c.yaml"}), ShouldBeNil)
+		So(validateExtraArgs([]string{"--output", "/tmp"}), ShouldBeError)
+		So(validateExtraArgs([]string{"--out=/tmp"}), ShouldBeError)
+		So(validateExtraArgs([]string{"-o/tmp"}), ShouldBeError)
+		So(validateExtraArgs([]string{"--", "/topic"}), ShouldBeError)
+	})
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// recorderOptions are the typed options of ros bag record which are not
+// managed by other settings.
+type recorderOptions struct {
+	// PollingInterval is the interval of polling for new topics. If zero, the
+	// default of ros bag record is used.
+	PollingInterval time.Duration `yaml:"polling_interval"`
+	// If IncludeHiddenTopics is true, hidden topics are recorded too.
+	IncludeHiddenTopics bool `yaml:"include_hidden_topics"`
+	// MaxCacheSize is the size of the message cache of ros bag record in
+	// bytes. If zero, the default of ros bag record is used.
+	MaxCacheSize int `yaml:"max_cache_size"`
+	// If NoDiscovery is true, only the topics which exist when the recording
+	// starts are recorded.
+	NoDiscovery bool `yaml:"no_discovery"`
+	// If TopicRegex is not empty, the topics matching it are recorded in
+	// addition to the listed topics. The regular expressions are passed to
+	// ros bag record as is and use its ECMAScript syntax, so they are not
+	// validated here.
+	TopicRegex string `yaml:"topic_regex"`
+	// Topics matching ExcludeRegex are not recorded. Can be used only if all
+	// topics are recorded or TopicRegex is set.
+	ExcludeRegex string `yaml:"exclude_regex"`
+}
+
+func (o *recorderOptions) validate(topics topicList) error {
+	if o.PollingInterval < 0 {
+		return errors.New("'polling_interval' must be non-negative")
+	}
+	if o.PollingInterval%time.Millisecond != 0 {
+		return errors.New("'polling_interval' must be a whole number of milliseconds")
+	}
+	if o.MaxCacheSize < 0 {
+		return errors.New("'max_cache_size' must be non-negative")
+	}
+	if o.ExcludeRegex != "" && !topics.All && o.TopicRegex == "" {
+		return errors.New("'exclude_regex' requires all topics to be recorded or 'topic_regex' to be set")
+	}
+	return nil
+}
+
+// args returns the arguments of ros bag record corresponding to o. The topic
+// selection options are not included.
+func (o *recorderOptions) args() (args []string) {
+	if o.PollingInterval > 0 {
+		args = append(args, "--polling-interval", strconv.FormatInt(o.PollingInterval.Milliseconds(), 10))
+	}
+	if o.IncludeHiddenTopics {
+		args = append(args, "--include-hidden-topics")
+	}
+	if o.MaxCacheSize > 0 {
+		args = append(args, "--max-cache-size", strconv.Itoa(o.MaxCacheSize))
+	}
+	if o.NoDiscovery {
+		args = append(args, "--no-discovery")
+	}
+	return args
+}
+
+// managedRecorderFlags are the flags of ros bag record which are set by the
+// recorder and must not be passed as extra arguments. The values are the
+// short forms of the flags.
+var managedRecorderFlags = map[string]string{
+	"--output":                     "-o",
+	"--max-bag-size":               "-b",
+	"--storage":                    "-s",
+	"--compression-mode":           "",
+	"--compression-format":         "",
+	"--qos-profile-overrides-path": "",
+	"--all":                        "-a",
+	"--regex":                      "-e",
+	"--exclude":                    "-x",
+	"--polling-interval":           "-p",
+	"--include-hidden-topics":      "",
+	"--max-cache-size":             "",
+	"--no-discovery":               "",
+}
+
+// validateExtraArgs returns an error if args contain flags managed by the
+// recorder. Long flags may be abbreviated, so all prefixes of the managed
+// flags are rejected.
+func validateExtraArgs(args []string) error {
+	for _, arg := range args {
+		if arg == "--" {
+			return errors.New("extra arguments must not contain '--'")
+		}
+		switch {
+		case strings.HasPrefix(arg, "--"):
+			name := strings.SplitN(arg, "=", 2)[0]
+			for flag := range managedRecorderFlags {
+				if strings.HasPrefix(flag, name) {
+					return fmt.Errorf("extra argument '%s' conflicts with '%s' managed by the recorder", arg, flag)
+				}
+			}
+		case strings.HasPrefix(arg, "-") && len(arg) >= 2:
+			for flag, short := range managedRecorderFlags {
+				if short != "" && strings.HasPrefix(arg, short) {
+					return fmt.Errorf("extra argument '%s' conflicts with '%s' managed by the recorder", arg, flag)
+				}
+			}
+		}
+	}
+	return nil
+}
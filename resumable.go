@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultUploadChunkSize is the size of the chunks of resumable uploads if
+// fileUploader.ChunkSize is not set.
+const defaultUploadChunkSize = 16 << 20
+
+// statusResumeIncomplete is returned by the upload URL for chunks which don't
+// complete the upload.
+const statusResumeIncomplete = 308
+
+// errUploadExpired is returned when the upload URL of a resumable upload is no
+// longer valid and the upload must be started again.
+var errUploadExpired = errors.New("upload URL has expired")
+
+// errNotResumable is returned when the upload URL completes an upload before
+// all chunks have been sent, which means that it ignores Content-Range.
+var errNotResumable = errors.New("upload URL doesn't support resumable uploads")
+
+// uploadProgress is the state of a resumable upload. It is stored next to the
+// manifest of the uploaded bag after every chunk so that an interrupted upload
+// can be continued when the bag is uploaded again, also after a restart.
+type uploadProgress struct {
+	URL    string `json:"url"`
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+	// Offset is the number of bytes acknowledged by the upload URL.
+	Offset int64 `json:"offset"`
+}
+
+func uploadProgressPath(bag *bagMetadata) string {
+	return bag.path + ".upload.json"
+}
+
+// loadUploadProgress returns the stored upload progress of bag or nil if it
+// doesn't exist.
+func loadUploadProgress(bag *bagMetadata) (*uploadProgress, error) {
+	data, err := os.ReadFile(uploadProgressPath(bag))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read upload progress: %w", err)
+	}
+	var progress uploadProgress
+	if err = json.Unmarshal(data, &progress); err != nil {
+		return nil, fmt.Errorf("failed to parse upload progress: %w", err)
+	}
+	return &progress, nil
+}
+
+func saveUploadProgress(bag *bagMetadata, progress *uploadProgress) error {
+	data, err := json.Marshal(progress)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(uploadProgressPath(bag), func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// uploadResumable uploads f, which is the file of bag sent as it is, in chunks.
+// If the bag has been partially uploaded before with the same name and
+// content, the upload is continued from the last acknowledged chunk. A new
+// upload URL is first asked for the received range. If it doesn't answer with
+// 308 Resume Incomplete, it doesn't support resumable uploads and the file is
+// sent in a single request.
+func (u *fileUploader) uploadResumable(
+	ctx context.Context, bag *bagMetadata, f *os.File, name string, manifest *bagManifest,
+) error {
+	progress, err := loadUploadProgress(bag)
+	if err != nil {
+		return err
+	}
+	if progress != nil && (progress.Name != name ||
+		progress.Size != manifest.Size || progress.SHA256 != manifest.SHA256) {
+		progress = nil
+	}
+	var done bool
+	if progress != nil {
+		progress.Offset, done, err = u.queryUploadOffset(ctx, progress)
+		if errors.Is(err, errUploadExpired) {
+			progress = nil
+		} else if err != nil {
+			return err
+		}
+	}
+	if progress == nil {
+		manifest.Resumable = true
+		uploadURL, err := u.requestUploadURL(ctx, name, u.BackendURL+"/generate-url", manifest)
+		if err != nil {
+			return err
+		}
+		progress = &uploadProgress{URL: uploadURL, Name: name, Size: manifest.Size, SHA256: manifest.SHA256}
+		if progress.Offset, done, err = u.queryUploadOffset(ctx, progress); err != nil {
+			return err
+		}
+		if done && progress.Size > 0 {
+			return u.uploadWhole(ctx, f, progress)
+		}
+	}
+	chunkSize := u.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = defaultUploadChunkSize
+	}
+	timer := &uploadTimer{}
+	start := time.Now()
+	for !done {
+		if err = saveUploadProgress(bag, progress); err != nil {
+			return err
+		}
+		n := progress.Size - progress.Offset
+		if n > chunkSize {
+			n = chunkSize
+		}
+		timer.r = io.NewSectionReader(f, progress.Offset, n)
+		offset := progress.Offset
+		if progress.Offset, done, err = u.uploadChunk(ctx, progress, timer, n); errors.Is(err, errNotResumable) {
+			// The upload is started again with a new URL.
+			if err := os.Remove(uploadProgressPath(bag)); err != nil {
+				return err
+			}
+			return err
+		} else if err != nil {
+			return err
+		}
+		if !done && progress.Offset <= offset {
+			return fmt.Errorf("failed to upload file: no bytes were received at offset %d", offset)
+		}
+	}
+	u.CompressionSelector.RecordUpload(timer.bytes, time.Since(start)-timer.readTime)
+	return nil
+}
+
+// uploadWhole uploads f to the upload URL of progress in a single request.
+func (u *fileUploader) uploadWhole(ctx context.Context, f *os.File, progress *uploadProgress) error {
+	timer := &uploadTimer{r: io.NewSectionReader(f, 0, progress.Size)}
+	start := time.Now()
+	if err := u.uploadFile(ctx, progress.URL, timer); err != nil {
+		return err
+	}
+	u.CompressionSelector.RecordUpload(timer.bytes, time.Since(start)-timer.readTime)
+	return nil
+}
+
+// uploadChunk sends n bytes read from chunk to the upload URL of progress
+// starting at progress.Offset. It returns the number of bytes acknowledged by
+// the upload URL and whether the upload is complete. The upload may be
+// complete only after its last chunk.
+func (u *fileUploader) uploadChunk(
+	ctx context.Context, progress *uploadProgress, chunk io.Reader, n int64,
+) (offset int64, done bool, err error) {
+	defer wrapErr("failed to upload file: %w", &err)
+	contentRange := fmt.Sprintf("bytes */%d", progress.Size)
+	if n > 0 {
+		contentRange = fmt.Sprintf("bytes %d-%d/%d", progress.Offset, progress.Offset+n-1, progress.Size)
+	}
+	offset, done, err = u.putRange(ctx, progress, chunk, n, contentRange)
+	if err == nil && done && progress.Offset+n != progress.Size {
+		return 0, false, errNotResumable
+	}
+	return offset, done, err
+}
+
+// queryUploadOffset returns the number of bytes of a resumable upload received
+// by its upload URL and whether the upload is complete.
+func (u *fileUploader) queryUploadOffset(
+	ctx context.Context, progress *uploadProgress,
+) (_ int64, done bool, err error) {
+	defer wrapErr("failed to query upload progress: %w", &err)
+	return u.putRange(ctx, progress, http.NoBody, 0, fmt.Sprintf("bytes */%d", progress.Size))
+}
+
+func (u *fileUploader) putRange(
+	ctx context.Context, progress *uploadProgress, body io.Reader, n int64, contentRange string,
+) (offset int64, done bool, err error) {
+	req, err := http.NewRequestWithContext(ctx, "PUT", progress.URL, body)
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.ContentLength = n
+	req.Header.Set("Content-Range", contentRange)
+	resp, err := u.HTTPClient.Do(req)
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+	msg, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to read response: %w", err)
+	}
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+		return progress.Size, true, nil
+	case statusResumeIncomplete:
+		offset, err := parseReceivedRange(resp.Header.Get("Range"))
+		return offset, false, err
+	case http.StatusNotFound, http.StatusGone:
+		return 0, false, errUploadExpired
+	default:
+		return 0, false, fmt.Errorf("HTTP error: code %d, %s", resp.StatusCode, msg)
+	}
+}
+
+// parseReceivedRange returns the number of bytes received according to the
+// Range header of an incomplete resumable upload. The header has the form
+// "bytes=0-<last byte>" and is missing if no bytes have been received.
+func parseReceivedRange(header string) (int64, error) {
+	if header == "" {
+		return 0, nil
+	}
+	last := strings.TrimPrefix(header, "bytes=0-")
+	n, err := strconv.ParseInt(last, 10, 64)
+	if last == header || err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid Range header: %q", header)
+	}
+	return n + 1, nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// resumableBackend implements the upload URL request and a resumable upload
+// URL. The upload fails after failAfter bytes have been received. If
+// ignoreRange is true, every request completes the upload like an upload URL
+// which doesn't support resumable uploads. If completeEarly is true, the first
+// chunk completes the upload.
+type resumableBackend struct {
+	mutex         sync.Mutex
+	received      []byte
+	size          int64
+	urls          int
+	failAfter     int
+	ignoreRange   bool
+	completeEarly bool
+}
+
+func (b *resumableBackend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	switch r.URL.Path {
+	case "/generate-url":
+		b.urls++
+		b.received = nil
+		fmt.Fprintf(w, `{"URL": "http://%s/upload"}`, r.Host)
+	case "/upload":
+		if b.ignoreRange {
+			b.received, _ = io.ReadAll(r.Body)
+			return
+		}
+		var start, end int64
+		if _, err := fmt.Sscanf(r.Header.Get("Content-Range"), "bytes */%d", &b.size); err != nil {
+			fmt.Sscanf(r.Header.Get("Content-Range"), "bytes %d-%d/%d", &start, &end, &b.size)
+			if start != int64(len(b.received)) || b.failAfter > 0 && len(b.received) >= b.failAfter {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			data, _ := io.ReadAll(r.Body)
+			b.received = append(b.received, data...)
+			if b.completeEarly {
+				return
+			}
+		}
+		if int64(len(b.received)) == b.size {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		if len(b.received) > 0 {
+			w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", len(b.received)-1))
+		}
+		w.WriteHeader(statusResumeIncomplete)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestResumableUpload(t *testing.T) {
+	Convey("Scenario: interrupted uploads of files sent as they are are resumed", t, func() {
+		dir := t.TempDir()
+		bag := &bagMetadata{path: filepath.Join(dir, "bag_0.db3"), ext: ".zst"}
+		data := bytes.Repeat([]byte("0123456789"), 5)
+		So(os.WriteFile(bag.filePath(), data, 0o600), ShouldBeNil)
+		So(saveBagManifest(bag, &bagManifest{RecordStartTime: time.Now()}), ShouldBeNil)
+		backend := &resumableBackend{failAfter: 20}
+		server := httptest.NewServer(backend)
+		defer server.Close()
+		u := &fileUploader{
+			HTTPClient:    server.Client(),
+			SigningMethod: jwt.SigningMethodHS256,
+			SigningKey:    []byte("key"),
+			TokenLifetime: time.Minute,
+			BackendURL:    server.URL,
+			ChunkSize:     8,
+		}
+		So(u.UploadBag(context.Background(), bag), ShouldBeError)
+		progress, err := loadUploadProgress(bag)
+		So(err, ShouldBeNil)
+		So(progress.Offset, ShouldEqual, 24)
+		So(progress.Size, ShouldEqual, len(data))
+
+		backend.failAfter = 0
+		So(u.UploadBag(context.Background(), bag), ShouldBeNil)
+		So(backend.urls, ShouldEqual, 1)
+		So(backend.received, ShouldResemble, data)
+
+		Convey("A new upload is started if the file has changed", func() {
+			data = append(data, "changed"...)
+			So(os.WriteFile(bag.filePath(), data, 0o600), ShouldBeNil)
+			So(u.UploadBag(context.Background(), bag), ShouldBeNil)
+			So(backend.urls, ShouldEqual, 2)
+			So(backend.received, ShouldResemble, data)
+		})
+		Convey("A completed upload is not sent again", func() {
+			So(u.UploadBag(context.Background(), bag), ShouldBeNil)
+			So(backend.urls, ShouldEqual, 1)
+		})
+	})
+	Convey("Scenario: upload URLs which don't support resumable uploads are detected", t, func() {
+		dir := t.TempDir()
+		bag := &bagMetadata{path: filepath.Join(dir, "bag_0.db3"), ext: ".zst"}
+		data := bytes.Repeat([]byte("0123456789"), 5)
+		So(os.WriteFile(bag.filePath(), data, 0o600), ShouldBeNil)
+		So(saveBagManifest(bag, &bagManifest{RecordStartTime: time.Now()}), ShouldBeNil)
+		backend := &resumableBackend{}
+		server := httptest.NewServer(backend)
+		defer server.Close()
+		u := &fileUploader{
+			HTTPClient:    server.Client(),
+			SigningMethod: jwt.SigningMethodHS256,
+			SigningKey:    []byte("key"),
+			TokenLifetime: time.Minute,
+			BackendURL:    server.URL,
+			ChunkSize:     8,
+		}
+		Convey("The file is sent in a single request if the handshake completes the upload", func() {
+			backend.ignoreRange = true
+			So(u.UploadBag(context.Background(), bag), ShouldBeNil)
+			So(backend.received, ShouldResemble, data)
+		})
+		Convey("The upload fails if a chunk other than the last one completes it", func() {
+			backend.completeEarly = true
+			So(errors.Is(u.UploadBag(context.Background(), bag), errNotResumable), ShouldBeTrue)
+			progress, err := loadUploadProgress(bag)
+			So(err, ShouldBeNil)
+			So(progress, ShouldBeNil)
+		})
+	})
+	Convey("Scenario: the received range of an incomplete upload is parsed", t, func() {
+		n, err := parseReceivedRange("")
+		So(err, ShouldBeNil)
+		So(n, ShouldEqual, 0)
+		n, err = parseReceivedRange("bytes=0-99")
+		So(err, ShouldBeNil)
+		So(n, ShouldEqual, 100)
+		_, err = parseReceivedRange("bytes=10-99")
+		So(err, ShouldBeError)
+	})
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// sessionFileName is the name of the file written to the directory of a
+// recording session when the recorder has stopped or, if the session belongs
+// to a mission, when the recording starts. The file is removed after the
+// backend has been notified that the session is complete.
+const sessionFileName = "session.json"
+
+// sessionInfo describes a recording session, i.e. the bags recorded by a
+// single run of ros bag record. The ID of a session is the name of its
+// directory.
+type sessionInfo struct {
+	ID        string `json:"sessionId"`
+	MissionID string `json:"missionId,omitempty"`
+	// Tags set by the operator. They are set on every bag of the session.
+	Tags map[string]string `json:"tags,omitempty"`
+	// SplitCount is the number of bags recorded in the session. It is zero
+	// until the session has ended. Empty bags are not uploaded, so the
+	// backend may receive fewer bags than this.
+	SplitCount int `json:"splitCount,omitempty"`
+}
+
+func (s *sessionInfo) ended() bool {
+	return s.SplitCount > 0
+}
+
+// bagSession identifies the position of a bag in its recording session.
+type bagSession struct {
+	ID         string `json:"id"`
+	MissionID  string `json:"missionId,omitempty"`
+	SplitIndex int    `json:"splitIndex"`
+	// Start is true for the first bag of a session whose upload is started.
+	// Empty bags are not uploaded, so it isn't necessarily the bag with split
+	// index 0.
+	Start bool `json:"start"`
+	// End is true for the bag with the largest split index left in the
+	// session directory after the recorder has stopped. It is a hint only:
+	// bags uploaded before the recorder stopped can't be marked, so a session
+	// may be uploaded without an end marker if its last bags were empty. The
+	// session-complete notification is the only reliable signal that all bags
+	// of a session have been uploaded.
+	End bool `json:"end"`
+	// Logs is true for the log archive of a session. Start, End and SplitIndex
+	// are not set for log archives.
+	Logs bool `json:"logs,omitempty"`
+	// ULog is true for PX4 ULog files associated with a session. Start, End
+	// and SplitIndex are not set for ULog files.
+	ULog bool `json:"ulog,omitempty"`
+}
+
+func sessionDir(bag *bagMetadata) string {
+	return filepath.Dir(bag.path)
+}
+
+func sessionFilePath(dir string) string {
+	return filepath.Join(dir, sessionFileName)
+}
+
+// loadSession returns the session stored in dir or nil if the session hasn't
+// ended.
+func loadSession(dir string) (*sessionInfo, error) {
+	data, err := os.ReadFile(sessionFilePath(dir))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read session: %w", err)
+	}
+	var session sessionInfo
+	if err = json.Unmarshal(data, &session); err != nil {
+		return nil, fmt.Errorf("failed to parse session: %w", err)
+	}
+	return &session, nil
+}
+
+func saveSession(dir string, session *sessionInfo) error {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(sessionFilePath(dir), func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// getBagSession returns the session information and the tags of bag, which is
+// about to be uploaded.
+func getBagSession(bag *bagMetadata) (*bagSession, map[string]string, error) {
+	dir := sessionDir(bag)
+	session, err := loadSession(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	bs := &bagSession{
+		ID:         filepath.Base(dir),
+		SplitIndex: bag.number,
+		Logs:       bag.logArchive,
+	}
+	if !bag.logArchive {
+		if bs.Start, err = claimSessionStart(bag); err != nil {
+			return nil, nil, err
+		}
+	}
+	if session != nil {
+		bs.MissionID = session.MissionID
+		if session.ended() && !bag.logArchive {
+			if bs.End, err = isLastBagLeft(bag); err != nil {
+				return nil, nil, err
+			}
+		}
+		return bs, session.Tags, nil
+	}
+	return bs, nil, nil
+}
+
+// sessionStartFileName is the name of the file in the directory of a session
+// containing the split index of the bag uploaded as the start of the session.
+const sessionStartFileName = "session_start"
+
+// claimSessionStart reports whether bag is the start of its session. The start
+// is claimed by the first bag whose upload is started, and the claim is kept if
+// the upload fails so that the bag is marked again when it is retried.
+func claimSessionStart(bag *bagMetadata) (_ bool, err error) {
+	defer wrapErr("failed to claim session start: %w", &err)
+	dir := sessionDir(bag)
+	path := filepath.Join(dir, sessionStartFileName)
+	index := strconv.Itoa(bag.number)
+	tmp, err := os.CreateTemp(dir, sessionStartFileName+".*")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.WriteString(index)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return false, err
+	}
+	// Linking fails if the start has already been claimed, which makes the
+	// claim atomic even if bags of the session are uploaded concurrently.
+	if err = os.Link(tmp.Name(), path); err == nil {
+		return true, nil
+	} else if !errors.Is(err, os.ErrExist) {
+		return false, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	return string(data) == index, nil
+}
+
+// isLastBagLeft reports whether bag has the largest split index of the bags
+// in its session directory.
+func isLastBagLeft(bag *bagMetadata) (bool, error) {
+	dir := sessionDir(bag)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return false, err
+	}
+	for _, e := range entries {
+		if e.IsDir() || !bagFileRegex.MatchString(e.Name()) {
+			continue
+		}
+		if other := newBagMetadata(filepath.Join(dir, e.Name()), 0, false); other != nil && other.number > bag.number {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// sessionHasBags reports whether dir contains bags or a log archive which
+// haven't been uploaded.
+func sessionHasBags(dir string) (bool, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return false, err
+	}
+	for _, e := range entries {
+		if !e.IsDir() && (bagFileRegex.MatchString(e.Name()) || logArchiveRegex.MatchString(e.Name())) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// sessionHistoryFileName is the name of the file in the destination directory
+// where the time ranges of recent sessions are stored. Session directories are
+// removed after they have been uploaded, so files written by other programs,
+// such as ULog files, are associated with sessions using the history.
+const sessionHistoryFileName = "session_history.json"
+
+// sessionHistoryLength is the number of sessions kept in the history.
+const sessionHistoryLength = 100
+
+type sessionRecord struct {
+	ID        string    `json:"sessionId"`
+	MissionID string    `json:"missionId,omitempty"`
+	Start     time.Time `json:"start"`
+	// End is nil while the session is being recorded.
+	End *time.Time `json:"end,omitempty"`
+}
+
+// sessionHistory records the time ranges of recent sessions. The methods of a
+// nil history do nothing.
+type sessionHistory struct {
+	path string
+
+	mutex sync.Mutex
+	// +checklocks:mutex
+	records []sessionRecord
+}
+
+func newSessionHistory(dir string) *sessionHistory {
+	return &sessionHistory{path: filepath.Join(dir, sessionHistoryFileName)}
+}
+
+// Load loads the stored history. Sessions which hadn't ended are ended at now,
+// because they were recorded by a previous run of the program.
+func (h *sessionHistory) Load(now time.Time) error {
+	if h == nil {
+		return nil
+	}
+	data, err := os.ReadFile(h.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to read session history: %w", err)
+	}
+	var records []sessionRecord
+	if err = json.Unmarshal(data, &records); err != nil {
+		return fmt.Errorf("failed to parse session history: %w", err)
+	}
+	for i := range records {
+		if records[i].End == nil {
+			records[i].End = &now
+		}
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.records = records
+	return nil
+}
+
+// Started adds a session which started at start to the history. Sessions
+// which haven't ended are ended at start.
+func (h *sessionHistory) Started(id, missionID string, start time.Time) error {
+	if h == nil {
+		return nil
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for i := range h.records {
+		if h.records[i].End == nil {
+			h.records[i].End = &start
+		}
+	}
+	h.records = append(h.records, sessionRecord{ID: id, MissionID: missionID, Start: start})
+	if len(h.records) > sessionHistoryLength {
+		h.records = h.records[len(h.records)-sessionHistoryLength:]
+	}
+	return h.save()
+}
+
+// Ended sets the end time of the session with the given ID if it is in the
+// history.
+func (h *sessionHistory) Ended(id string, end time.Time) error {
+	if h == nil {
+		return nil
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for i := range h.records {
+		if h.records[i].ID == id && h.records[i].End == nil {
+			h.records[i].End = &end
+			return h.save()
+		}
+	}
+	return nil
+}
+
+// SetMissionID sets the mission ID of the session with the given ID if it is
+// in the history.
+func (h *sessionHistory) SetMissionID(id, missionID string) error {
+	if h == nil {
+		return nil
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for i := range h.records {
+		if h.records[i].ID == id {
+			h.records[i].MissionID = missionID
+			return h.save()
+		}
+	}
+	return nil
+}
+
+// Find returns the session overlapping most with the time range from start to
+// end or nil if no session overlaps it. Sessions which haven't ended are
+// treated as if they ended at now.
+func (h *sessionHistory) Find(start, end, now time.Time) *sessionRecord {
+	if h == nil {
+		return nil
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	var best *sessionRecord
+	var bestOverlap time.Duration
+	for i := range h.records {
+		r := &h.records[i]
+		rEnd := now
+		if r.End != nil {
+			rEnd = *r.End
+		}
+		overlap := minTime(end, rEnd).Sub(maxTime(start, r.Start))
+		if overlap >= 0 && (best == nil || overlap > bestOverlap) {
+			record := *r
+			best, bestOverlap = &record, overlap
+		}
+	}
+	return best
+}
+
+// +checklocks:h.mutex
+func (h *sessionHistory) save() error {
+	data, err := json.Marshal(h.records)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(h.path, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+func minTime(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type sessionUploader struct {
+	mutex     sync.Mutex
+	uploaded  []string
+	sessions  []sessionInfo
+	snapshots []string
+}
+
+func (u *sessionUploader) WithCompression(compressionMode, int) uploaderInterface {
+	return u
+}
+
+func (u *sessionUploader) UploadBag(ctx context.Context, bag *bagMetadata) error {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	u.uploaded = append(u.uploaded, bag.path)
+	return nil
+}
+
+func (u *sessionUploader) CompleteSession(ctx context.Context, session *sessionInfo) error {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	u.sessions = append(u.sessions, *session)
+	return nil
+}
+
+func (u *sessionUploader) UploadSnapshot(ctx context.Context, dir string, session *sessionInfo) error {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if _, err := os.Stat(snapshotFilePath(dir)); err == nil {
+		u.snapshots = append(u.snapshots, session.ID)
+	}
+	return removeSnapshot(dir)
+}
+
+func TestSessions(t *testing.T) {
+	Convey("Scenario: the position of a bag in its session is known", t, func() {
+		dir := filepath.Join(t.TempDir(), "session")
+		So(os.Mkdir(dir, 0o700), ShouldBeNil)
+		// The first bag was empty and has been removed.
+		first := newBagMetadata(filepath.Join(dir, "bag_1.db3"), 0, true)
+		last := newBagMetadata(filepath.Join(dir, "bag_2.db3"), 0, true)
+		for _, bag := range []*bagMetadata{first, last} {
+			So(os.WriteFile(bag.filePath(), nil, 0o600), ShouldBeNil)
+		}
+
+		s, _, err := getBagSession(first)
+		So(err, ShouldBeNil)
+		So(*s, ShouldResemble, bagSession{ID: "session", SplitIndex: 1, Start: true})
+
+		So(saveSession(dir, &sessionInfo{ID: "session", MissionID: "m"}), ShouldBeNil)
+		s, _, err = getBagSession(last)
+		So(err, ShouldBeNil)
+		So(*s, ShouldResemble, bagSession{ID: "session", MissionID: "m", SplitIndex: 2})
+
+		// The last bag was empty and has been removed.
+		So(saveSession(dir, &sessionInfo{ID: "session", MissionID: "m", SplitCount: 4}), ShouldBeNil)
+		s, _, err = getBagSession(first)
+		So(err, ShouldBeNil)
+		So(*s, ShouldResemble, bagSession{ID: "session", MissionID: "m", SplitIndex: 1, Start: true})
+		s, _, err = getBagSession(last)
+		So(err, ShouldBeNil)
+		So(*s, ShouldResemble, bagSession{ID: "session", MissionID: "m", SplitIndex: 2, End: true})
+	})
+	Convey("Scenario: empty bags are removed before they are queued", t, func() {
+		dir := filepath.Join(t.TempDir(), "session")
+		So(os.Mkdir(dir, 0o700), ShouldBeNil)
+		empty := newBagMetadata(filepath.Join(dir, "bag_0.db3"), 0, true)
+		nonEmpty := newBagMetadata(filepath.Join(dir, "bag_1.db3"), 0, true)
+		createTestBag(t, empty.filePath())
+		createTestBag(t, nonEmpty.filePath(), 1_000_000_000)
+
+		uploader := &sessionUploader{}
+		m := newUploadManager(1, uploader, fakeLogger{}, nil)
+		m.AddBag(context.Background(), empty)
+		m.AddBag(context.Background(), nonEmpty)
+		m.Wait()
+
+		So(uploader.uploaded, ShouldResemble, []string{nonEmpty.path})
+		_, err := os.Stat(empty.filePath())
+		So(os.IsNotExist(err), ShouldBeTrue)
+	})
+	Convey("Scenario: the snapshot of a session whose bags were all empty is uploaded on its own", t, func() {
+		root := t.TempDir()
+		dir := filepath.Join(root, "session")
+		So(os.Mkdir(dir, 0o700), ShouldBeNil)
+		empty := newBagMetadata(filepath.Join(dir, "bag_0.db3"), 0, true)
+		createTestBag(t, empty.filePath())
+		So(os.WriteFile(snapshotFilePath(dir), []byte("{}"), 0o600), ShouldBeNil)
+		So(saveSession(dir, &sessionInfo{ID: "session", SplitCount: 1}), ShouldBeNil)
+
+		uploader := &sessionUploader{}
+		m := newUploadManager(1, uploader, fakeLogger{}, nil)
+		m.AddBag(context.Background(), empty)
+		m.Wait()
+
+		So(uploader.uploaded, ShouldBeEmpty)
+		So(uploader.snapshots, ShouldResemble, []string{"session"})
+		So(uploader.sessions, ShouldResemble, []sessionInfo{{ID: "session", SplitCount: 1}})
+		entries, err := os.ReadDir(root)
+		So(err, ShouldBeNil)
+		So(entries, ShouldBeEmpty)
+	})
+	Convey("Scenario: sessions are completed after all bags have been uploaded", t, func() {
+		root := t.TempDir()
+		for _, name := range []string{"a/bag_0.db3", "a/bag_1.db3", "b/bag_0.db3", "c/session.json", "d/session.json", "d/snapshot.json"} {
+			path := filepath.Join(root, name)
+			So(os.MkdirAll(filepath.Dir(path), 0o700), ShouldBeNil)
+			So(os.WriteFile(path, nil, 0o600), ShouldBeNil)
+		}
+		So(saveSession(filepath.Join(root, "a"), &sessionInfo{ID: "a", MissionID: "m"}), ShouldBeNil)
+		So(saveSession(filepath.Join(root, "b"), &sessionInfo{ID: "b", SplitCount: 3}), ShouldBeNil)
+		So(saveSession(filepath.Join(root, "d"), &sessionInfo{ID: "d", MissionID: "m"}), ShouldBeNil)
+		So(saveSession(filepath.Join(root, "c"), &sessionInfo{ID: "c", SplitCount: 1}), ShouldBeNil)
+
+		uploader := &sessionUploader{}
+		m := newUploadManager(2, uploader, fakeLogger{}, nil)
+		So(m.LoadExistingBags(context.Background(), root), ShouldBeNil)
+		m.StartAllWorkers(context.Background())
+		m.Wait()
+
+		So(uploader.uploaded, ShouldHaveLength, 3)
+		So(uploader.sessions, ShouldHaveLength, 3)
+		So(uploader.sessions, ShouldContain, sessionInfo{ID: "a", MissionID: "m", SplitCount: 2})
+		So(uploader.sessions, ShouldContain, sessionInfo{ID: "b", SplitCount: 3})
+		So(uploader.sessions, ShouldContain, sessionInfo{ID: "c", SplitCount: 1})
+		So(uploader.snapshots, ShouldBeEmpty)
+		entries, err := os.ReadDir(root)
+		So(err, ShouldBeNil)
+		So(entries, ShouldBeEmpty)
+	})
+	Convey("Scenario: log archives are uploaded with their sessions", t, func() {
+		root := t.TempDir()
+		dir := filepath.Join(root, "a")
+		for _, name := range []string{"bag_0.db3", logArchiveFileName} {
+			path := filepath.Join(dir, name)
+			So(os.MkdirAll(filepath.Dir(path), 0o700), ShouldBeNil)
+			So(os.WriteFile(path, nil, 0o600), ShouldBeNil)
+		}
+		logs := newLogArchiveMetadata(logArchivePath(dir), false)
+		s, _, err := getBagSession(logs)
+		So(err, ShouldBeNil)
+		So(*s, ShouldResemble, bagSession{ID: "a", Logs: true})
+
+		uploader := &sessionUploader{}
+		m := newUploadManager(2, uploader, fakeLogger{}, nil)
+		So(m.LoadExistingBags(context.Background(), root), ShouldBeNil)
+		m.StartAllWorkers(context.Background())
+		m.Wait()
+
+		So(uploader.uploaded, ShouldHaveLength, 2)
+		So(uploader.uploaded, ShouldContain, logs.path)
+		So(uploader.sessions, ShouldResemble, []sessionInfo{{ID: "a", SplitCount: 1}})
+		entries, err := os.ReadDir(root)
+		So(err, ShouldBeNil)
+		So(entries, ShouldBeEmpty)
+	})
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// drainPolicy determines which uploads are allowed to finish after a shutdown
+// signal.
+type drainPolicy string
+
+const (
+	// Queued bags are uploaded until the queue is empty.
+	drainAll drainPolicy = "all"
+	// Uploads in progress are finished, but no new uploads are started.
+	drainInFlight drainPolicy = "in-flight"
+	// Uploads are cancelled immediately.
+	drainNone drainPolicy = "none"
+)
+
+func (p drainPolicy) String() string {
+	return string(p)
+}
+
+func (p drainPolicy) Type() string {
+	return "drain policy"
+}
+
+func (p *drainPolicy) Set(val string) error {
+	policy, err := p.Parse(val)
+	if err != nil {
+		return err
+	}
+	*p = policy.(drainPolicy)
+	return nil
+}
+
+func (p drainPolicy) Parse(val interface{}) (interface{}, error) {
+	if val, ok := val.(string); ok {
+		switch val {
+		case "all":
+			return drainAll, nil
+		case "in-flight":
+			return drainInFlight, nil
+		case "none":
+			return drainNone, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid drain policy: %v", val)
+}
+
+type uploadQueueStopper interface {
+	StopQueue()
+}
+
+// shutdownHandler shuts the program down in two stages. On the first signal,
+// recording is stopped and uploads are drained according to Policy for at most
+// GracePeriod. On the second signal, uploads are cancelled and the recorder is
+// killed immediately. Bags which were not uploaded are left in the destination
+// directory and uploaded when the program is started again. Uploads of files
+// sent as they are continue from the last chunk received by the backend.
+type shutdownHandler struct {
+	Policy      drainPolicy
+	GracePeriod time.Duration
+
+	logger        logger
+	queue         uploadQueueStopper
+	stopRecording context.CancelFunc
+
+	uploadCtx     context.Context
+	cancelUploads context.CancelFunc
+	forceStop     chan struct{}
+	done          chan struct{}
+	closeOnce     sync.Once
+}
+
+func newShutdownHandler(
+	policy drainPolicy,
+	gracePeriod time.Duration,
+	logger logger,
+	queue uploadQueueStopper,
+	stopRecording context.CancelFunc,
+) *shutdownHandler {
+	h := &shutdownHandler{
+		Policy:        policy,
+		GracePeriod:   gracePeriod,
+		logger:        logger,
+		queue:         queue,
+		stopRecording: stopRecording,
+		forceStop:     make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+	h.uploadCtx, h.cancelUploads = context.WithCancel(context.Background())
+	return h
+}
+
+// UploadContext returns the context used for processing and uploading bags. It
+// is cancelled when draining ends.
+func (h *shutdownHandler) UploadContext() context.Context {
+	return h.uploadCtx
+}
+
+// ForceStop returns a channel which is closed when the recorder must be killed
+// without waiting for it to finish the last bag.
+func (h *shutdownHandler) ForceStop() <-chan struct{} {
+	return h.forceStop
+}
+
+// Close cancels the upload context and stops Run.
+func (h *shutdownHandler) Close() {
+	h.closeOnce.Do(func() {
+		h.cancelUploads()
+		close(h.done)
+	})
+}
+
+// Run waits for a signal from signals or for ctx to be cancelled and then
+// shuts the program down. Run returns when the shutdown is complete or Close is
+// called.
+func (h *shutdownHandler) Run(ctx context.Context, signals <-chan os.Signal) {
+	select {
+	case sig := <-signals:
+		h.logger.Infof(
+			"received %v, draining uploads for at most %v using policy '%s', send it again to exit immediately",
+			sig, h.GracePeriod, h.Policy,
+		)
+	case <-ctx.Done():
+	case <-h.done:
+		return
+	}
+	h.stopRecording()
+	var timeout <-chan time.Time
+	switch h.Policy {
+	case drainNone:
+		h.cancelUploads()
+	case drainInFlight:
+		h.queue.StopQueue()
+		fallthrough
+	default:
+		timer := time.NewTimer(h.GracePeriod)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case sig := <-signals:
+		h.logger.Errorf("received %v again, cancelling uploads", sig)
+	case <-timeout:
+		h.logger.Errorf("uploads didn't finish in %v, cancelling them", h.GracePeriod)
+	case <-h.done:
+		return
+	}
+	h.cancelUploads()
+	close(h.forceStop)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type fakeQueueStopper struct {
+	stopped bool
+}
+
+func (q *fakeQueueStopper) StopQueue() { q.stopped = true }
+
+func TestShutdownHandler(t *testing.T) {
+	Convey("Given a shutdown handler", t, func() {
+		var (
+			queue           fakeQueueStopper
+			signals         = make(chan os.Signal, 1)
+			recordCtx, stop = context.WithCancel(context.Background())
+			h               = newShutdownHandler(drainAll, time.Hour, fakeLogger{}, &queue, stop)
+			done            = make(chan struct{})
+		)
+		defer h.Close()
+		run := func() {
+			go func() {
+				defer close(done)
+				h.Run(recordCtx, signals)
+			}()
+		}
+
+		Convey("the first signal stops recording and the second one cancels uploads", func() {
+			run()
+			signals <- syscall.SIGTERM
+			<-recordCtx.Done()
+			So(h.UploadContext().Err(), ShouldBeNil)
+			So(queue.stopped, ShouldBeFalse)
+			signals <- syscall.SIGTERM
+			<-done
+			So(h.UploadContext().Err(), ShouldNotBeNil)
+			So(isClosed(h.ForceStop()), ShouldBeTrue)
+		})
+
+		Convey("uploads are cancelled when the grace period expires", func() {
+			h.Policy = drainInFlight
+			h.GracePeriod = time.Millisecond
+			run()
+			signals <- syscall.SIGINT
+			<-done
+			So(queue.stopped, ShouldBeTrue)
+			So(h.UploadContext().Err(), ShouldNotBeNil)
+		})
+
+		Convey("uploads are cancelled immediately if draining is disabled", func() {
+			h.Policy = drainNone
+			run()
+			signals <- syscall.SIGINT
+			<-h.UploadContext().Done()
+			So(recordCtx.Err(), ShouldNotBeNil)
+			So(isClosed(h.ForceStop()), ShouldBeFalse)
+			h.Close()
+			<-done
+		})
+
+		Convey("closing the handler stops it after uploads have been drained", func() {
+			run()
+			stop()
+			<-recordCtx.Done()
+			h.Close()
+			<-done
+			So(isClosed(h.ForceStop()), ShouldBeFalse)
+		})
+	})
+}
+
+func isClosed(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
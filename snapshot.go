@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	rcl_interfaces_msg "github.com/tiiuae/mission-data-recorder/msgs/rcl_interfaces/msg"
+	rcl_interfaces_srv "github.com/tiiuae/mission-data-recorder/msgs/rcl_interfaces/srv"
+	"github.com/tiiuae/rclgo/pkg/rclgo"
+)
+
+// snapshotFileName is the name of the file written to the directory of a
+// recording session when the session starts. It is uploaded with the first
+// bag of the session whose upload is started, or on its own when the session is
+// completed if all bags of the session were empty or the upload with the first
+// bag failed.
+const snapshotFileName = "snapshot.json"
+
+// endpointLookupWorkers is the number of topics whose endpoints are looked up
+// concurrently. Each lookup runs the ros2 command line interface, whose
+// startup takes most of the time.
+const endpointLookupWorkers = 4
+
+// parameterRequestTimeout is the time a node is given to respond to a
+// parameter request. Requests to nodes which don't exist are never answered.
+const parameterRequestTimeout = 5 * time.Second
+
+// sessionSnapshot describes the system at the start of a recording session.
+type sessionSnapshot struct {
+	CapturedAt      time.Time        `json:"capturedAt"`
+	DeviceID        string           `json:"deviceId"`
+	RecorderVersion string           `json:"recorderVersion,omitempty"`
+	Config          *updatableConfig `json:"config,omitempty"`
+	Nodes           []string         `json:"nodes,omitempty"`
+	// Topics maps the topics in the ROS graph to their types.
+	Topics map[string][]string `json:"topics,omitempty"`
+	// TopicEndpoints maps the topics in the ROS graph to their publishers and
+	// subscriptions including their QoS profiles.
+	TopicEndpoints map[string][]topicEndpoint `json:"topicEndpoints,omitempty"`
+	// Parameters maps node names to the values of their parameters.
+	Parameters map[string]map[string]interface{} `json:"parameters,omitempty"`
+	// Packages maps the installed ROS packages to their versions.
+	Packages map[string]string `json:"packages,omitempty"`
+	// Errors describes the parts of the snapshot which couldn't be captured.
+	Errors []string `json:"errors,omitempty"`
+}
+
+func (s *sessionSnapshot) addError(format string, a ...interface{}) {
+	s.Errors = append(s.Errors, fmt.Sprintf(format, a...))
+}
+
+func snapshotFilePath(dir string) string {
+	return filepath.Join(dir, snapshotFileName)
+}
+
+// snapshotter captures session snapshots. Each part of a snapshot is captured
+// independently, so that a failure doesn't prevent capturing the others.
+type snapshotter struct {
+	DeviceID string
+	// If empty defaults to "ros2".
+	ROSCommand string
+	// Nodes whose parameters are captured.
+	Nodes []string
+	// Timeout of capturing a snapshot.
+	Timeout time.Duration
+
+	node   *rclgo.Node
+	logger logger
+}
+
+func newSnapshotter(node *rclgo.Node, logger logger, deviceID string, nodes []string) *snapshotter {
+	return &snapshotter{
+		DeviceID: deviceID,
+		Nodes:    nodes,
+		Timeout:  30 * time.Second,
+		node:     node,
+		logger:   logger,
+	}
+}
+
+// Capture writes a snapshot of the system and config to dir.
+func (s *snapshotter) Capture(ctx context.Context, dir string, config *updatableConfig) error {
+	ctx, cancel := context.WithTimeout(ctx, s.Timeout)
+	defer cancel()
+	snapshot := &sessionSnapshot{
+		CapturedAt: time.Now().UTC(),
+		DeviceID:   s.DeviceID,
+		Config:     config,
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		snapshot.RecorderVersion = info.Main.Version
+	}
+	var err error
+	if snapshot.Topics, err = s.node.GetTopicNamesAndTypes(); err != nil {
+		snapshot.addError("failed to get topics: %v", err)
+	}
+	s.captureEndpoints(ctx, snapshot)
+	if snapshot.Nodes, err = s.nodeNames(ctx); err != nil {
+		snapshot.addError("failed to get nodes: %v", err)
+	}
+	s.captureParameters(ctx, snapshot)
+	if snapshot.Packages, err = installedPackages(ctx); err != nil {
+		snapshot.addError("failed to get packages: %v", err)
+	}
+	for _, e := range snapshot.Errors {
+		s.logger.Errorf("session snapshot: %s", e)
+	}
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return fmt.Errorf("failed to encode snapshot: %w", err)
+	}
+	return writeFileAtomic(snapshotFilePath(dir), func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// nodeNames returns the nodes in the ROS graph. rclgo doesn't support listing
+// nodes, so the ros2 command line interface is used.
+func (s *snapshotter) nodeNames(ctx context.Context) ([]string, error) {
+	rosCmd := s.ROSCommand
+	if rosCmd == "" {
+		rosCmd = "ros2"
+	}
+	//#nosec G204 -- The command needs to be configurable.
+	out, err := exec.CommandContext(ctx, rosCmd, "node", "list").Output()
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(string(out)), nil
+}
+
+// captureEndpoints gets the endpoints of the topics in snapshot.Topics using
+// "ros2 topic info --verbose". Up to endpointLookupWorkers topics are looked
+// up at a time.
+func (s *snapshotter) captureEndpoints(ctx context.Context, snapshot *sessionSnapshot) {
+	if len(snapshot.Topics) == 0 {
+		return
+	}
+	type lookup struct {
+		topic string
+		info  *topicInfo
+		err   error
+	}
+	topics := make(chan string)
+	results := make(chan lookup)
+	var wg sync.WaitGroup
+	for i := 0; i < endpointLookupWorkers && i < len(snapshot.Topics); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for topic := range topics {
+				info, err := getTopicInfo(ctx, s.ROSCommand, topic, true)
+				results <- lookup{topic: topic, info: info, err: err}
+			}
+		}()
+	}
+	go func() {
+		defer close(topics)
+		for topic := range snapshot.Topics {
+			select {
+			case topics <- topic:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+	snapshot.TopicEndpoints = make(map[string][]topicEndpoint, len(snapshot.Topics))
+	for r := range results {
+		switch {
+		case r.err == nil:
+			snapshot.TopicEndpoints[r.topic] = r.info.Endpoints
+		case ctx.Err() == nil:
+			snapshot.addError("failed to get endpoints: %v", r.err)
+		}
+	}
+	if ctx.Err() != nil {
+		snapshot.addError("failed to get endpoints of topics: %v", ctx.Err())
+	}
+}
+
+// captureParameters gets the parameters of s.Nodes using their parameter
+// services.
+func (s *snapshotter) captureParameters(ctx context.Context, snapshot *sessionSnapshot) {
+	if len(s.Nodes) == 0 {
+		return
+	}
+	ws, err := s.node.Context().NewWaitSet()
+	if err != nil {
+		snapshot.addError("failed to get parameters: %v", err)
+		return
+	}
+	defer ws.Close()
+	clients := make(map[string]*parameterClients, len(s.Nodes))
+	defer func() {
+		for _, c := range clients {
+			c.Close()
+		}
+	}()
+	for _, name := range s.Nodes {
+		c, err := newParameterClients(s.node, name)
+		if err != nil {
+			snapshot.addError("failed to get parameters of %s: %v", name, err)
+			continue
+		}
+		clients[name] = c
+		ws.AddClients(c.list.Client, c.get.Client)
+	}
+	// The responses are received only while the wait set is running.
+	wsCtx, stopWaitSet := context.WithCancel(ctx)
+	wsDone := make(chan struct{})
+	go func() {
+		defer close(wsDone)
+		if err := ws.Run(wsCtx); err != nil && !errors.Is(err, context.Canceled) {
+			s.logger.Errorf("failed to receive parameters: %v", err)
+		}
+	}()
+	defer func() {
+		stopWaitSet()
+		<-wsDone
+	}()
+	snapshot.Parameters = make(map[string]map[string]interface{}, len(clients))
+	for _, name := range s.Nodes {
+		c := clients[name]
+		if c == nil {
+			continue
+		}
+		reqCtx, cancel := context.WithTimeout(ctx, parameterRequestTimeout)
+		params, err := c.Get(reqCtx)
+		cancel()
+		if err != nil {
+			snapshot.addError("failed to get parameters of %s: %v", name, err)
+			continue
+		}
+		snapshot.Parameters[name] = params
+	}
+}
+
+// parameterClients calls the parameter services of a node.
+type parameterClients struct {
+	list *rcl_interfaces_srv.ListParametersClient
+	get  *rcl_interfaces_srv.GetParametersClient
+}
+
+func newParameterClients(node *rclgo.Node, nodeName string) (c *parameterClients, err error) {
+	c = &parameterClients{}
+	c.list, err = rcl_interfaces_srv.NewListParametersClient(node, nodeName+"/list_parameters", nil)
+	if err != nil {
+		return nil, err
+	}
+	c.get, err = rcl_interfaces_srv.NewGetParametersClient(node, nodeName+"/get_parameters", nil)
+	if err != nil {
+		c.list.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *parameterClients) Close() {
+	c.list.Close()
+	c.get.Close()
+}
+
+// Get returns the values of all parameters of the node.
+func (c *parameterClients) Get(ctx context.Context) (map[string]interface{}, error) {
+	listReq := rcl_interfaces_srv.NewListParameters_Request()
+	listResp, _, err := c.list.Send(ctx, listReq)
+	if err != nil {
+		return nil, err
+	}
+	getReq := rcl_interfaces_srv.NewGetParameters_Request()
+	getReq.Names = listResp.Result.Names
+	getResp, _, err := c.get.Send(ctx, getReq)
+	if err != nil {
+		return nil, err
+	}
+	if len(getResp.Values) != len(getReq.Names) {
+		return nil, fmt.Errorf("got %d values for %d parameters", len(getResp.Values), len(getReq.Names))
+	}
+	params := make(map[string]interface{}, len(getReq.Names))
+	for i, name := range getReq.Names {
+		params[name] = parameterValue(&getResp.Values[i])
+	}
+	return params, nil
+}
+
+// parameterValue returns the value of v as a Go value. Unset parameters are
+// returned as nil.
+func parameterValue(v *rcl_interfaces_msg.ParameterValue) interface{} {
+	switch v.Type {
+	case rcl_interfaces_msg.ParameterType_PARAMETER_BOOL:
+		return v.BoolValue
+	case rcl_interfaces_msg.ParameterType_PARAMETER_INTEGER:
+		return v.IntegerValue
+	case rcl_interfaces_msg.ParameterType_PARAMETER_DOUBLE:
+		return v.DoubleValue
+	case rcl_interfaces_msg.ParameterType_PARAMETER_STRING:
+		return v.StringValue
+	case rcl_interfaces_msg.ParameterType_PARAMETER_BYTE_ARRAY:
+		return v.ByteArrayValue
+	case rcl_interfaces_msg.ParameterType_PARAMETER_BOOL_ARRAY:
+		return v.BoolArrayValue
+	case rcl_interfaces_msg.ParameterType_PARAMETER_INTEGER_ARRAY:
+		return v.IntegerArrayValue
+	case rcl_interfaces_msg.ParameterType_PARAMETER_DOUBLE_ARRAY:
+		return v.DoubleArrayValue
+	case rcl_interfaces_msg.ParameterType_PARAMETER_STRING_ARRAY:
+		return v.StringArrayValue
+	}
+	return nil
+}
+
+// installedPackages returns the versions of the installed ROS packages. Only
+// Debian based systems are supported.
+func installedPackages(ctx context.Context) (map[string]string, error) {
+	out, err := exec.CommandContext(ctx, "dpkg-query", "-W", "-f", "${Package}\t${Version}\n", "ros-*").Output()
+	if err != nil {
+		return nil, err
+	}
+	return parsePackageList(string(out)), nil
+}
+
+// parsePackageList parses lines of tab-separated package names and versions.
+// Packages without a version are not installed and are skipped.
+func parsePackageList(s string) map[string]string {
+	packages := make(map[string]string)
+	scanner := bufio.NewScanner(strings.NewReader(s))
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), "\t", 2)
+		if len(fields) == 2 && fields[1] != "" {
+			packages[fields[0]] = fields[1]
+		}
+	}
+	return packages
+}
+
+// removeSnapshot removes the snapshot of the session in dir if it exists.
+func removeSnapshot(dir string) error {
+	if err := os.Remove(snapshotFilePath(dir)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
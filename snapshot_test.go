@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	rcl_interfaces_msg "github.com/tiiuae/mission-data-recorder/msgs/rcl_interfaces/msg"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestSnapshot(t *testing.T) {
+	Convey("Installed packages are parsed from the output of dpkg-query", t, func() {
+		So(parsePackageList("ros-humble-rclcpp\t16.0.5-1jammy\nros-humble-removed\t\n\n"), ShouldResemble, map[string]string{
+			"ros-humble-rclcpp": "16.0.5-1jammy",
+		})
+	})
+	Convey("Parameter values are converted to Go values", t, func() {
+		So(parameterValue(&rcl_interfaces_msg.ParameterValue{}), ShouldBeNil)
+		So(parameterValue(&rcl_interfaces_msg.ParameterValue{
+			Type:         rcl_interfaces_msg.ParameterType_PARAMETER_INTEGER,
+			IntegerValue: 3,
+		}), ShouldEqual, 3)
+		So(parameterValue(&rcl_interfaces_msg.ParameterValue{
+			Type:             rcl_interfaces_msg.ParameterType_PARAMETER_STRING_ARRAY,
+			StringArrayValue: []string{"a", "b"},
+		}), ShouldResemble, []string{"a", "b"})
+	})
+	Convey("Scenario: the endpoints of topics are looked up concurrently", t, func() {
+		script := filepath.Join(t.TempDir(), "ros2")
+		So(os.WriteFile(script, []byte("#!/bin/sh\nsleep 0.3\nprintf 'Type: t\\n\\nPublisher count: 1\\n\\nNode name: %s\\nEndpoint type: PUBLISHER\\n\\nSubscription count: 0\\n' \"$3\"\n"), 0o700), ShouldBeNil)
+		s := &snapshotter{ROSCommand: script}
+		snapshot := &sessionSnapshot{Topics: make(map[string][]string)}
+		for i := 0; i < 2*endpointLookupWorkers; i++ {
+			snapshot.Topics[fmt.Sprintf("/t%d", i)] = []string{"t"}
+		}
+		// Looking up the topics one at a time would take too long.
+		ctx, cancel := context.WithTimeout(context.Background(), 1500*time.Millisecond)
+		defer cancel()
+		s.captureEndpoints(ctx, snapshot)
+		So(snapshot.Errors, ShouldBeEmpty)
+		So(snapshot.TopicEndpoints, ShouldHaveLength, len(snapshot.Topics))
+		So(snapshot.TopicEndpoints["/t3"], ShouldResemble, []topicEndpoint{{NodeName: "/t3", EndpointType: "PUBLISHER"}})
+	})
+}
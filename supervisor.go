@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errRecorderStalled = errors.New("recorder stalled")
+
+const (
+	// maxRecorderErrorLines is the number of the latest error lines of ros bag
+	// record kept for diagnostics.
+	maxRecorderErrorLines = 5
+
+	// clockTicksPerSecond is the unit of the CPU times in /proc/<pid>/stat.
+	// It is 100 on all architectures supported by Linux.
+	clockTicksPerSecond = 100
+)
+
+// rosLogRegex matches a line logged by ROS 2 and captures the severity and the
+// message.
+var rosLogRegex = regexp.MustCompile(`^\[(DEBUG|INFO|WARN|ERROR|FATAL)\] \[[^\]]*\] (.*)$`)
+
+// recorderSupervisor monitors a running ros bag record process. The output of
+// the process is logged and the latest error lines are kept. The process is
+// considered stalled if the size of the recording directory doesn't grow for
+// StallTimeout while messages are published on the recorded topics. A
+// shrinking directory doesn't count as growth.
+type recorderSupervisor struct {
+	// Dir is the recording directory of the process.
+	Dir string
+	// If zero, stalls are not detected.
+	StallTimeout  time.Duration
+	CheckInterval time.Duration
+	// RecordedMessages returns the number of messages published so far on
+	// the expected topics which are recorded. If nil, messages are assumed to
+	// be published all the time.
+	RecordedMessages func() int64
+
+	logger      logger
+	diagnostics *diagnosticsMonitor
+
+	mu sync.Mutex
+	// +checklocks:mu
+	errorLines []string
+}
+
+func newRecorderSupervisor(
+	dir string, stallTimeout time.Duration, logger logger, diagnostics *diagnosticsMonitor,
+) *recorderSupervisor {
+	return &recorderSupervisor{
+		Dir:           dir,
+		StallTimeout:  stallTimeout,
+		CheckInterval: 5 * time.Second,
+		logger:        logger,
+		diagnostics:   diagnostics,
+	}
+}
+
+// CaptureOutput logs the lines read from r until it returns an error.
+func (s *recorderSupervisor) CaptureOutput(r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		s.logLine(scanner.Text())
+	}
+	if err := scanner.Err(); err != nil && !errors.Is(err, os.ErrClosed) {
+		s.logger.Errorf("failed to read recorder output: %v", err)
+	}
+}
+
+func (s *recorderSupervisor) logLine(line string) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return
+	}
+	severity, msg := "ERROR", line
+	if m := rosLogRegex.FindStringSubmatch(line); m != nil {
+		severity, msg = m[1], m[2]
+	}
+	switch severity {
+	case "DEBUG", "INFO":
+		s.logger.Infof("ros bag record: %s", msg)
+	case "WARN":
+		s.logger.Warnf("ros bag record: %s", msg)
+	default:
+		// Lines without a severity are usually tracebacks or errors printed
+		// by the command line interface.
+		s.logger.Errorf("ros bag record: %s", msg)
+		s.mu.Lock()
+		s.errorLines = append(s.errorLines, msg)
+		if len(s.errorLines) > maxRecorderErrorLines {
+			s.errorLines = s.errorLines[len(s.errorLines)-maxRecorderErrorLines:]
+		}
+		s.mu.Unlock()
+	}
+}
+
+// ErrorLines returns the latest error lines logged by the process.
+func (s *recorderSupervisor) ErrorLines() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.errorLines...)
+}
+
+// Monitor checks the process with the given pid until ctx is cancelled or the
+// process stalls, in which case an error wrapping errRecorderStalled is
+// returned.
+func (s *recorderSupervisor) Monitor(ctx context.Context, pid int) error {
+	ticker := time.NewTicker(s.CheckInterval)
+	defer ticker.Stop()
+	var (
+		lastSize      int64
+		lastCPU, _    = processCPUTime(pid)
+		lastCheck     = time.Now()
+		lastGrowth    = lastCheck
+		cpuPercentage float64
+		// Number of recorded messages when the recording last grew.
+		grownMessages = s.recordedMessages()
+	)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		now := time.Now()
+		elapsed := now.Sub(lastCheck)
+		size, err := dirSize(s.Dir)
+		if err != nil {
+			s.logger.Errorf("failed to check recording size: %v", err)
+			size = lastSize
+		}
+		var writeRate float64
+		switch {
+		case size > lastSize:
+			writeRate = float64(size-lastSize) / elapsed.Seconds()
+			lastSize = size
+			lastGrowth = now
+			grownMessages = s.recordedMessages()
+		case size < lastSize:
+			// Uploaded bags are removed and compressed bags replace the
+			// uncompressed ones, which isn't progress of the recording.
+			// Growth is measured from the new size.
+			lastSize = size
+		}
+		if cpu, err := processCPUTime(pid); err == nil {
+			cpuPercentage = 100 * (cpu - lastCPU).Seconds() / elapsed.Seconds()
+			lastCPU = cpu
+		}
+		lastCheck = now
+		s.diagnostics.ReportSuccess(
+			"recorder health", fmt.Sprintf("writing %.0f B/s, CPU %.1f%%", writeRate, cpuPercentage),
+		)
+		if s.StallTimeout <= 0 || now.Sub(lastGrowth) < s.StallTimeout {
+			continue
+		}
+		// Nothing is written if nothing has been published.
+		if s.RecordedMessages != nil && s.recordedMessages() == grownMessages {
+			lastGrowth = now
+			continue
+		}
+		err = fmt.Errorf(
+			"%w: nothing written for %v, CPU usage %.1f%%",
+			errRecorderStalled, now.Sub(lastGrowth).Round(time.Second), cpuPercentage,
+		)
+		s.diagnostics.ReportError("recorder health", err)
+		return err
+	}
+}
+
+func (s *recorderSupervisor) recordedMessages() int64 {
+	if s.RecordedMessages == nil {
+		return 0
+	}
+	return s.RecordedMessages()
+}
+
+// errorLinesSuffix formats the error lines of ros bag record to be appended to
+// an error message.
+func errorLinesSuffix(lines []string) string {
+	if len(lines) == 0 {
+		return ""
+	}
+	return ", latest errors: " + strings.Join(lines, " | ")
+}
+
+// dirSize returns the total size of the files in dir. If dir doesn't exist,
+// zero is returned.
+func dirSize(dir string) (size int64, err error) {
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			info, err := d.Info()
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+// processCPUTime returns the CPU time used by the process with the given pid.
+// Only Linux is supported.
+func processCPUTime(pid int) (time.Duration, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, err
+	}
+	// The second field is the command in parentheses, which may contain
+	// spaces. utime and stime are the 14th and 15th fields.
+	i := strings.LastIndexByte(string(data), ')')
+	if i < 0 {
+		return 0, errors.New("invalid process stat")
+	}
+	fields := strings.Fields(string(data[i+1:]))
+	const utimeIndex = 14 - 3
+	if len(fields) <= utimeIndex+1 {
+		return 0, errors.New("invalid process stat")
+	}
+	var ticks int64
+	for _, f := range fields[utimeIndex : utimeIndex+2] {
+		n, err := strconv.ParseInt(f, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid process stat: %w", err)
+		}
+		ticks += n
+	}
+	return time.Duration(ticks) * time.Second / clockTicksPerSecond, nil
+}
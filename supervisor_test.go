@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRecorderSupervisor(t *testing.T) {
+	Convey("Scenario: the latest error lines of the recorder are kept", t, func() {
+		s := newRecorderSupervisor(t.TempDir(), 0, fakeLogger{}, nil)
+		var output strings.Builder
+		output.WriteString("[INFO] [1646000000.000000000] [rosbag2_recorder]: Listening for topics...\n")
+		output.WriteString("[WARN] [1646000000.000000000] [rosbag2_recorder]: Hidden topics are not recorded\n")
+		for i := 0; i < maxRecorderErrorLines+2; i++ {
+			output.WriteString("[ERROR] [1646000000.000000000] [rosbag2_storage]: error " + string(rune('a'+i)) + "\n")
+		}
+		output.WriteString("Traceback (most recent call last):\n")
+		s.CaptureOutput(strings.NewReader(output.String()))
+		So(s.ErrorLines(), ShouldResemble, []string{
+			"[rosbag2_storage]: error d",
+			"[rosbag2_storage]: error e",
+			"[rosbag2_storage]: error f",
+			"[rosbag2_storage]: error g",
+			"Traceback (most recent call last):",
+		})
+		So(errorLinesSuffix(nil), ShouldBeEmpty)
+		So(errorLinesSuffix([]string{"a", "b"}), ShouldEqual, ", latest errors: a | b")
+	})
+	Convey("Scenario: a recorder which doesn't write anything is stalled", t, func() {
+		dir := t.TempDir()
+		s := newRecorderSupervisor(dir, 50*time.Millisecond, fakeLogger{}, nil)
+		s.CheckInterval = 10 * time.Millisecond
+		var messages int64
+		s.RecordedMessages = func() int64 { return messages }
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		So(s.Monitor(ctx, os.Getpid()), ShouldBeNil)
+
+		// Messages keep being published.
+		s.RecordedMessages = func() int64 {
+			messages++
+			return messages
+		}
+		So(os.WriteFile(filepath.Join(dir, "bag_0.db3"), []byte("data"), 0o600), ShouldBeNil)
+		err := s.Monitor(context.Background(), os.Getpid())
+		So(errors.Is(err, errRecorderStalled), ShouldBeTrue)
+	})
+	Convey("Scenario: a shrinking recording directory doesn't count as growth", t, func() {
+		dir := t.TempDir()
+		path := filepath.Join(dir, "bag_0.db3")
+		So(os.WriteFile(path, make([]byte, 1000), 0o600), ShouldBeNil)
+		s := newRecorderSupervisor(dir, 50*time.Millisecond, fakeLogger{}, nil)
+		s.CheckInterval = 10 * time.Millisecond
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			ticker := time.NewTicker(5 * time.Millisecond)
+			defer ticker.Stop()
+			for size := int64(999); size > 0; size-- {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				}
+				if err := os.Truncate(path, size); err != nil {
+					return
+				}
+			}
+		}()
+		err := s.Monitor(ctx, os.Getpid())
+		cancel()
+		<-done
+		So(errors.Is(err, errRecorderStalled), ShouldBeTrue)
+	})
+	Convey("Scenario: resource usage is measured", t, func() {
+		dir := t.TempDir()
+		So(os.WriteFile(filepath.Join(dir, "a"), make([]byte, 10), 0o600), ShouldBeNil)
+		So(os.Mkdir(filepath.Join(dir, "b"), 0o700), ShouldBeNil)
+		So(os.WriteFile(filepath.Join(dir, "b", "c"), make([]byte, 5), 0o600), ShouldBeNil)
+		size, err := dirSize(dir)
+		So(err, ShouldBeNil)
+		So(size, ShouldEqual, 15)
+		size, err = dirSize(filepath.Join(dir, "missing"))
+		So(err, ShouldBeNil)
+		So(size, ShouldEqual, 0)
+
+		_, err = processCPUTime(os.Getpid())
+		So(err, ShouldBeNil)
+	})
+	Convey("Scenario: the messages of the recorded expected topics are counted", t, func() {
+		sel := topicSelection{Topics: []string{"/a", "/b/_hidden"}, Regex: "/c.*"}
+		recorded := sel.matcher()
+		So(recorded("/a"), ShouldBeTrue)
+		So(recorded("/b/_hidden"), ShouldBeTrue)
+		So(recorded("/c/d"), ShouldBeTrue)
+		So(recorded("/c/_d"), ShouldBeFalse)
+		So(recorded("/d/c"), ShouldBeFalse)
+		all := (&topicSelection{All: true}).matcher()
+		So(all("/d"), ShouldBeTrue)
+
+		m := newTopicMonitor(nil, fakeLogger{}, nil, nil)
+		m.start(map[string]topicExpectation{"/a": {}, "/e": {}}, recorded, time.Now())
+		m.messageReceived("/a", time.Now())
+		m.messageReceived("/e", time.Now())
+		So(m.MessageCount(), ShouldEqual, 1)
+	})
+	Convey("Scenario: errors of ros bag record are included in the returned error", t, func() {
+		script := filepath.Join(t.TempDir(), "ros2")
+		So(os.WriteFile(script, []byte("#!/bin/sh\necho 'failed to open storage' >&2\nexit 1\n"), 0o700), ShouldBeNil)
+		r := &missionDataRecorder{ROSCommand: script, Dir: t.TempDir(), Logger: fakeLogger{}}
+		err := r.Start(context.Background(), func(context.Context, *bagMetadata) {})
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "latest errors: failed to open storage")
+	})
+}
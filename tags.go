@@ -0,0 +1,203 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+
+	rcl_interfaces_msg "github.com/tiiuae/mission-data-recorder/msgs/rcl_interfaces/msg"
+	rcl_interfaces_srv "github.com/tiiuae/mission-data-recorder/msgs/rcl_interfaces/srv"
+	std_msgs_msg "github.com/tiiuae/mission-data-recorder/msgs/std_msgs/msg"
+	"github.com/tiiuae/rclgo/pkg/rclgo"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	maxTagCount       = 64
+	maxTagValueLength = 1024
+)
+
+var tagKeyRegex = regexp.MustCompile(`^[a-zA-Z0-9_.:/-]{1,128}$`)
+
+// mergeTags applies update to tags and returns the result. Tags with empty
+// values in update are removed. tags is not modified.
+func mergeTags(tags, update map[string]string) (map[string]string, error) {
+	merged := make(map[string]string, len(tags)+len(update))
+	for k, v := range tags {
+		merged[k] = v
+	}
+	for k, v := range update {
+		if !tagKeyRegex.MatchString(k) {
+			return nil, fmt.Errorf("invalid tag key: %q", k)
+		}
+		if len(v) > maxTagValueLength {
+			return nil, fmt.Errorf("value of tag '%s' is longer than %d bytes", k, maxTagValueLength)
+		}
+		if v == "" {
+			delete(merged, k)
+		} else {
+			merged[k] = v
+		}
+	}
+	if len(merged) > maxTagCount {
+		return nil, fmt.Errorf("at most %d tags are allowed", maxTagCount)
+	}
+	if len(merged) == 0 {
+		return nil, nil
+	}
+	return merged, nil
+}
+
+// parseTagsYAML parses a YAML mapping of tags. Null values remove tags and
+// other scalars are converted to strings.
+func parseTagsYAML(s string) (map[string]string, error) {
+	var decoded map[string]interface{}
+	if err := yaml.Unmarshal([]byte(s), &decoded); err != nil {
+		return nil, err
+	}
+	tags := make(map[string]string, len(decoded))
+	for k, v := range decoded {
+		switch v := v.(type) {
+		case nil:
+			tags[k] = ""
+		case string:
+			tags[k] = v
+		case bool, int, float64:
+			tags[k] = fmt.Sprint(v)
+		default:
+			return nil, fmt.Errorf("value of tag '%s' must be a scalar", k)
+		}
+	}
+	return tags, nil
+}
+
+// tagsFromParameters converts the parameters of a SetParameters request to
+// tags. Unset parameters remove tags.
+func tagsFromParameters(params []rcl_interfaces_msg.Parameter) (map[string]string, error) {
+	tags := make(map[string]string, len(params))
+	for _, p := range params {
+		switch p.Value.Type {
+		case rcl_interfaces_msg.ParameterType_PARAMETER_NOT_SET:
+			tags[p.Name] = ""
+		case rcl_interfaces_msg.ParameterType_PARAMETER_STRING:
+			tags[p.Name] = p.Value.StringValue
+		default:
+			return nil, fmt.Errorf("value of tag '%s' must be a string", p.Name)
+		}
+	}
+	return tags, nil
+}
+
+// tagsWatcher receives tag updates from the ~/tags topic and the ~/set_tags
+// service and passes them to onUpdate. Messages on the topic are YAML
+// mappings. The service has the type rcl_interfaces/srv/SetParameters, where
+// each parameter sets the tag of the same name to a string value.
+type tagsWatcher struct {
+	sub         *rclgo.Subscription
+	service     *rcl_interfaces_srv.SetParametersService
+	onUpdate    func(map[string]string) error
+	diagnostics *diagnosticsMonitor
+}
+
+func newTagsWatcher(
+	node *rclgo.Node,
+	onUpdate func(map[string]string) error,
+	diagnostics *diagnosticsMonitor,
+) (w *tagsWatcher, err error) {
+	w = &tagsWatcher{
+		onUpdate:    onUpdate,
+		diagnostics: diagnostics,
+	}
+	opts := rclgo.NewDefaultSubscriptionOptions()
+	opts.Qos.Durability = rclgo.RmwQosDurabilityPolicyTransientLocal
+	opts.Qos.Reliability = rclgo.RmwQosReliabilityPolicyReliable
+	w.sub, err = node.NewSubscriptionWithOpts(
+		"~/tags",
+		std_msgs_msg.StringTypeSupport,
+		opts,
+		w.onMessage,
+	)
+	if err != nil {
+		return nil, err
+	}
+	w.service, err = rcl_interfaces_srv.NewSetParametersService(node, "~/set_tags", nil, w.onRequest)
+	if err != nil {
+		w.sub.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *tagsWatcher) Close() error {
+	var errs []error
+	if err := w.sub.Close(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := w.service.Close(); err != nil {
+		errs = append(errs, err)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to close tagsWatcher: %v", errs)
+	}
+	return nil
+}
+
+func (w *tagsWatcher) onMessage(s *rclgo.Subscription) {
+	var msg std_msgs_msg.String
+	if _, err := s.TakeMessage(&msg); err != nil {
+		w.sub.Node().Logger().Errorln("failed to read tags from topic:", err)
+		w.diagnostics.ReportError("tags", err)
+		return
+	}
+	tags, err := parseTagsYAML(msg.Data)
+	if err == nil {
+		err = w.update(tags)
+	}
+	if err != nil {
+		w.sub.Node().Logger().Errorln("failed to set tags:", err)
+		w.diagnostics.ReportError("tags", err)
+	}
+}
+
+func (w *tagsWatcher) onRequest(
+	info *rclgo.RmwServiceInfo,
+	req *rcl_interfaces_srv.SetParameters_Request,
+	sender rcl_interfaces_srv.SetParametersServiceResponseSender,
+) {
+	var result rcl_interfaces_msg.SetParametersResult
+	tags, err := tagsFromParameters(req.Parameters)
+	if err == nil {
+		err = w.update(tags)
+	}
+	if err != nil {
+		result.Reason = err.Error()
+	} else {
+		result.Successful = true
+	}
+	// The tags are set atomically, so every parameter has the same result.
+	resp := rcl_interfaces_srv.NewSetParameters_Response()
+	for range req.Parameters {
+		resp.Results = append(resp.Results, result)
+	}
+	if err := sender.SendResponse(resp); err != nil {
+		w.sub.Node().Logger().Errorln("failed to send response:", err)
+	}
+}
+
+func (w *tagsWatcher) update(tags map[string]string) error {
+	if len(tags) == 0 {
+		return errors.New("no tags given")
+	}
+	if err := w.onUpdate(tags); err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	w.sub.Node().Logger().Infoln("tags updated:", keys)
+	w.diagnostics.ReportSuccess("tags", "updated")
+	return nil
+}
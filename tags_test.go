@@ -0,0 +1,68 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	rcl_interfaces_msg "github.com/tiiuae/mission-data-recorder/msgs/rcl_interfaces/msg"
+)
+
+func TestTags(t *testing.T) {
+	Convey("Scenario: tags are updated", t, func() {
+		tags, err := mergeTags(nil, map[string]string{"pilot": "alice", "site": "field-1"})
+		So(err, ShouldBeNil)
+		tags, err = mergeTags(tags, map[string]string{"site": "", "payload": "camera"})
+		So(err, ShouldBeNil)
+		So(tags, ShouldResemble, map[string]string{"pilot": "alice", "payload": "camera"})
+		tags, err = mergeTags(tags, map[string]string{"pilot": "", "payload": ""})
+		So(err, ShouldBeNil)
+		So(tags, ShouldBeNil)
+
+		_, err = mergeTags(nil, map[string]string{"bad key": "x"})
+		So(err, ShouldNotBeNil)
+		_, err = mergeTags(nil, map[string]string{"key": strings.Repeat("x", maxTagValueLength+1)})
+		So(err, ShouldNotBeNil)
+	})
+	Convey("Scenario: tags are parsed from YAML and parameters", t, func() {
+		tags, err := parseTagsYAML("pilot: alice\ntest_case: 12\nsite: null\n")
+		So(err, ShouldBeNil)
+		So(tags, ShouldResemble, map[string]string{"pilot": "alice", "test_case": "12", "site": ""})
+		_, err = parseTagsYAML("pilot: [a, b]")
+		So(err, ShouldNotBeNil)
+
+		params := []rcl_interfaces_msg.Parameter{
+			{Name: "pilot", Value: rcl_interfaces_msg.ParameterValue{
+				Type: rcl_interfaces_msg.ParameterType_PARAMETER_STRING, StringValue: "alice",
+			}},
+			{Name: "site"},
+		}
+		tags, err = tagsFromParameters(params)
+		So(err, ShouldBeNil)
+		So(tags, ShouldResemble, map[string]string{"pilot": "alice", "site": ""})
+		params[0].Value.Type = rcl_interfaces_msg.ParameterType_PARAMETER_INTEGER
+		_, err = tagsFromParameters(params)
+		So(err, ShouldNotBeNil)
+	})
+	Convey("Scenario: tags are stored in the active session", t, func() {
+		dir := t.TempDir()
+		r := &missionDataRecorder{Logger: fakeLogger{}, currentDir: dir}
+		So(r.SetTags(map[string]string{"pilot": "alice"}), ShouldBeNil)
+		_, err := os.Stat(filepath.Join(dir, sessionFileName))
+		So(os.IsNotExist(err), ShouldBeTrue)
+
+		r.startSession()
+		session, err := loadSession(dir)
+		So(err, ShouldBeNil)
+		So(session.Tags, ShouldResemble, map[string]string{"pilot": "alice"})
+
+		So(r.SetTags(map[string]string{"site": "field-1"}), ShouldBeNil)
+		So(os.WriteFile(filepath.Join(dir, "bag_0.db3"), nil, 0o600), ShouldBeNil)
+		bag := newBagMetadata(filepath.Join(dir, "bag_0.db3"), 0, true)
+		_, tags, err := getBagSession(bag)
+		So(err, ShouldBeNil)
+		So(tags, ShouldResemble, map[string]string{"pilot": "alice", "site": "field-1"})
+	})
+}
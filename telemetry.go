@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	std_msgs_msg "github.com/tiiuae/mission-data-recorder/msgs/std_msgs/msg"
+	"github.com/tiiuae/rclgo/pkg/rclgo"
+)
+
+// diskSectorSize is the size of the sectors counted in /proc/diskstats
+// regardless of the actual sector size of the device.
+const diskSectorSize = 512
+
+// systemSample is published as a JSON object on the ~/telemetry topic.
+type systemSample struct {
+	Time time.Time `json:"time"`
+	// CPULoad is the percentage of time all CPUs were busy since the previous
+	// sample. CPUCoreLoads contains the same for each CPU. Both are empty in
+	// the first sample.
+	CPULoad      *float64     `json:"cpuLoad,omitempty"`
+	CPUCoreLoads []float64    `json:"cpuCoreLoads,omitempty"`
+	LoadAverage  []float64    `json:"loadAverage,omitempty"`
+	Memory       *memoryUsage `json:"memory,omitempty"`
+	// Temperatures maps thermal zone types to their temperatures in degrees
+	// Celsius.
+	Temperatures map[string]float64 `json:"temperatures,omitempty"`
+	// Disks maps block devices to their I/O rates since the previous sample.
+	// It is empty in the first sample.
+	Disks map[string]diskIORate `json:"disks,omitempty"`
+	// Errors describes the values which couldn't be read.
+	Errors []string `json:"errors,omitempty"`
+}
+
+type memoryUsage struct {
+	TotalBytes     int64 `json:"totalBytes"`
+	AvailableBytes int64 `json:"availableBytes"`
+	SwapTotalBytes int64 `json:"swapTotalBytes"`
+	SwapFreeBytes  int64 `json:"swapFreeBytes"`
+}
+
+type diskIORate struct {
+	ReadBytesPerSecond  float64 `json:"readBytesPerSecond"`
+	WriteBytesPerSecond float64 `json:"writeBytesPerSecond"`
+}
+
+type cpuTimes struct {
+	busy, total uint64
+}
+
+type diskCounters struct {
+	sectorsRead, sectorsWritten uint64
+}
+
+// systemSampler reads system resource usage from /proc and /sys. Rates are
+// computed from the difference to the previous sample.
+type systemSampler struct {
+	ProcDir string
+	SysDir  string
+
+	prevTime  time.Time
+	prevCPU   []cpuTimes
+	prevDisks map[string]diskCounters
+}
+
+func newSystemSampler() *systemSampler {
+	return &systemSampler{ProcDir: "/proc", SysDir: "/sys"}
+}
+
+// Sample reads the current resource usage. Values which can't be read are
+// omitted and described in the errors of the sample.
+func (s *systemSampler) Sample(now time.Time) *systemSample {
+	sample := &systemSample{Time: now}
+	addError := func(what string, err error) {
+		sample.Errors = append(sample.Errors, fmt.Sprintf("failed to read %s: %v", what, err))
+	}
+	elapsed := now.Sub(s.prevTime).Seconds()
+	if cpu, err := s.readCPUTimes(); err != nil {
+		addError("CPU load", err)
+	} else {
+		if len(s.prevCPU) == len(cpu) {
+			loads := make([]float64, len(cpu))
+			for i := range cpu {
+				loads[i] = cpuLoad(s.prevCPU[i], cpu[i])
+			}
+			sample.CPULoad = &loads[0]
+			sample.CPUCoreLoads = loads[1:]
+		}
+		s.prevCPU = cpu
+	}
+	if load, err := s.readLoadAverage(); err != nil {
+		addError("load average", err)
+	} else {
+		sample.LoadAverage = load
+	}
+	if mem, err := s.readMemoryUsage(); err != nil {
+		addError("memory usage", err)
+	} else {
+		sample.Memory = mem
+	}
+	if temps, err := s.readTemperatures(); err != nil {
+		addError("temperatures", err)
+	} else {
+		sample.Temperatures = temps
+	}
+	if disks, err := s.readDiskCounters(); err != nil {
+		addError("disk I/O", err)
+	} else {
+		if s.prevDisks != nil && elapsed > 0 {
+			sample.Disks = make(map[string]diskIORate, len(disks))
+			for name, c := range disks {
+				prev, ok := s.prevDisks[name]
+				if !ok || c.sectorsRead < prev.sectorsRead || c.sectorsWritten < prev.sectorsWritten {
+					continue
+				}
+				sample.Disks[name] = diskIORate{
+					ReadBytesPerSecond:  float64((c.sectorsRead-prev.sectorsRead)*diskSectorSize) / elapsed,
+					WriteBytesPerSecond: float64((c.sectorsWritten-prev.sectorsWritten)*diskSectorSize) / elapsed,
+				}
+			}
+		}
+		s.prevDisks = disks
+	}
+	s.prevTime = now
+	return sample
+}
+
+func cpuLoad(prev, cur cpuTimes) float64 {
+	if cur.total <= prev.total || cur.busy < prev.busy {
+		return 0
+	}
+	return 100 * float64(cur.busy-prev.busy) / float64(cur.total-prev.total)
+}
+
+// readCPUTimes returns the times of all CPUs followed by the times of each
+// CPU.
+func (s *systemSampler) readCPUTimes() ([]cpuTimes, error) {
+	var times []cpuTimes
+	err := s.scanFile(filepath.Join(s.ProcDir, "stat"), func(fields []string) error {
+		if len(fields) < 5 || !strings.HasPrefix(fields[0], "cpu") {
+			return nil
+		}
+		var t cpuTimes
+		for i, f := range fields[1:] {
+			v, err := strconv.ParseUint(f, 10, 64)
+			if err != nil {
+				return err
+			}
+			// Guest times are included in user and nice times.
+			if i >= 8 {
+				break
+			}
+			t.total += v
+			// The fourth and fifth fields are idle and iowait.
+			if i != 3 && i != 4 {
+				t.busy += v
+			}
+		}
+		times = append(times, t)
+		return nil
+	})
+	if err == nil && len(times) == 0 {
+		err = errors.New("no CPUs found")
+	}
+	return times, err
+}
+
+func (s *systemSampler) readLoadAverage() ([]float64, error) {
+	data, err := os.ReadFile(filepath.Join(s.ProcDir, "loadavg"))
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) < 3 {
+		return nil, errors.New("invalid format")
+	}
+	load := make([]float64, 3)
+	for i := range load {
+		if load[i], err = strconv.ParseFloat(fields[i], 64); err != nil {
+			return nil, err
+		}
+	}
+	return load, nil
+}
+
+func (s *systemSampler) readMemoryUsage() (*memoryUsage, error) {
+	var mem memoryUsage
+	values := map[string]*int64{
+		"MemTotal:":     &mem.TotalBytes,
+		"MemAvailable:": &mem.AvailableBytes,
+		"SwapTotal:":    &mem.SwapTotalBytes,
+		"SwapFree:":     &mem.SwapFreeBytes,
+	}
+	err := s.scanFile(filepath.Join(s.ProcDir, "meminfo"), func(fields []string) error {
+		if len(fields) < 2 {
+			return nil
+		}
+		if v, ok := values[fields[0]]; ok {
+			kb, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return err
+			}
+			*v = kb * 1024
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &mem, nil
+}
+
+// readTemperatures returns the temperatures of the thermal zones. Zones whose
+// type is shared by another zone are named after the zone instead.
+func (s *systemSampler) readTemperatures() (map[string]float64, error) {
+	zones, err := filepath.Glob(filepath.Join(s.SysDir, "class", "thermal", "thermal_zone*"))
+	if err != nil {
+		return nil, err
+	}
+	temps := make(map[string]float64, len(zones))
+	for _, zone := range zones {
+		//#nosec G304 -- The path is constructed by this program.
+		data, err := os.ReadFile(filepath.Join(zone, "temp"))
+		if err != nil {
+			// Reading the temperature of a disabled zone fails.
+			continue
+		}
+		milli, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid temperature of %s: %w", filepath.Base(zone), err)
+		}
+		//#nosec G304 -- The path is constructed by this program.
+		typ, err := os.ReadFile(filepath.Join(zone, "type"))
+		name := strings.TrimSpace(string(typ))
+		if _, exists := temps[name]; err != nil || name == "" || exists {
+			name = filepath.Base(zone)
+		}
+		temps[name] = float64(milli) / 1000
+	}
+	return temps, nil
+}
+
+// readDiskCounters returns the I/O counters of block devices. Partitions are
+// skipped, because their I/O is included in the I/O of their devices.
+func (s *systemSampler) readDiskCounters() (map[string]diskCounters, error) {
+	disks := make(map[string]diskCounters)
+	err := s.scanFile(filepath.Join(s.ProcDir, "diskstats"), func(fields []string) error {
+		if len(fields) < 10 {
+			return nil
+		}
+		name := fields[2]
+		if strings.HasPrefix(name, "loop") || strings.HasPrefix(name, "ram") {
+			return nil
+		}
+		if _, err := os.Stat(filepath.Join(s.SysDir, "block", name)); err != nil {
+			return nil
+		}
+		var c diskCounters
+		var err error
+		if c.sectorsRead, err = strconv.ParseUint(fields[5], 10, 64); err != nil {
+			return err
+		}
+		if c.sectorsWritten, err = strconv.ParseUint(fields[9], 10, 64); err != nil {
+			return err
+		}
+		disks[name] = c
+		return nil
+	})
+	return disks, err
+}
+
+func (s *systemSampler) scanFile(path string, handleLine func(fields []string) error) error {
+	//#nosec G304 -- The path is constructed by this program.
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if err := handleLine(strings.Fields(scanner.Text())); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// telemetryCollector publishes samples of system resource usage on the
+// ~/telemetry topic, so that they are recorded in the bags with the other
+// topics.
+type telemetryCollector struct {
+	pub    *std_msgs_msg.StringPublisher
+	topic  string
+	logger logger
+}
+
+func newTelemetryCollector(node *rclgo.Node) (_ *telemetryCollector, err error) {
+	c := &telemetryCollector{
+		topic:  node.FullyQualifiedName() + "/telemetry",
+		logger: node.Logger(),
+	}
+	c.pub, err = std_msgs_msg.NewStringPublisher(node, "~/telemetry", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create publisher: %w", err)
+	}
+	return c, nil
+}
+
+func (c *telemetryCollector) Close() error {
+	return c.pub.Close()
+}
+
+// Topic returns the fully qualified name of the telemetry topic.
+func (c *telemetryCollector) Topic() string {
+	return c.topic
+}
+
+// Run publishes a sample every interval until ctx is done.
+func (c *telemetryCollector) Run(ctx context.Context, interval time.Duration) {
+	sampler := newSystemSampler()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	loggedErrors := make(map[string]bool)
+	for {
+		sample := sampler.Sample(time.Now())
+		// The same values usually fail on every sample.
+		for _, e := range sample.Errors {
+			if !loggedErrors[e] {
+				loggedErrors[e] = true
+				c.logger.Errorf("telemetry: %s", e)
+			}
+		}
+		c.publish(sample)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *telemetryCollector) publish(sample *systemSample) {
+	data, err := json.Marshal(sample)
+	if err != nil {
+		c.logger.Errorf("failed to encode telemetry: %v", err)
+		return
+	}
+	msg := std_msgs_msg.NewString()
+	msg.Data = string(data)
+	if err := c.pub.Publish(msg); err != nil {
+		c.logger.Errorf("failed to publish telemetry: %v", err)
+	}
+}
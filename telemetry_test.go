@@ -0,0 +1,63 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func writeTestFiles(root string, files map[string]string) {
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		So(os.MkdirAll(filepath.Dir(path), 0o700), ShouldBeNil)
+		So(os.WriteFile(path, []byte(content), 0o600), ShouldBeNil)
+	}
+}
+
+func TestTelemetry(t *testing.T) {
+	Convey("System resource usage is sampled from /proc and /sys", t, func() {
+		root := t.TempDir()
+		s := &systemSampler{ProcDir: filepath.Join(root, "proc"), SysDir: filepath.Join(root, "sys")}
+		writeTestFiles(root, map[string]string{
+			"proc/stat":                            "cpu  100 0 100 700 100 0 0 0 0 0\ncpu0 100 0 100 700 100 0 0 0 0 0\nintr 1 2 3\n",
+			"proc/loadavg":                         "0.50 0.25 0.10 1/100 1234\n",
+			"proc/meminfo":                         "MemTotal:       2048 kB\nMemFree:         512 kB\nMemAvailable:   1024 kB\nSwapTotal:         0 kB\nSwapFree:          0 kB\n",
+			"proc/diskstats":                       "   7       0 loop0 1 0 8 0 0 0 0 0 0 0 0\n 179       0 mmcblk0 10 0 100 0 10 0 200 0 0 0 0\n 179       1 mmcblk0p1 10 0 100 0 10 0 200 0 0 0 0\n",
+			"sys/block/loop0/size":                 "0",
+			"sys/block/mmcblk0/size":               "0",
+			"sys/class/thermal/thermal_zone0/type": "cpu-thermal\n",
+			"sys/class/thermal/thermal_zone0/temp": "45500\n",
+			"sys/class/thermal/thermal_zone1/type": "cpu-thermal\n",
+			"sys/class/thermal/thermal_zone1/temp": "47000\n",
+		})
+		start := time.Now()
+		first := s.Sample(start)
+		So(first.Errors, ShouldBeEmpty)
+		So(first.CPULoad, ShouldBeNil)
+		So(first.Disks, ShouldBeNil)
+		So(first.LoadAverage, ShouldResemble, []float64{0.5, 0.25, 0.1})
+		So(*first.Memory, ShouldResemble, memoryUsage{TotalBytes: 2048 * 1024, AvailableBytes: 1024 * 1024})
+		So(first.Temperatures, ShouldResemble, map[string]float64{"cpu-thermal": 45.5, "thermal_zone1": 47})
+
+		writeTestFiles(root, map[string]string{
+			"proc/stat":      "cpu  200 0 200 800 100 0 0 0 0 0\ncpu0 200 0 200 800 100 0 0 0 0 0\n",
+			"proc/diskstats": " 179       0 mmcblk0 10 0 2148 0 10 0 4296 0 0 0 0\n",
+		})
+		second := s.Sample(start.Add(2 * time.Second))
+		So(second.Errors, ShouldBeEmpty)
+		So(*second.CPULoad, ShouldAlmostEqual, 200.0/3)
+		So(second.CPUCoreLoads, ShouldHaveLength, 1)
+		So(second.Disks, ShouldResemble, map[string]diskIORate{
+			"mmcblk0": {ReadBytesPerSecond: 1024 * 512, WriteBytesPerSecond: 2048 * 512},
+		})
+	})
+	Convey("Missing files are reported as errors", t, func() {
+		s := &systemSampler{ProcDir: t.TempDir(), SysDir: t.TempDir()}
+		sample := s.Sample(time.Now())
+		So(sample.Errors, ShouldHaveLength, 4)
+		So(sample.Temperatures, ShouldBeEmpty)
+	})
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// topicInfo describes a topic as printed by "ros2 topic info". rclgo doesn't
+// expose the publishers of a topic or their QoS profiles, so the command line
+// interface is used.
+type topicInfo struct {
+	Type              string
+	PublisherCount    int
+	SubscriptionCount int
+	// Endpoints is set only if the verbose output was requested.
+	Endpoints []topicEndpoint
+}
+
+// topicEndpoint is a publisher or subscription of a topic.
+type topicEndpoint struct {
+	NodeName      string `json:"nodeName"`
+	NodeNamespace string `json:"nodeNamespace"`
+	TopicType     string `json:"topicType"`
+	// EndpointType is PUBLISHER or SUBSCRIPTION.
+	EndpointType string `json:"endpointType"`
+	// QoS maps the policies of the QoS profile of the endpoint to their
+	// values as printed by ros2, e.g. "Reliability": "RELIABLE".
+	QoS map[string]string `json:"qos,omitempty"`
+}
+
+// getTopicInfo runs "ros2 topic info" for topic using rosCmd, which defaults to
+// "ros2" if empty. If verbose is true, the endpoints of the topic are included.
+func getTopicInfo(ctx context.Context, rosCmd, topic string, verbose bool) (*topicInfo, error) {
+	if rosCmd == "" {
+		rosCmd = "ros2"
+	}
+	args := []string{"topic", "info", topic}
+	if verbose {
+		args = append(args, "--verbose")
+	}
+	//#nosec G204 -- The command needs to be configurable.
+	out, err := exec.CommandContext(ctx, rosCmd, args...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get info of topic %s: %w", topic, err)
+	}
+	return parseTopicInfo(string(out))
+}
+
+// parseTopicInfo parses the output of "ros2 topic info" with or without the
+// --verbose flag.
+func parseTopicInfo(s string) (*topicInfo, error) {
+	info := &topicInfo{PublisherCount: -1, SubscriptionCount: -1}
+	var endpoint *topicEndpoint
+	inQoS := false
+	scanner := bufio.NewScanner(strings.NewReader(s))
+	for scanner.Scan() {
+		line := scanner.Text()
+		fields := strings.SplitN(line, ":", 2)
+		if len(fields) != 2 {
+			inQoS = false
+			continue
+		}
+		key := strings.TrimSpace(fields[0])
+		value := strings.TrimSpace(fields[1])
+		if inQoS && endpoint != nil && strings.HasPrefix(line, " ") {
+			endpoint.QoS[key] = value
+			continue
+		}
+		inQoS = false
+		var err error
+		switch key {
+		case "Type":
+			info.Type = value
+		case "Publisher count":
+			info.PublisherCount, err = strconv.Atoi(value)
+		case "Subscription count":
+			info.SubscriptionCount, err = strconv.Atoi(value)
+		case "Node name":
+			info.Endpoints = append(info.Endpoints, topicEndpoint{NodeName: value})
+			endpoint = &info.Endpoints[len(info.Endpoints)-1]
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid topic info: %w", err)
+		}
+		if endpoint == nil {
+			continue
+		}
+		switch key {
+		case "Node namespace":
+			endpoint.NodeNamespace = value
+		case "Topic type":
+			endpoint.TopicType = value
+		case "Endpoint type":
+			endpoint.EndpointType = value
+		case "QoS profile":
+			endpoint.QoS = make(map[string]string)
+			inQoS = true
+		}
+	}
+	if info.PublisherCount < 0 || info.SubscriptionCount < 0 {
+		return nil, fmt.Errorf("invalid topic info: %q", s)
+	}
+	return info, nil
+}
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/tiiuae/rclgo/pkg/rclgo"
+)
+
+const defaultMaxTopicGap = 5 * time.Second
+
+// topicExpectation describes how a recorded topic is expected to be published.
+type topicExpectation struct {
+	// MinRate is the minimum expected message rate in Hz. If zero, the rate
+	// is not checked.
+	MinRate float64 `yaml:"min_rate"`
+	// MaxGap is the longest expected time between two messages. If zero,
+	// defaultMaxTopicGap is used.
+	MaxGap time.Duration `yaml:"max_gap"`
+	// If Required is true, a warning is raised when the topic is silent for
+	// longer than MaxGap.
+	Required bool `yaml:"required"`
+}
+
+func (e *topicExpectation) maxGap() time.Duration {
+	if e.MaxGap > 0 {
+		return e.MaxGap
+	}
+	return defaultMaxTopicGap
+}
+
+func (e *topicExpectation) validate() error {
+	if e.MinRate < 0 {
+		return errors.New("'min_rate' must be non-negative")
+	}
+	if e.MaxGap < 0 {
+		return errors.New("'max_gap' must be non-negative")
+	}
+	return nil
+}
+
+// Event types published by topicMonitor.
+const (
+	eventTopicSilent    = "topic_silent"
+	eventTopicRateLow   = "topic_rate_low"
+	eventTopicRecovered = "topic_recovered"
+)
+
+// topicStatus is the state of a monitored topic.
+type topicStatus struct {
+	Expectation topicExpectation
+	// Publishers is the number of publishers of the topic when it was last
+	// looked up or -1 if it isn't known.
+	Publishers int
+	// Messages is the number of messages received since monitoring started.
+	Messages int64
+	// Rate is the message rate in Hz during the latest check interval.
+	Rate float64
+	// Gaps is the number of times the topic has been silent for longer than
+	// the maximum gap.
+	Gaps int
+	// LongestGap is the longest time observed between two messages.
+	LongestGap  time.Duration
+	LastMessage time.Time
+	// Problem is the type of the event describing the current problem of the
+	// topic or empty if there is no problem.
+	Problem string
+
+	// counted is true if the topic is recorded, see MessageCount.
+	counted bool
+
+	sub              *rclgo.Subscription
+	subscribeFailed  bool
+	intervalMessages int64
+	rateValid        bool
+	silent           bool
+}
+
+// topicMonitor subscribes to the topics with expectations while they are
+// being recorded and reports the topics which don't meet the expectations as
+// warnings in diagnostics and as events. The messages of the monitored topics
+// which are recorded are counted too, which is used to detect a stalled
+// recorder without subscribing to the other recorded topics. Messages are
+// taken serialized, so the Go bindings of the message types are not needed.
+type topicMonitor struct {
+	CheckInterval time.Duration
+	// The publishers of the monitored topics are counted every
+	// PublisherInterval using ROSCommand, which defaults to "ros2" if empty.
+	PublisherInterval time.Duration
+	ROSCommand        string
+
+	node        *rclgo.Node
+	logger      logger
+	diagnostics *diagnosticsMonitor
+	events      *eventPublisher
+
+	mu sync.Mutex
+	// +checklocks:mu
+	topics map[string]*topicStatus
+	// +checklocks:mu
+	started time.Time
+	// +checklocks:mu
+	lastCheck time.Time
+}
+
+func newTopicMonitor(
+	node *rclgo.Node, logger logger, diagnostics *diagnosticsMonitor, events *eventPublisher,
+) *topicMonitor {
+	return &topicMonitor{
+		CheckInterval:     time.Second,
+		PublisherInterval: 10 * time.Second,
+		node:              node,
+		logger:            logger,
+		diagnostics:       diagnostics,
+		events:            events,
+	}
+}
+
+// Run monitors the topics in expectations until ctx is cancelled. If recorded
+// is non-nil, the messages of the monitored topics for which it returns true
+// are counted, see MessageCount.
+func (m *topicMonitor) Run(
+	ctx context.Context, expectations map[string]topicExpectation, recorded func(topic string) bool,
+) {
+	if len(expectations) == 0 {
+		return
+	}
+	m.start(expectations, recorded, time.Now())
+	defer m.stop()
+	publishersDone := make(chan struct{})
+	publishersCtx, stopPublishers := context.WithCancel(ctx)
+	go func() {
+		defer close(publishersDone)
+		m.countPublishers(publishersCtx, expectations)
+	}()
+	defer func() {
+		stopPublishers()
+		<-publishersDone
+	}()
+	stopWaitSet := func() {}
+	defer func() { stopWaitSet() }()
+	ticker := time.NewTicker(m.CheckInterval)
+	defer ticker.Stop()
+	for {
+		if subs, changed := m.subscribe(); changed {
+			stopWaitSet()
+			stopWaitSet = m.runWaitSet(ctx, subs)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			m.check(time.Now())
+		}
+	}
+}
+
+// Status returns the status of the monitored topics.
+func (m *topicMonitor) Status() map[string]topicStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	status := make(map[string]topicStatus, len(m.topics))
+	for name, t := range m.topics {
+		status[name] = *t
+	}
+	return status
+}
+
+// MessageCount returns the number of messages received on the monitored
+// topics which are recorded since monitoring started.
+func (m *topicMonitor) MessageCount() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var n int64
+	for _, t := range m.topics {
+		if t.counted {
+			n += t.Messages
+		}
+	}
+	return n
+}
+
+func (m *topicMonitor) start(
+	expectations map[string]topicExpectation, recorded func(topic string) bool, now time.Time,
+) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.topics = make(map[string]*topicStatus, len(expectations))
+	for name, e := range expectations {
+		m.topics[name] = &topicStatus{
+			Expectation: e,
+			Publishers:  -1,
+			counted:     recorded != nil && recorded(name),
+		}
+	}
+	m.started = now
+	m.lastCheck = now
+}
+
+func (m *topicMonitor) stop() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for name, t := range m.topics {
+		if t.sub != nil {
+			if err := t.sub.Close(); err != nil {
+				m.logger.Errorf("failed to close subscription to %s: %v", name, err)
+			}
+			t.sub = nil
+		}
+		m.diagnostics.ReportSuccess("topic "+name, "not recording")
+	}
+}
+
+// subscribe subscribes to the monitored topics which exist in the ROS graph.
+// All subscriptions are returned. changed is true if new subscriptions were
+// created.
+func (m *topicMonitor) subscribe() (subs []*rclgo.Subscription, changed bool) {
+	graph, err := m.node.GetTopicNamesAndTypes()
+	if err != nil {
+		m.logger.Errorf("failed to get topics: %v", err)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for name, t := range m.topics {
+		types, ok := graph[name]
+		if t.sub == nil && ok && !t.subscribeFailed {
+			sub, err := m.newSubscription(name, types)
+			if err != nil {
+				// The type of a topic rarely changes, so the error isn't
+				// repeated on every check.
+				t.subscribeFailed = true
+				m.logger.Errorf("failed to monitor topic %s: %v", name, err)
+				m.diagnostics.ReportError("topic "+name, "failed to monitor: ", err)
+			} else {
+				t.sub = sub
+				changed = true
+			}
+		}
+		if t.sub != nil {
+			subs = append(subs, t.sub)
+		}
+	}
+	return subs, changed
+}
+
+// countPublishers updates the publisher counts of the topics in expectations
+// every PublisherInterval until ctx is cancelled. The subscriptions of the
+// monitor make the topics exist in the ROS graph even if they have no
+// publishers, so the publishers are counted separately.
+func (m *topicMonitor) countPublishers(ctx context.Context, expectations map[string]topicExpectation) {
+	ticker := time.NewTicker(m.PublisherInterval)
+	defer ticker.Stop()
+	var failed bool
+	for {
+		for name := range expectations {
+			info, err := getTopicInfo(ctx, m.ROSCommand, name, false)
+			if ctx.Err() != nil {
+				return
+			}
+			publishers := -1
+			if err == nil {
+				publishers = info.PublisherCount
+			} else if !failed {
+				// The error is likely to be repeated for every topic.
+				failed = true
+				m.logger.Errorf("failed to count publishers: %v", err)
+			}
+			m.mu.Lock()
+			m.topics[name].Publishers = publishers
+			m.mu.Unlock()
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (m *topicMonitor) newSubscription(topic string, types []string) (*rclgo.Subscription, error) {
+	if len(types) != 1 {
+		return nil, fmt.Errorf("topic has %d types", len(types))
+	}
+	ts, err := loadRawTypeSupport(types[0])
+	if err != nil {
+		return nil, err
+	}
+	// Best effort subscriptions match both reliable and best effort
+	// publishers.
+	opts := rclgo.NewDefaultSubscriptionOptions()
+	opts.Qos.Reliability = rclgo.RmwQosReliabilityPolicyBestEffort
+	return m.node.NewSubscriptionWithOpts(topic, ts, opts, m.onMessage)
+}
+
+// runWaitSet runs a wait set for subs until the returned function is called
+// or ctx is cancelled. The wait set of the rclgo context contains only the
+// subscriptions which existed when it was started.
+func (m *topicMonitor) runWaitSet(ctx context.Context, subs []*rclgo.Subscription) (stop func()) {
+	ws, err := m.node.Context().NewWaitSet()
+	if err != nil {
+		m.logger.Errorf("failed to create wait set for topic monitoring: %v", err)
+		return func() {}
+	}
+	ws.AddSubscriptions(subs...)
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer ws.Close()
+		if err := ws.Run(ctx); err != nil && !errors.Is(err, context.Canceled) {
+			m.logger.Errorf("topic monitoring stopped: %v", err)
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+func (m *topicMonitor) onMessage(s *rclgo.Subscription) {
+	if _, _, err := s.TakeSerializedMessage(); err != nil {
+		m.logger.Errorf("failed to take message from %s: %v", s.TopicName, err)
+		return
+	}
+	m.messageReceived(s.TopicName, time.Now())
+}
+
+func (m *topicMonitor) messageReceived(topic string, now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t := m.topics[topic]
+	if t == nil {
+		return
+	}
+	last := t.LastMessage
+	if last.IsZero() {
+		last = m.started
+	}
+	if gap := now.Sub(last); gap > t.LongestGap {
+		t.LongestGap = gap
+	}
+	t.LastMessage = now
+	t.Messages++
+	t.intervalMessages++
+	t.silent = false
+}
+
+// check updates the rates of the topics and reports their problems.
+func (m *topicMonitor) check(now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	elapsed := now.Sub(m.lastCheck)
+	m.lastCheck = now
+	names := make([]string, 0, len(m.topics))
+	for name := range m.topics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		t := m.topics[name]
+		last := t.LastMessage
+		if last.IsZero() {
+			last = m.started
+		}
+		silence := now.Sub(last)
+		if silence > t.Expectation.maxGap() && !t.silent {
+			t.silent = true
+			t.Gaps++
+		}
+		if t.silent && silence > t.LongestGap {
+			t.LongestGap = silence
+		}
+		// The rate is valid from the first whole interval during which the
+		// topic was subscribed to.
+		if t.rateValid && elapsed > 0 {
+			t.Rate = float64(t.intervalMessages) / elapsed.Seconds()
+		}
+		t.rateValid = t.sub != nil || t.Messages > 0
+		t.intervalMessages = 0
+
+		var problem, description string
+		switch {
+		case t.silent && t.Expectation.Required && t.Publishers == 0:
+			problem, description = eventTopicSilent, "not published"
+		case t.silent && t.Expectation.Required:
+			problem, description = eventTopicSilent, fmt.Sprintf("no messages for %v", silence.Round(time.Second))
+		case !t.silent && t.Expectation.MinRate > 0 && t.Rate > 0 && t.Rate < t.Expectation.MinRate:
+			problem, description = eventTopicRateLow, fmt.Sprintf(
+				"rate %.1f Hz is below %.1f Hz", t.Rate, t.Expectation.MinRate,
+			)
+		}
+		key := "topic " + name
+		if problem != "" {
+			m.diagnostics.ReportWarning(key, description)
+		} else {
+			m.diagnostics.ReportSuccess(key, fmt.Sprintf(
+				"%.1f Hz, %d messages, %d gaps, longest gap %v",
+				t.Rate, t.Messages, t.Gaps, t.LongestGap.Round(time.Millisecond),
+			))
+		}
+		if problem == t.Problem {
+			continue
+		}
+		if problem != "" {
+			m.logger.Warnf("topic %s: %s", name, description)
+			m.events.Publish(recorderEvent{Time: now, Type: problem, Topic: name, Message: description})
+		} else {
+			m.logger.Infof("topic %s recovered", name)
+			m.events.Publish(recorderEvent{Time: now, Type: eventTopicRecovered, Topic: name})
+		}
+		t.Problem = problem
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestTopicMonitor(t *testing.T) {
+	Convey("Scenario: silent and slow topics are detected", t, func() {
+		m := newTopicMonitor(nil, fakeLogger{}, nil, nil)
+		start := time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)
+		m.start(map[string]topicExpectation{
+			"/required": {Required: true, MaxGap: 2 * time.Second},
+			"/optional": {},
+			"/fast":     {MinRate: 10},
+		}, nil, start)
+		at := func(d time.Duration) time.Time { return start.Add(d) }
+
+		Convey("Given messages are received as expected", func() {
+			m.messageReceived("/fast", at(500*time.Millisecond))
+			m.messageReceived("/required", at(time.Second))
+			m.check(at(time.Second))
+			for i := 1; i <= 10; i++ {
+				m.messageReceived("/fast", at(time.Second+time.Duration(i)*100*time.Millisecond))
+			}
+			m.check(at(2 * time.Second))
+
+			status := m.Status()
+			So(status["/required"].Problem, ShouldBeEmpty)
+			So(status["/optional"].Problem, ShouldBeEmpty)
+			So(status["/fast"].Problem, ShouldBeEmpty)
+			So(status["/fast"].Messages, ShouldEqual, 11)
+			So(status["/fast"].Rate, ShouldEqual, 10)
+		})
+		Convey("Given a required topic goes silent", func() {
+			m.messageReceived("/required", at(time.Second))
+			m.check(at(2 * time.Second))
+			m.check(at(4 * time.Second))
+
+			status := m.Status()
+			So(status["/required"].Problem, ShouldEqual, eventTopicSilent)
+			So(status["/required"].Gaps, ShouldEqual, 1)
+			So(status["/required"].LongestGap, ShouldEqual, 3*time.Second)
+			So(status["/optional"].Problem, ShouldBeEmpty)
+
+			Convey("It recovers when messages are received again", func() {
+				m.messageReceived("/required", at(5*time.Second))
+				m.check(at(6 * time.Second))
+
+				status := m.Status()
+				So(status["/required"].Problem, ShouldBeEmpty)
+				So(status["/required"].Gaps, ShouldEqual, 1)
+				So(status["/required"].LongestGap, ShouldEqual, 4*time.Second)
+			})
+		})
+		Convey("Given a topic is published slower than expected", func() {
+			m.messageReceived("/fast", at(500*time.Millisecond))
+			m.check(at(time.Second))
+			for i := 1; i <= 5; i++ {
+				m.messageReceived("/fast", at(time.Second+time.Duration(i)*200*time.Millisecond))
+			}
+			m.check(at(2 * time.Second))
+
+			status := m.Status()
+			So(status["/fast"].Problem, ShouldEqual, eventTopicRateLow)
+			So(status["/fast"].Rate, ShouldEqual, 5)
+		})
+	})
+	Convey("Scenario: the publishers of monitored topics are counted", t, func() {
+		info, err := parseTopicInfo("Type: std_msgs/msg/String\nPublisher count: 2\nSubscription count: 1\n")
+		So(err, ShouldBeNil)
+		So(info, ShouldResemble, &topicInfo{Type: "std_msgs/msg/String", PublisherCount: 2, SubscriptionCount: 1})
+		_, err = parseTopicInfo("Unknown topic '/a'\n")
+		So(err, ShouldBeError)
+
+		info, err = parseTopicInfo(`Type: std_msgs/msg/String
+
+Publisher count: 1
+
+Node name: talker
+Node namespace: /
+Topic type: std_msgs/msg/String
+Endpoint type: PUBLISHER
+GID: 01.0f.2c.4e.3b.0e.e0.9f.01.00.00.00.00.00.12.03.00.00.00.00.00.00.00.00
+QoS profile:
+  Reliability: RELIABLE
+  History (Depth): KEEP_LAST (7)
+  Durability: VOLATILE
+
+Subscription count: 0
+
+`)
+		So(err, ShouldBeNil)
+		So(info.Endpoints, ShouldResemble, []topicEndpoint{{
+			NodeName:      "talker",
+			NodeNamespace: "/",
+			TopicType:     "std_msgs/msg/String",
+			EndpointType:  "PUBLISHER",
+			QoS: map[string]string{
+				"Reliability":     "RELIABLE",
+				"History (Depth)": "KEEP_LAST (7)",
+				"Durability":      "VOLATILE",
+			},
+		}})
+
+		script := filepath.Join(t.TempDir(), "ros2")
+		So(os.WriteFile(script, []byte("#!/bin/sh\necho 'Type: std_msgs/msg/String'\necho 'Publisher count: 0'\necho 'Subscription count: 1'\n"), 0o700), ShouldBeNil)
+		m := newTopicMonitor(nil, fakeLogger{}, nil, nil)
+		m.ROSCommand = script
+		expectations := map[string]topicExpectation{"/a": {Required: true}}
+		m.start(expectations, nil, time.Now())
+		So(m.Status()["/a"].Publishers, ShouldEqual, -1)
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			m.countPublishers(ctx, expectations)
+		}()
+		for i := 0; i < 100 && m.Status()["/a"].Publishers < 0; i++ {
+			time.Sleep(50 * time.Millisecond)
+		}
+		cancel()
+		<-done
+		So(m.Status()["/a"].Publishers, ShouldEqual, 0)
+	})
+	Convey("Type support of invalid message types is not loaded", t, func() {
+		_, err := loadRawTypeSupport("std_msgs/String")
+		So(err, ShouldBeError)
+		_, err = loadRawTypeSupport("nonexistent_msgs/msg/Nothing")
+		So(err, ShouldBeError)
+	})
+}
@@ -0,0 +1,80 @@
+package main
+
+/*
+#cgo LDFLAGS: -ldl
+#include <dlfcn.h>
+#include <stdlib.h>
+
+typedef const void *(*get_type_support_func)(void);
+
+static const void *call_get_type_support(void *f) {
+	return ((get_type_support_func)f)();
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"unsafe"
+
+	"github.com/tiiuae/rclgo/pkg/rclgo/types"
+)
+
+var errRawMessage = errors.New("messages of a raw type support can only be taken serialized")
+
+// rawTypeSupport is the C type support of a message type whose Go bindings
+// haven't been generated. It can only be used to create subscriptions from
+// which messages are taken serialized.
+type rawTypeSupport struct {
+	typeSupport unsafe.Pointer
+}
+
+func (t *rawTypeSupport) New() types.Message                       { panic(errRawMessage) }
+func (t *rawTypeSupport) PrepareMemory() unsafe.Pointer            { panic(errRawMessage) }
+func (t *rawTypeSupport) ReleaseMemory(unsafe.Pointer)             { panic(errRawMessage) }
+func (t *rawTypeSupport) AsCStruct(unsafe.Pointer, types.Message)  { panic(errRawMessage) }
+func (t *rawTypeSupport) AsGoStruct(types.Message, unsafe.Pointer) { panic(errRawMessage) }
+func (t *rawTypeSupport) TypeSupport() unsafe.Pointer              { return t.typeSupport }
+
+var (
+	rawTypeSupportsMutex sync.Mutex
+	// +checklocks:rawTypeSupportsMutex
+	rawTypeSupports = map[string]*rawTypeSupport{}
+)
+
+// loadRawTypeSupport loads the C type support of the message type with the
+// given name, e.g. "std_msgs/msg/String", from the shared library of its
+// package. The library is never unloaded.
+func loadRawTypeSupport(typeName string) (*rawTypeSupport, error) {
+	parts := strings.Split(typeName, "/")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("invalid message type: %q", typeName)
+	}
+	rawTypeSupportsMutex.Lock()
+	defer rawTypeSupportsMutex.Unlock()
+	if ts, ok := rawTypeSupports[typeName]; ok {
+		return ts, nil
+	}
+	libName := C.CString("lib" + parts[0] + "__rosidl_typesupport_c.so")
+	defer C.free(unsafe.Pointer(libName))
+	lib := C.dlopen(libName, C.RTLD_LAZY|C.RTLD_LOCAL)
+	if lib == nil {
+		return nil, fmt.Errorf("failed to load type support of %s: %s", typeName, C.GoString(C.dlerror()))
+	}
+	symbolName := C.CString(
+		"rosidl_typesupport_c__get_message_type_support_handle__" + strings.Join(parts, "__"),
+	)
+	defer C.free(unsafe.Pointer(symbolName))
+	getTypeSupport := C.dlsym(lib, symbolName)
+	if getTypeSupport == nil {
+		return nil, fmt.Errorf("failed to load type support of %s: %s", typeName, C.GoString(C.dlerror()))
+	}
+	ts := &rawTypeSupport{
+		typeSupport: unsafe.Pointer(C.call_get_type_support(getTypeSupport)),
+	}
+	rawTypeSupports[typeName] = ts
+	return ts, nil
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// ulogArtifactKind is the artifact kind of PX4 ULog files.
+const ulogArtifactKind = "ulog"
+
+const ulogExtension = ".ulg"
+
+// maxULogDuration is the longest duration of a ULog file considered valid.
+// Longer durations are caused by corrupted timestamps.
+const maxULogDuration = 24 * time.Hour
+
+// ulogStateFileName is the name of the file in the destination directory where
+// the modification time of the last collected ULog file is stored.
+const ulogStateFileName = "ulog_state.json"
+
+var ulogMagic = []byte{'U', 'L', 'o', 'g', 0x01, 0x12, 0x35}
+
+// px4LogPathRegex matches the paths of the files logged by PX4 when it knows
+// the time. The date and time in the path are in UTC.
+var px4LogPathRegex = regexp.MustCompile(`(\d{4}-\d{2}-\d{2})/(\d{2}_\d{2}_\d{2})\.ulg$`)
+
+// readULogDuration returns the time between the header of the ULog file read
+// from r and the last timestamped message. A truncated last message is
+// ignored, because PX4 may have been stopped while writing it.
+func readULogDuration(r io.Reader) (time.Duration, error) {
+	br := bufio.NewReader(r)
+	var header [16]byte
+	if _, err := io.ReadFull(br, header[:]); err != nil {
+		return 0, fmt.Errorf("failed to read header: %w", err)
+	}
+	if !bytes.Equal(header[:len(ulogMagic)], ulogMagic) {
+		return 0, errors.New("not a ULog file")
+	}
+	start := binary.LittleEndian.Uint64(header[8:])
+	last := start
+	var msgHeader [3]byte
+	var payload []byte
+	for {
+		_, err := io.ReadFull(br, msgHeader[:])
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				break
+			}
+			return 0, err
+		}
+		size := int(binary.LittleEndian.Uint16(msgHeader[:2]))
+		// The timestamp of data messages follows the message ID and the
+		// timestamps of logged strings follow the log level and tag.
+		offset := -1
+		switch msgHeader[2] {
+		case 'D':
+			offset = 2
+		case 'L':
+			offset = 1
+		case 'C':
+			offset = 3
+		}
+		if offset < 0 || size < offset+8 {
+			_, err = br.Discard(size)
+		} else {
+			if cap(payload) < size {
+				payload = make([]byte, size)
+			}
+			payload = payload[:size]
+			if _, err = io.ReadFull(br, payload); err == nil {
+				ts := binary.LittleEndian.Uint64(payload[offset:])
+				if ts > last && time.Duration(ts-start)*time.Microsecond <= maxULogDuration {
+					last = ts
+				}
+			}
+		}
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				break
+			}
+			return 0, err
+		}
+	}
+	return time.Duration(last-start) * time.Microsecond, nil
+}
+
+// ulogTimeRange returns the time range of the ULog file at path. The start
+// time is taken from the path if PX4 named the file after the time. Otherwise
+// the file is assumed to have been last modified when logging ended.
+func ulogTimeRange(path string, modTime time.Time) (start, end time.Time, err error) {
+	//#nosec G304 -- The path is found in the ULog directory.
+	f, err := os.Open(path)
+	if err != nil {
+		return start, end, err
+	}
+	defer f.Close()
+	duration, err := readULogDuration(f)
+	if err != nil {
+		return start, end, err
+	}
+	if m := px4LogPathRegex.FindStringSubmatch(filepath.ToSlash(path)); m != nil {
+		if start, err := time.Parse("2006-01-02/15_04_05", m[1]+"/"+m[2]); err == nil {
+			return start, start.Add(duration), nil
+		}
+	}
+	return modTime.Add(-duration), modTime, nil
+}
+
+// ulogUploadName returns the name of an uploaded ULog file without the
+// extensions added by processing. ULog files are named after their start time
+// and the session they are associated with.
+func ulogUploadName(manifest *bagManifest) string {
+	name := manifest.RecordStartTime.Format(timeFormat)
+	if manifest.Session != nil {
+		name += "_" + manifest.Session.ID
+	}
+	return name + ulogExtension
+}
+
+// ulogState is the state of the ULog collector stored across restarts.
+type ulogState struct {
+	// Collected is the latest modification time of the collected files.
+	Collected time.Time `json:"collected"`
+}
+
+// ulogCollector collects the ULog files written by PX4 to Dir and its
+// subdirectories as artifacts. Each file is associated with the session in
+// Sessions whose time range overlaps it most.
+type ulogCollector struct {
+	// Dir is polled for new files every PollInterval. Files are collected
+	// after their size and modification time haven't changed for SettleTime.
+	// Collected files are copied and left in Dir, where PX4 rotates them.
+	// Files not modified after the last collected file are skipped. When the
+	// collector runs for the first time, files which existed before it
+	// started are skipped, so that old logs are not uploaded.
+	Dir          string
+	PollInterval time.Duration
+	SettleTime   time.Duration
+	Sessions     *sessionHistory
+	Artifacts    *artifactCollector
+
+	// StatePath is the path of the file where the state is stored.
+	StatePath string
+
+	logger      logger
+	diagnostics *diagnosticsMonitor
+
+	// Files in Dir and the state. Accessed only by Run.
+	files map[string]*watchedFile
+	state ulogState
+}
+
+func newULogCollector(
+	dir string,
+	destDir string,
+	sessions *sessionHistory,
+	artifacts *artifactCollector,
+	logger logger,
+	diagnostics *diagnosticsMonitor,
+) *ulogCollector {
+	return &ulogCollector{
+		Dir:          dir,
+		PollInterval: 5 * time.Second,
+		// PX4 writes the log in bursts, so a file is considered complete only
+		// after a longer pause than other artifacts.
+		SettleTime:  30 * time.Second,
+		Sessions:    sessions,
+		Artifacts:   artifacts,
+		StatePath:   filepath.Join(destDir, ulogStateFileName),
+		logger:      logger,
+		diagnostics: diagnostics,
+		files:       make(map[string]*watchedFile),
+	}
+}
+
+// Run collects the ULog files in Dir until ctx is done.
+func (c *ulogCollector) Run(ctx context.Context) error {
+	if c.Dir == "" {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	if err := c.loadState(time.Now()); err != nil {
+		c.logger.Errorf("failed to load ULog collector state: %v", err)
+		c.diagnostics.ReportError("ulog", err)
+	}
+	ticker := time.NewTicker(c.PollInterval)
+	defer ticker.Stop()
+	for {
+		c.scan(time.Now())
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// scan collects the ULog files in Dir which haven't changed for SettleTime.
+func (c *ulogCollector) scan(now time.Time) {
+	found := make(map[string]bool)
+	err := filepath.WalkDir(c.Dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.EqualFold(filepath.Ext(path), ulogExtension) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil || !info.Mode().IsRegular() || !info.ModTime().After(c.state.Collected) {
+			return nil
+		}
+		found[path] = true
+		f := settledFile(c.files, path, info, now, c.SettleTime)
+		if f == nil {
+			return nil
+		}
+		ulog, err := c.collect(path, info, now)
+		if err != nil {
+			c.logger.Errorf("failed to collect ULog file '%s': %v", path, err)
+			c.diagnostics.ReportError("ulog", err)
+			f.failed = true
+			return nil
+		}
+		delete(c.files, path)
+		c.state.Collected = maxTime(c.state.Collected, info.ModTime())
+		if err := c.saveState(); err != nil {
+			c.logger.Errorf("failed to save ULog collector state: %v", err)
+			c.diagnostics.ReportError("ulog", err)
+		}
+		c.Artifacts.AddArtifact(ulog)
+		return nil
+	})
+	if err != nil {
+		c.logger.Errorf("failed to read ULog directory '%s': %v", c.Dir, err)
+		c.diagnostics.ReportError("ulog", err)
+	}
+	pruneWatchedFiles(c.files, found)
+}
+
+func (c *ulogCollector) collect(path string, info fs.FileInfo, now time.Time) (*bagMetadata, error) {
+	start, end, err := ulogTimeRange(path, info.ModTime())
+	if err != nil {
+		return nil, err
+	}
+	manifest := &bagManifest{
+		RecordStartTime: start.UTC(),
+		Artifact:        &artifactInfo{Kind: ulogArtifactKind, Name: filepath.Base(path)},
+	}
+	if session := c.Sessions.Find(start, end, now); session != nil {
+		manifest.Session = &bagSession{ID: session.ID, MissionID: session.MissionID, ULog: true}
+	}
+	return c.Artifacts.store(path, manifest, false)
+}
+
+// loadState loads the stored state. If it doesn't exist, the collector is run
+// for the first time and only files modified after now are collected.
+func (c *ulogCollector) loadState(now time.Time) error {
+	data, err := os.ReadFile(c.StatePath)
+	if errors.Is(err, os.ErrNotExist) {
+		c.state.Collected = now
+		return c.saveState()
+	} else if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &c.state)
+}
+
+func (c *ulogCollector) saveState() error {
+	data, err := json.Marshal(&c.state)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(c.StatePath, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type ulogBuilder struct {
+	bytes.Buffer
+}
+
+func newULogBuilder(start uint64) *ulogBuilder {
+	b := &ulogBuilder{}
+	b.Write(ulogMagic)
+	b.WriteByte(1)
+	binary.Write(b, binary.LittleEndian, start)
+	return b
+}
+
+func (b *ulogBuilder) message(typ byte, payload []byte) {
+	binary.Write(b, binary.LittleEndian, uint16(len(payload)))
+	b.WriteByte(typ)
+	b.Write(payload)
+}
+
+func (b *ulogBuilder) data(timestamp uint64) {
+	payload := make([]byte, 14)
+	binary.LittleEndian.PutUint16(payload, 3)
+	binary.LittleEndian.PutUint64(payload[2:], timestamp)
+	b.message('D', payload)
+}
+
+func TestULog(t *testing.T) {
+	Convey("Scenario: the duration of a ULog file is read from its messages", t, func() {
+		b := newULogBuilder(1_000_000)
+		b.message('F', []byte("sensor_combined:uint64_t timestamp;float x;"))
+		b.data(2_000_000)
+		logged := make([]byte, 13)
+		logged[0] = '6'
+		binary.LittleEndian.PutUint64(logged[1:], 4_500_000)
+		b.message('L', logged)
+		b.data(3_000_000)
+		// Corrupted timestamps are ignored.
+		b.data(1 << 60)
+		duration, err := readULogDuration(bytes.NewReader(b.Bytes()))
+		So(err, ShouldBeNil)
+		So(duration, ShouldEqual, 3500*time.Millisecond)
+
+		Convey("A truncated last message is ignored", func() {
+			b.data(10_000_000)
+			data := b.Bytes()[:b.Len()-4]
+			duration, err := readULogDuration(bytes.NewReader(data))
+			So(err, ShouldBeNil)
+			So(duration, ShouldEqual, 3500*time.Millisecond)
+		})
+		Convey("Other files are rejected", func() {
+			_, err := readULogDuration(bytes.NewReader([]byte("not a ULog file at all")))
+			So(err, ShouldBeError)
+		})
+	})
+	Convey("Scenario: the start time is taken from the path of the file if possible", t, func() {
+		root := t.TempDir()
+		b := newULogBuilder(0)
+		b.data(60_000_000)
+		modTime := time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC)
+		named := filepath.Join(root, "2024-05-01", "12_00_00.ulg")
+		So(os.Mkdir(filepath.Dir(named), 0o700), ShouldBeNil)
+		So(os.WriteFile(named, b.Bytes(), 0o600), ShouldBeNil)
+		start, end, err := ulogTimeRange(named, modTime)
+		So(err, ShouldBeNil)
+		So(start, ShouldEqual, time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+		So(end, ShouldEqual, time.Date(2024, 5, 1, 12, 1, 0, 0, time.UTC))
+		unnamed := filepath.Join(root, "log001.ulg")
+		So(os.WriteFile(unnamed, b.Bytes(), 0o600), ShouldBeNil)
+		start, end, err = ulogTimeRange(unnamed, modTime)
+		So(err, ShouldBeNil)
+		So(start, ShouldEqual, modTime.Add(-time.Minute))
+		So(end, ShouldEqual, modTime)
+	})
+	Convey("Scenario: ULog files are associated with the session overlapping them most", t, func() {
+		root := t.TempDir()
+		t0 := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+		history := newSessionHistory(root)
+		So(history.Started("s1", "m1", t0), ShouldBeNil)
+		So(history.Ended("s1", t0.Add(10*time.Minute)), ShouldBeNil)
+		So(history.Started("s2", "m2", t0.Add(11*time.Minute)), ShouldBeNil)
+
+		So(history.Find(t0.Add(-time.Hour), t0.Add(-time.Minute), t0), ShouldBeNil)
+		So(history.Find(t0.Add(5*time.Minute), t0.Add(12*time.Minute), t0.Add(time.Hour)).ID, ShouldEqual, "s1")
+		So(history.Find(t0.Add(9*time.Minute), t0.Add(20*time.Minute), t0.Add(time.Hour)).ID, ShouldEqual, "s2")
+
+		Convey("Sessions which hadn't ended are ended when the history is loaded", func() {
+			loaded := newSessionHistory(root)
+			So(loaded.Load(t0.Add(15*time.Minute)), ShouldBeNil)
+			So(loaded.Find(t0.Add(20*time.Minute), t0.Add(30*time.Minute), t0.Add(time.Hour)), ShouldBeNil)
+			So(loaded.Find(t0.Add(12*time.Minute), t0.Add(30*time.Minute), t0.Add(time.Hour)).MissionID, ShouldEqual, "m2")
+		})
+		Convey("Settled files are collected with their session", func() {
+			ulogDir := filepath.Join(root, "px4")
+			path := filepath.Join(ulogDir, "2024-05-01", "12_02_00.ulg")
+			So(os.MkdirAll(filepath.Dir(path), 0o700), ShouldBeNil)
+			b := newULogBuilder(0)
+			b.data(60_000_000)
+			So(os.WriteFile(path, b.Bytes(), 0o600), ShouldBeNil)
+			var collected []*bagMetadata
+			c := newULogCollector(ulogDir, root, history, &artifactCollector{
+				Dir:         filepath.Join(root, artifactsDirName),
+				AddArtifact: func(a *bagMetadata) { collected = append(collected, a) },
+				logger:      fakeLogger{},
+			}, fakeLogger{}, nil)
+			now := time.Now()
+			c.scan(now)
+			So(collected, ShouldBeEmpty)
+			c.scan(now.Add(c.SettleTime))
+			So(collected, ShouldHaveLength, 1)
+			_, err := os.Stat(path)
+			So(err, ShouldBeNil)
+			c.scan(now.Add(2 * c.SettleTime))
+			So(collected, ShouldHaveLength, 1)
+			manifest, err := loadBagManifest(collected[0])
+			So(err, ShouldBeNil)
+			So(manifest.RecordStartTime, ShouldEqual, t0.Add(2*time.Minute))
+			So(manifest.Artifact, ShouldResemble, &artifactInfo{Kind: ulogArtifactKind, Name: "12_02_00.ulg"})
+			So(manifest.Session, ShouldResemble, &bagSession{ID: "s1", MissionID: "m1", ULog: true})
+			So(uploadName(collected[0], manifest), ShouldEqual, t0.Add(2*time.Minute).Format(timeFormat)+"_s1.ulg")
+
+			Convey("Collected files are not collected again after a restart", func() {
+				restarted := newULogCollector(ulogDir, root, history, c.Artifacts, fakeLogger{}, nil)
+				So(restarted.loadState(now.Add(time.Hour)), ShouldBeNil)
+				restarted.scan(now)
+				restarted.scan(now.Add(restarted.SettleTime))
+				So(collected, ShouldHaveLength, 1)
+			})
+		})
+		Convey("Files which existed when the collector was first started are skipped", func() {
+			ulogDir := filepath.Join(root, "px4")
+			path := filepath.Join(ulogDir, "old.ulg")
+			So(os.MkdirAll(ulogDir, 0o700), ShouldBeNil)
+			So(os.WriteFile(path, newULogBuilder(0).Bytes(), 0o600), ShouldBeNil)
+			var collected []*bagMetadata
+			c := newULogCollector(ulogDir, root, history, &artifactCollector{
+				Dir:         filepath.Join(root, artifactsDirName),
+				AddArtifact: func(a *bagMetadata) { collected = append(collected, a) },
+				logger:      fakeLogger{},
+			}, fakeLogger{}, nil)
+			now := time.Now().Add(time.Second)
+			So(c.loadState(now), ShouldBeNil)
+			c.scan(now)
+			c.scan(now.Add(c.SettleTime))
+			So(collected, ShouldBeEmpty)
+
+			So(os.Chtimes(path, now.Add(time.Second), now.Add(time.Second)), ShouldBeNil)
+			c.scan(now.Add(2 * c.SettleTime))
+			c.scan(now.Add(3 * c.SettleTime))
+			So(collected, ShouldHaveLength, 1)
+		})
+	})
+}
@@ -1,25 +1,37 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"compress/gzip"
 	"context"
-	"database/sql"
+	"crypto/rsa"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v4"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+	"github.com/tiiuae/mission-data-recorder/internal/rosbag"
 	"github.com/ulikunitz/xz"
+	"gopkg.in/yaml.v3"
 )
 
 var errEmptyBag = errors.New("bag is empty")
 
-var validBagExtensions = []string{".gz", ".xz"}
+const encryptedBagExtension = ".enc"
+
+var validBagExtensions = []string{
+	".gz", ".xz", ".zst", ".lz4", recorderCompressedBagExtension, encryptedBagExtension,
+}
 
 type compressionMode string
 
@@ -27,8 +39,24 @@ const (
 	compressionNone compressionMode = "none"
 	compressionGzip compressionMode = "gzip"
 	compressionXz   compressionMode = "xz"
+	compressionZstd compressionMode = "zstd"
+	compressionLz4  compressionMode = "lz4"
+	compressionAuto compressionMode = "auto"
 )
 
+// compressionLevels contains the valid compression levels of the compression
+// modes supporting them. Level 0 always selects the default level.
+var compressionLevels = map[compressionMode]struct{ min, max int }{
+	compressionGzip: {gzip.BestSpeed, gzip.BestCompression},
+	compressionZstd: {1, 22},
+	compressionLz4:  {1, 9},
+}
+
+var lz4Levels = []lz4.CompressionLevel{
+	lz4.Level1, lz4.Level2, lz4.Level3, lz4.Level4, lz4.Level5,
+	lz4.Level6, lz4.Level7, lz4.Level8, lz4.Level9,
+}
+
 func (m compressionMode) String() string {
 	return string(m)
 }
@@ -55,11 +83,44 @@ func (m compressionMode) Parse(val interface{}) (interface{}, error) {
 			return compressionGzip, nil
 		case "xz":
 			return compressionXz, nil
+		case "zstd":
+			return compressionZstd, nil
+		case "lz4":
+			return compressionLz4, nil
+		case "auto":
+			return compressionAuto, nil
 		}
 	}
 	return nil, fmt.Errorf("invalid compression mode: %v", val)
 }
 
+func (m *compressionMode) UnmarshalYAML(val *yaml.Node) error {
+	var decoded interface{}
+	if err := val.Decode(&decoded); err != nil {
+		return err
+	}
+	mode, err := m.Parse(decoded)
+	if err != nil {
+		return err
+	}
+	*m = mode.(compressionMode)
+	return nil
+}
+
+func (m compressionMode) validateLevel(level int) error {
+	if level == 0 {
+		return nil
+	}
+	levels, ok := compressionLevels[m]
+	if !ok {
+		return fmt.Errorf("compression mode %s doesn't support compression levels", m)
+	}
+	if level < levels.min || level > levels.max {
+		return fmt.Errorf("compression level of %s must be between %d and %d", m, levels.min, levels.max)
+	}
+	return nil
+}
+
 type modifierFunc = func(io.Writer) (io.WriteCloser, error)
 
 type pipe struct {
@@ -113,39 +174,149 @@ func (p *pipe) Close() error {
 }
 
 type fileUploader struct {
-	HTTPClient      *http.Client
-	SigningMethod   jwt.SigningMethod
-	SigningKey      interface{}
-	TokenLifetime   time.Duration
-	DeviceID        string
-	TenantID        string
-	CompressionMode compressionMode
-	BackendURL      string
+	HTTPClient       *http.Client
+	SigningMethod    jwt.SigningMethod
+	SigningKey       interface{}
+	TokenLifetime    time.Duration
+	DeviceID         string
+	TenantID         string
+	CompressionMode  compressionMode
+	CompressionLevel int
+	BackendURL       string
+	// ChunkSize is the size of the chunks of resumable uploads. If zero,
+	// defaultUploadChunkSize is used.
+	ChunkSize int64
+
+	// If non-nil, bags are encrypted to this key before uploading.
+	EncryptionKey *rsa.PublicKey
+
+	// Used to select the compression mode if CompressionMode is
+	// compressionAuto. The measured upload rates are recorded to it.
+	CompressionSelector *compressionSelector
+
+	// If non-nil, errors which don't fail an upload are logged to Logger.
+	Logger logger
+}
+
+// bagManifest is sent to the backend when requesting an upload URL. It
+// describes how the uploaded file has been processed. If a bag is processed
+// before it is queued for uploading, its manifest is stored next to it, because
+// the information can't be recovered from the processed file.
+type bagManifest struct {
+	RecordStartTime time.Time         `json:"recordStartTime"`
+	Encryption      *encryptionHeader `json:"encryption,omitempty"`
+
+	// Session and Tags are set when the bag is uploaded, because the last bag
+	// of a session is known only after the recorder has stopped and tags can
+	// be changed during the session.
+	Session *bagSession       `json:"session,omitempty"`
+	Tags    map[string]string `json:"tags,omitempty"`
+
+	// Size and SHA256 describe the uploaded file. They are known only for
+	// files which are uploaded as they are.
+	Size   int64  `json:"size,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+
+	// Resumable is set when requesting the URL of a resumable upload. The
+	// file is sent to it in chunks with a Content-Range header, and the
+	// number of bytes received is queried with an empty chunk after an
+	// interruption.
+	Resumable bool `json:"resumable,omitempty"`
+
+	// Artifact is set for artifacts. RecordStartTime of an artifact is the
+	// modification time of its original file or the start time of a ULog
+	// file.
+	Artifact *artifactInfo `json:"artifact,omitempty"`
+}
+
+func manifestPath(bag *bagMetadata) string {
+	return bag.path + ".manifest.json"
+}
+
+// loadBagManifest returns the stored manifest of bag or an empty manifest if
+// it doesn't exist.
+func loadBagManifest(bag *bagMetadata) (*bagManifest, error) {
+	var manifest bagManifest
+	data, err := os.ReadFile(manifestPath(bag))
+	if errors.Is(err, os.ErrNotExist) {
+		return &manifest, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+	if err = json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest: %w", err)
+	}
+	return &manifest, nil
+}
+
+func saveBagManifest(bag *bagMetadata, manifest *bagManifest) error {
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(manifestPath(bag), func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// writeFileAtomic writes a file by calling write with a temporary file which is
+// renamed to path after write returns successfully.
+func writeFileAtomic(path string, write func(io.Writer) error) (err error) {
+	tmpPath := path + ".tmp"
+	//#nosec G304 -- The path is constructed by this program.
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(tmpPath)
+		}
+	}()
+	if err = write(f); err != nil {
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
 }
 
-func (u *fileUploader) WithCompression(mode compressionMode) uploaderInterface {
+func (u *fileUploader) WithCompression(mode compressionMode, level int) uploaderInterface {
 	x := *u
 	x.CompressionMode = mode
+	x.CompressionLevel = level
 	return &x
 }
 
-func (u *fileUploader) createToken(bagName string) (string, error) {
-	type jwtClaims struct {
-		DeviceID string `json:"deviceId"`
-		TenantID string `json:"tenantId"`
-		BagName  string `json:"bagName"`
-		jwt.RegisteredClaims
-	}
+type tokenClaims struct {
+	DeviceID   string `json:"deviceId"`
+	TenantID   string `json:"tenantId"`
+	BagName    string `json:"bagName,omitempty"`
+	SessionID  string `json:"sessionId,omitempty"`
+	MissionID  string `json:"missionId,omitempty"`
+	SplitIndex *int   `json:"splitIndex,omitempty"`
+	// SessionStart and SessionEnd are set on the first and last uploaded bag
+	// of a session as described in bagSession.
+	SessionStart bool `json:"sessionStart,omitempty"`
+	SessionEnd   bool `json:"sessionEnd,omitempty"`
+	jwt.RegisteredClaims
+}
+
+func (u *fileUploader) createToken(claims *tokenClaims) (string, error) {
 	now := time.Now()
-	token := jwt.NewWithClaims(u.SigningMethod, &jwtClaims{
-		DeviceID: u.DeviceID,
-		TenantID: u.TenantID,
-		BagName:  bagName,
-		RegisteredClaims: jwt.RegisteredClaims{
-			IssuedAt:  jwt.NewNumericDate(now),
-			ExpiresAt: jwt.NewNumericDate(now.Add(u.TokenLifetime)),
-		},
-	})
+	claims.DeviceID = u.DeviceID
+	claims.TenantID = u.TenantID
+	claims.RegisteredClaims = jwt.RegisteredClaims{
+		IssuedAt:  jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(now.Add(u.TokenLifetime)),
+	}
+	token := jwt.NewWithClaims(u.SigningMethod, claims)
 	return token.SignedString(u.SigningKey)
 }
 
@@ -155,36 +326,78 @@ func wrapErr(format string, err *error, a ...interface{}) {
 	}
 }
 
-func (u *fileUploader) requestUploadURL(ctx context.Context, bagName, endpoint string) (_ string, err error) {
+func (u *fileUploader) requestUploadURL(
+	ctx context.Context, bagName, endpoint string, manifest *bagManifest,
+) (_ string, err error) {
 	defer wrapErr("failed to request upload URL: %w", &err)
-	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, nil)
+	claims := &tokenClaims{BagName: bagName}
+	if manifest.Session != nil {
+		claims.SessionID = manifest.Session.ID
+		claims.MissionID = manifest.Session.MissionID
+		claims.SplitIndex = &manifest.Session.SplitIndex
+		claims.SessionStart = manifest.Session.Start
+		claims.SessionEnd = manifest.Session.End
+	}
+	resp, err := u.postJSON(ctx, endpoint, claims, manifest)
 	if err != nil {
-		return "", fmt.Errorf("failed to create request: %w", err)
+		return "", err
 	}
-	token, err := u.createToken(bagName)
+	return resp.URL, nil
+}
+
+// CompleteSession notifies the backend that all bags of session have been
+// uploaded.
+func (u *fileUploader) CompleteSession(ctx context.Context, session *sessionInfo) (err error) {
+	defer wrapErr("failed to send session completion: %w", &err)
+	_, err = u.postJSON(ctx, u.BackendURL+"/session-complete", &tokenClaims{SessionID: session.ID, MissionID: session.MissionID}, session)
+	return err
+}
+
+type backendResponse struct {
+	URL   string
+	Error string
+}
+
+// postJSON sends body encoded as JSON to endpoint authenticated with a token
+// containing claims.
+func (u *fileUploader) postJSON(
+	ctx context.Context, endpoint string, claims *tokenClaims, body interface{},
+) (*backendResponse, error) {
+	reqBody, err := json.Marshal(body)
 	if err != nil {
-		return "", fmt.Errorf("failed to create token: %w", err)
+		return nil, fmt.Errorf("failed to encode request: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewReader(reqBody))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	token, err := u.createToken(claims)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create token: %w", err)
 	}
 	req.Header.Add("Authorization", "Bearer "+token)
 	resp, err := u.HTTPClient.Do(req)
 	if err != nil {
-		return "", fmt.Errorf("failed to send request: %w", err)
+		return nil, fmt.Errorf("failed to send request: %w", err)
 	}
 	defer resp.Body.Close()
-	body, err := io.ReadAll(resp.Body)
+	respBody, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return "", fmt.Errorf("failed to read response body: %w", err)
+		return nil, fmt.Errorf("failed to read response body: %w", err)
 	}
-	var respData struct{ URL, Error string }
-	if err := json.Unmarshal(body, &respData); err != nil {
-		return "", fmt.Errorf("response is invalid JSON: %w: %q", err, body)
+	var respData backendResponse
+	if err := json.Unmarshal(respBody, &respData); err != nil {
+		return nil, fmt.Errorf("response is invalid JSON: %w: %q", err, respBody)
 	}
 	if resp.StatusCode != 200 {
-		return "", fmt.Errorf("request failed with code %d: %s", resp.StatusCode, respData.Error)
+		return nil, fmt.Errorf("request failed with code %d: %s", resp.StatusCode, respData.Error)
 	}
-	return respData.URL, nil
+	return &respData, nil
 }
 
+// uploadFile uploads file to url. The size of the file is unknown because it
+// is processed while uploading, so it is sent using chunked transfer encoding.
 func (u *fileUploader) uploadFile(ctx context.Context, url string, file io.Reader) (err error) {
 	defer wrapErr("failed to upload file: %w", &err)
 	req, err := http.NewRequestWithContext(ctx, "PUT", url, file)
@@ -206,14 +419,22 @@ func (u *fileUploader) uploadFile(ctx context.Context, url string, file io.Reade
 	return nil
 }
 
-func (u *fileUploader) withCompression(src io.Reader) (rc io.ReadCloser, ext string, err error) {
-	var modifier modifierFunc
-	switch u.CompressionMode {
+// compressionModifier returns a modifierFunc compressing data using mode at
+// level and the file extension of the compressed data. If mode is
+// compressionNone, the returned modifierFunc is nil.
+func compressionModifier(mode compressionMode, level int) (modifier modifierFunc, ext string, err error) {
+	if err = mode.validateLevel(level); err != nil {
+		return nil, "", err
+	}
+	switch mode {
 	case compressionNone:
-		return io.NopCloser(src), "", nil
+		return nil, "", nil
 	case compressionGzip:
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
 		modifier = func(w io.Writer) (io.WriteCloser, error) {
-			return gzip.NewWriter(w), nil
+			return gzip.NewWriterLevel(w, level)
 		}
 		ext = ".gz"
 	case compressionXz:
@@ -221,48 +442,271 @@ func (u *fileUploader) withCompression(src io.Reader) (rc io.ReadCloser, ext str
 			return xz.NewWriter(w)
 		}
 		ext = ".xz"
+	case compressionZstd:
+		var opts []zstd.EOption
+		if level != 0 {
+			opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+		}
+		modifier = func(w io.Writer) (io.WriteCloser, error) {
+			return zstd.NewWriter(w, opts...)
+		}
+		ext = ".zst"
+	case compressionLz4:
+		modifier = func(w io.Writer) (io.WriteCloser, error) {
+			zw := lz4.NewWriter(w)
+			if level == 0 {
+				return zw, nil
+			}
+			return zw, zw.Apply(lz4.CompressionLevelOption(lz4Levels[level-1]))
+		}
+		ext = ".lz4"
 	default:
-		return nil, "", fmt.Errorf("invalid compression mode: %#v", u.CompressionMode)
+		return nil, "", fmt.Errorf("invalid compression mode: %#v", mode)
 	}
-	return newPipe(src, modifier), ext, err
+	return modifier, ext, nil
+}
+
+func withCompression(src io.Reader, mode compressionMode, level int) (rc io.ReadCloser, ext string, err error) {
+	modifier, ext, err := compressionModifier(mode, level)
+	if err != nil {
+		return nil, "", err
+	}
+	if modifier == nil {
+		return io.NopCloser(src), "", nil
+	}
+	return newPipe(src, modifier), ext, nil
+}
+
+func (u *fileUploader) withEncryption(src io.Reader) (rc io.ReadCloser, ext string, header *encryptionHeader, err error) {
+	if u.EncryptionKey == nil {
+		return io.NopCloser(src), "", nil, nil
+	}
+	header, key, err := newEncryptionHeader(u.EncryptionKey)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	modifier := func(w io.Writer) (io.WriteCloser, error) {
+		return newEncryptingWriter(w, header, key)
+	}
+	return newPipe(src, modifier), ".enc", header, nil
 }
 
 func (u *fileUploader) UploadBag(ctx context.Context, bag *bagMetadata) error {
-	f, err := os.Open(bag.path)
+	manifest, err := loadBagManifest(bag)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-	compressed, ext, err := u.withCompression(f)
+	if manifest.RecordStartTime.IsZero() {
+		if manifest.RecordStartTime, err = getRecordStartTime(ctx, bag.filePath()); err != nil {
+			return err
+		}
+	}
+	f, err := os.Open(bag.filePath())
 	if err != nil {
 		return err
 	}
-	defer compressed.Close()
-	recordStartTime, err := getRecordStartTime(ctx, bag.path)
+	defer f.Close()
+	var (
+		file  io.Reader = f
+		ext             = bag.ext
+		mode            = compressionNone
+		level int
+	)
+	if bag.ext == "" {
+		if mode, level, err = u.compressionFor(f); err != nil {
+			return err
+		}
+	}
+	// Bags which have been encrypted at rest and bags which are not processed
+	// at all are uploaded as they are, so their uploads can be resumed. Bags
+	// compressed at rest or by the recorder are still encrypted while they are
+	// uploaded.
+	encrypt := u.EncryptionKey != nil && !bag.isEncrypted()
+	resumable := !encrypt && (bag.ext != "" || mode == compressionNone)
+	if resumable {
+		info, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		if manifest.SHA256 == "" || manifest.Size != info.Size() {
+			if err = fileDigest(bag.filePath(), manifest); err != nil {
+				return err
+			}
+		}
+	} else {
+		compressed, compExt, err := withCompression(file, mode, level)
+		if err != nil {
+			return err
+		}
+		defer compressed.Close()
+		encrypted, encExt, header, err := u.withEncryption(compressed)
+		if err != nil {
+			return err
+		}
+		defer encrypted.Close()
+		file = encrypted
+		ext += compExt + encExt
+		manifest.Encryption = header
+	}
+	// Artifacts don't belong to sessions. The sessions of ULog files are set
+	// when they are collected.
+	if !bag.artifact {
+		if manifest.Session, manifest.Tags, err = getBagSession(bag); err != nil {
+			return err
+		}
+	}
+	if manifest.Session != nil && manifest.Session.Start {
+		name := manifest.RecordStartTime.Format(timeFormat) + ".snapshot.json"
+		// The session markers are set only on bags.
+		session := *manifest.Session
+		session.Start, session.End = false, false
+		if err = u.uploadSnapshot(ctx, sessionDir(bag), name, &bagManifest{
+			RecordStartTime: manifest.RecordStartTime,
+			Session:         &session,
+			Tags:            manifest.Tags,
+		}); err != nil && u.Logger != nil {
+			// The snapshot is left in the session directory and uploaded on
+			// its own when the session is completed.
+			u.Logger.Errorf("session snapshot: %v", err)
+		}
+	}
+	name := uploadName(bag, manifest) + ext
+	if resumable {
+		return u.uploadResumable(ctx, bag, f, name, manifest)
+	}
+	uploadURL, err := u.requestUploadURL(ctx, name, u.BackendURL+"/generate-url", manifest)
 	if err != nil {
 		return err
 	}
-	name := recordStartTime.Format(timeFormat) + ".db3" + ext
-	uploadURL, err := u.requestUploadURL(ctx, name, u.BackendURL+"/generate-url")
+	timer := &uploadTimer{r: file}
+	start := time.Now()
+	if err = u.uploadFile(ctx, uploadURL, timer); err != nil {
+		return err
+	}
+	u.CompressionSelector.RecordUpload(timer.bytes, time.Since(start)-timer.readTime)
+	return nil
+}
+
+// uploadName returns the name of the uploaded file of bag without the
+// extensions added by processing.
+func uploadName(bag *bagMetadata, manifest *bagManifest) string {
+	if manifest.Artifact != nil && manifest.Artifact.Kind == ulogArtifactKind {
+		return ulogUploadName(manifest)
+	}
+	name := manifest.RecordStartTime.Format(timeFormat)
+	if manifest.Artifact != nil {
+		return name + "_" + manifest.Artifact.Name
+	}
+	return name + bag.storageExt()
+}
+
+// UploadSnapshot uploads the snapshot of session if it is still in dir. The
+// snapshot is normally uploaded with the first bag of the session, so it is
+// left only if no bag of the session was uploaded or the upload with the first
+// bag failed.
+func (u *fileUploader) UploadSnapshot(ctx context.Context, dir string, session *sessionInfo) error {
+	manifest := &bagManifest{
+		Session: &bagSession{ID: session.ID, MissionID: session.MissionID},
+		Tags:    session.Tags,
+	}
+	// The session ID is the start time of the session.
+	if start, err := time.Parse(timeFormat, session.ID); err == nil {
+		manifest.RecordStartTime = start
+	}
+	return u.uploadSnapshot(ctx, dir, session.ID+".snapshot.json", manifest)
+}
+
+// uploadSnapshot uploads the snapshot of the session in dir with name and
+// manifest if it exists. The snapshot is removed after it has been uploaded.
+func (u *fileUploader) uploadSnapshot(ctx context.Context, dir, name string, manifest *bagManifest) error {
+	path := snapshotFilePath(dir)
+	//#nosec G304 -- The path is constructed by this program.
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	file, ext, header, err := u.withEncryption(f)
 	if err != nil {
 		return err
 	}
-	return u.uploadFile(ctx, uploadURL, compressed)
+	defer file.Close()
+	manifest.Encryption = header
+	uploadURL, err := u.requestUploadURL(ctx, name+ext, u.BackendURL+"/generate-url", manifest)
+	if err != nil {
+		return fmt.Errorf("failed to upload session snapshot: %w", err)
+	}
+	if err = u.uploadFile(ctx, uploadURL, file); err != nil {
+		return fmt.Errorf("failed to upload session snapshot: %w", err)
+	}
+	return removeSnapshot(dir)
+}
+
+func (u *fileUploader) compressionFor(f *os.File) (compressionMode, int, error) {
+	if u.CompressionMode != compressionAuto {
+		return u.CompressionMode, u.CompressionLevel, nil
+	}
+	if u.CompressionSelector == nil {
+		return compressionNone, 0, nil
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return "", 0, err
+	}
+	c, err := u.CompressionSelector.Select(f, info.Size())
+	if err != nil {
+		return "", 0, err
+	}
+	return c.Mode, c.Level, nil
 }
 
 func getRecordStartTime(ctx context.Context, bagPath string) (time.Time, error) {
-	db, err := sql.Open("sqlite3", bagPath)
+	if strings.HasSuffix(bagPath, recorderCompressedBagExtension) {
+		return getCompressedStartTime(bagPath)
+	}
+	if filepath.Ext(bagPath) == storageExtensions[storageMCAP] {
+		return getMCAPStartTime(bagPath)
+	}
+	return getSQLiteStartTime(ctx, bagPath)
+}
+
+// getCompressedStartTime returns the start time of a bag compressed by ros bag
+// record. The bag is decompressed while it is read, so that the plaintext is
+// never written to disk when bags are encrypted at rest.
+func getCompressedStartTime(bagPath string) (time.Time, error) {
+	//#nosec G304 -- The path is constructed by this program.
+	f, err := os.Open(bagPath)
 	if err != nil {
 		return time.Time{}, err
 	}
-	defer db.Close()
-	var timestamp int64
-	err = db.QueryRowContext(ctx, "SELECT timestamp FROM messages ORDER BY timestamp LIMIT 1").Scan(&timestamp)
+	defer f.Close()
+	r, err := zstd.NewReader(f)
 	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return time.Time{}, errEmptyBag
-		}
 		return time.Time{}, err
 	}
-	return time.Unix(0, timestamp).UTC(), nil
+	defer r.Close()
+	bagPath = strings.TrimSuffix(bagPath, recorderCompressedBagExtension)
+	if filepath.Ext(bagPath) == storageExtensions[storageMCAP] {
+		return readMCAPStartTime(bufio.NewReader(r))
+	}
+	start, err := rosbag.ScanStartTime(r)
+	if errors.Is(err, rosbag.ErrEmpty) {
+		return time.Time{}, errEmptyBag
+	}
+	return start, err
+}
+
+func getSQLiteStartTime(ctx context.Context, bagPath string) (time.Time, error) {
+	bag, err := rosbag.Open(bagPath)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer bag.Close()
+	start, err := bag.StartTime(ctx)
+	if errors.Is(err, rosbag.ErrEmpty) {
+		return time.Time{}, errEmptyBag
+	}
+	return start, err
 }
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/ulikunitz/xz"
+)
+
+func TestCompression(t *testing.T) {
+	data := []byte(strings.Repeat("mission data recorder ", 10000))
+	decompressors := map[string]func(io.Reader) (io.Reader, error){
+		"": func(r io.Reader) (io.Reader, error) { return r, nil },
+		".gz": func(r io.Reader) (io.Reader, error) {
+			return gzip.NewReader(r)
+		},
+		".xz": func(r io.Reader) (io.Reader, error) {
+			return xz.NewReader(r)
+		},
+		".zst": func(r io.Reader) (io.Reader, error) {
+			return zstd.NewReader(r)
+		},
+		".lz4": func(r io.Reader) (io.Reader, error) {
+			return lz4.NewReader(r), nil
+		},
+	}
+	Convey("Scenario: all compression modes and levels can be decompressed", t, func() {
+		for _, mode := range []compressionMode{
+			compressionNone, compressionGzip, compressionXz, compressionZstd, compressionLz4,
+		} {
+			levels := []int{0}
+			if l, ok := compressionLevels[mode]; ok {
+				levels = append(levels, l.min, l.max)
+			}
+			for _, level := range levels {
+				compressed, ext, err := withCompression(bytes.NewReader(data), mode, level)
+				So(err, ShouldBeNil)
+				decompress, ok := decompressors[ext]
+				So(ok, ShouldBeTrue)
+				r, err := decompress(compressed)
+				So(err, ShouldBeNil)
+				decompressed, err := io.ReadAll(r)
+				So(err, ShouldBeNil)
+				So(compressed.Close(), ShouldBeNil)
+				So(bytes.Equal(decompressed, data), ShouldBeTrue)
+			}
+		}
+	})
+	Convey("Scenario: invalid compression levels are rejected", t, func() {
+		So(compressionNone.validateLevel(1), ShouldNotBeNil)
+		So(compressionXz.validateLevel(1), ShouldNotBeNil)
+		So(compressionGzip.validateLevel(10), ShouldNotBeNil)
+		So(compressionZstd.validateLevel(-1), ShouldNotBeNil)
+		So(compressionLz4.validateLevel(9), ShouldBeNil)
+	})
+}
+
+func TestTokenClaims(t *testing.T) {
+	Convey("Scenario: the session markers of a bag are set in the token claims", t, func() {
+		var claims []tokenClaims
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var c tokenClaims
+			token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if _, err := jwt.ParseWithClaims(token, &c, func(*jwt.Token) (interface{}, error) {
+				return []byte("key"), nil
+			}); err != nil {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			claims = append(claims, c)
+			fmt.Fprintf(w, `{"URL": "http://%s/upload"}`, r.Host)
+		}))
+		defer server.Close()
+		u := &fileUploader{
+			HTTPClient:    server.Client(),
+			SigningMethod: jwt.SigningMethodHS256,
+			SigningKey:    []byte("key"),
+			TokenLifetime: time.Minute,
+			BackendURL:    server.URL,
+			DeviceID:      "drone",
+		}
+		for _, session := range []*bagSession{
+			{ID: "s", MissionID: "m", SplitIndex: 1, Start: true},
+			{ID: "s", MissionID: "m", SplitIndex: 2},
+			{ID: "s", MissionID: "m", SplitIndex: 3, End: true},
+		} {
+			_, err := u.requestUploadURL(context.Background(), "bag", server.URL, &bagManifest{Session: session})
+			So(err, ShouldBeNil)
+		}
+		So(claims, ShouldHaveLength, 3)
+		for i, c := range claims {
+			So(c.DeviceID, ShouldEqual, "drone")
+			So(c.BagName, ShouldEqual, "bag")
+			So(c.SessionID, ShouldEqual, "s")
+			So(c.MissionID, ShouldEqual, "m")
+			So(*c.SplitIndex, ShouldEqual, i+1)
+		}
+		So(claims[0].SessionStart, ShouldBeTrue)
+		So(claims[0].SessionEnd, ShouldBeFalse)
+		So(claims[1].SessionStart || claims[1].SessionEnd, ShouldBeFalse)
+		So(claims[2].SessionStart, ShouldBeFalse)
+		So(claims[2].SessionEnd, ShouldBeTrue)
+	})
+}
+
+func TestSnapshotUploadFailure(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	Convey("Scenario: a failed snapshot upload doesn't fail the upload of the first bag", t, func() {
+		dir := t.TempDir()
+		bag := &bagMetadata{path: filepath.Join(dir, "bag_0.db3"), ext: ".zst"}
+		So(os.WriteFile(bag.filePath(), []byte("compressed bag"), 0o600), ShouldBeNil)
+		So(saveBagManifest(bag, &bagManifest{RecordStartTime: time.Now()}), ShouldBeNil)
+		So(os.WriteFile(snapshotFilePath(dir), []byte("{}"), 0o600), ShouldBeNil)
+		backend := &encryptionBackend{failSnapshots: true}
+		server := httptest.NewServer(backend)
+		defer server.Close()
+		// Encrypted bags are uploaded in a single request.
+		u := &fileUploader{
+			HTTPClient:    server.Client(),
+			SigningMethod: jwt.SigningMethodHS256,
+			SigningKey:    []byte("key"),
+			TokenLifetime: time.Minute,
+			BackendURL:    server.URL,
+			EncryptionKey: &priv.PublicKey,
+			Logger:        fakeLogger{},
+		}
+		So(u.UploadBag(context.Background(), bag), ShouldBeNil)
+		So(backend.name, ShouldEndWith, ".db3.zst.enc")
+		_, err := os.Stat(snapshotFilePath(dir))
+		So(err, ShouldBeNil)
+
+		// The snapshot is uploaded on its own when the session is completed.
+		backend.failSnapshots = false
+		So(u.UploadSnapshot(context.Background(), dir, &sessionInfo{ID: filepath.Base(dir)}), ShouldBeNil)
+		So(backend.name, ShouldEqual, filepath.Base(dir)+".snapshot.json.enc")
+		_, err = os.Stat(snapshotFilePath(dir))
+		So(errors.Is(err, os.ErrNotExist), ShouldBeTrue)
+	})
+}
@@ -8,9 +8,11 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 
 	"golang.org/x/sync/semaphore"
 )
@@ -52,22 +54,53 @@ func (a *bagQueue) Pop() interface{} {
 	return item
 }
 
-var globRegex = func() *regexp.Regexp {
+// bagExtensionsPattern returns a regular expression matching any sequence of
+// extensions in validBagExtensions.
+func bagExtensionsPattern() string {
+	return extensionsPattern(validBagExtensions) + `*`
+}
+
+// storageExtensionsPattern returns a regular expression matching the extension
+// of any storage format.
+func storageExtensionsPattern() string {
+	exts := make([]string, 0, len(storageExtensions))
+	for _, ext := range storageExtensions {
+		exts = append(exts, ext)
+	}
+	sort.Strings(exts)
+	return extensionsPattern(exts)
+}
+
+func extensionsPattern(exts []string) string {
 	var b strings.Builder
-	b.WriteString(`^/.+\.db3(`)
-	for i, ext := range validBagExtensions {
+	b.WriteString(`(?:`)
+	for i, ext := range exts {
 		if i > 0 {
 			b.WriteByte('|')
 		}
 		b.WriteString(regexp.QuoteMeta(ext))
 	}
-	b.WriteString(`)?$`)
-	return regexp.MustCompile(b.String())
-}()
+	b.WriteString(`)`)
+	return b.String()
+}
+
+var globRegex = regexp.MustCompile(`^/.+` + storageExtensionsPattern() + bagExtensionsPattern() + `$`)
+
+// bagFileRegex matches the names of bag files.
+var bagFileRegex = regexp.MustCompile(`^.+` + storageExtensionsPattern() + bagExtensionsPattern() + `$`)
 
 type uploaderInterface interface {
 	UploadBag(context.Context, *bagMetadata) error
-	WithCompression(compressionMode) uploaderInterface
+	WithCompression(compressionMode, int) uploaderInterface
+	CompleteSession(context.Context, *sessionInfo) error
+	UploadSnapshot(context.Context, string, *sessionInfo) error
+}
+
+// bagProcessor processes a completed bag before it is queued for upload.
+// Processors are run again for bags loaded from disk, so ProcessBag must skip
+// bags it has already processed.
+type bagProcessor interface {
+	ProcessBag(context.Context, *bagMetadata) error
 }
 
 type uploadManager struct {
@@ -80,6 +113,28 @@ type uploadManager struct {
 	uploader uploaderInterface
 	// +checklocks:mutex
 	queue bagQueue
+	// +checklocks:mutex
+	queueStopped bool
+	// +checklocks:mutex
+	paused bool
+	// held is set by the operator independently of paused, so that resuming
+	// deferred uploads doesn't override the operator and vice versa.
+	// +checklocks:mutex
+	held bool
+	// Bags being uploaded mapped to the time their upload started.
+	// +checklocks:mutex
+	uploading map[*bagMetadata]time.Time
+	// Bags whose upload failed. They are uploaded again when RetryFailed is
+	// called or the program is restarted.
+	// +checklocks:mutex
+	failed []*bagMetadata
+	// +checklocks:mutex
+	history []uploadRecord
+
+	processors []bagProcessor
+
+	// Prevents the completion of a session from being sent twice.
+	sessionMutex sync.Mutex
 
 	logger logger
 	wg     sync.WaitGroup
@@ -87,25 +142,52 @@ type uploadManager struct {
 	diagnostics *diagnosticsMonitor
 }
 
-func newUploadManager(workerCount int, uploader uploaderInterface, logger logger, diagnostics *diagnosticsMonitor) *uploadManager {
+func newUploadManager(
+	workerCount int,
+	uploader uploaderInterface,
+	logger logger,
+	diagnostics *diagnosticsMonitor,
+	processors ...bagProcessor,
+) *uploadManager {
 	return &uploadManager{
 		workerCount:    semaphore.NewWeighted(int64(workerCount)),
 		maxWorkerCount: workerCount,
 		uploader:       uploader,
+		uploading:      make(map[*bagMetadata]time.Time),
+		processors:     processors,
 		logger:         logger,
 		diagnostics:    diagnostics,
 	}
 }
 
-func (m *uploadManager) LoadExistingBags(dir string) error {
+func (m *uploadManager) LoadExistingBags(ctx context.Context, dir string) error {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
+	// An interrupted processor may leave several versions of a bag on disk.
+	// The least processed one is kept since it is the only one guaranteed to
+	// be complete. Processing it again replaces the others.
+	bags := make(map[string]*bagMetadata)
+	sessions := make(map[string]bool)
 	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
 			m.logger.Errorf(`error during loading existing bags: failed to access "%s": %v`, dir, err)
+		} else if d.IsDir() && path == filepath.Join(dir, quarantineDirName) {
+			return filepath.SkipDir
+		} else if d.Name() == sessionFileName || d.Name() == snapshotFileName {
+			sessions[filepath.Dir(path)] = true
+		} else if bag := newLogArchiveMetadata(path, false); bag != nil && !d.IsDir() {
+			if prev := bags[bag.path]; prev == nil || len(bag.ext) < len(prev.ext) {
+				bags[bag.path] = bag
+			}
+		} else if bag := newArtifactMetadata(path, false); bag != nil && !d.IsDir() {
+			if prev := bags[bag.path]; prev == nil || len(bag.ext) < len(prev.ext) {
+				bags[bag.path] = bag
+			}
 		} else if globRegex.MatchString(path[len(dir):]) {
 			if bag := newBagMetadata(path, 0, false); bag != nil {
-				m.queue = append(m.queue, bag) // +checklocksignore
+				if prev := bags[bag.path]; prev == nil || len(bag.ext) < len(prev.ext) {
+					bags[bag.path] = bag
+				}
 			}
 		}
 		return nil
@@ -113,16 +195,90 @@ func (m *uploadManager) LoadExistingBags(dir string) error {
 	if err != nil {
 		return err
 	}
+	m.endInterruptedSessions(bags, sessions)
+	for sessionDir := range sessions {
+		m.wg.Add(1)
+		go func(dir string, uploader uploaderInterface) {
+			defer m.wg.Done()
+			m.completeSession(ctx, uploader, dir)
+		}(sessionDir, m.uploader)
+	}
+	for _, bag := range bags {
+		if len(m.processors) == 0 {
+			m.queue = append(m.queue, bag)
+		} else {
+			m.wg.Add(1)
+			go func(bag *bagMetadata) {
+				defer m.wg.Done()
+				m.AddBag(ctx, bag)
+			}(bag)
+		}
+	}
 	heap.Init(&m.queue)
 	return nil
 }
 
-func (m *uploadManager) SetConfig(workerCount int, mode compressionMode) {
+// endInterruptedSessions ends the sessions of bags which were recorded by a
+// previous run of the program that didn't stop the recorder properly. The last
+// bag of a session is never uploaded before the session has ended, so it is
+// the bag with the largest number. Sessions without bags are removed. Log
+// archives are not bags of their sessions and artifacts don't belong to
+// sessions.
+func (m *uploadManager) endInterruptedSessions(bags map[string]*bagMetadata, sessions map[string]bool) {
+	lastBags := make(map[string]int)
+	for _, bag := range bags {
+		if bag.logArchive || bag.artifact {
+			continue
+		}
+		dir := sessionDir(bag)
+		if n, ok := lastBags[dir]; !ok || n < bag.number {
+			lastBags[dir] = bag.number
+		}
+	}
+	for dir := range sessions {
+		if _, ok := lastBags[dir]; !ok {
+			lastBags[dir] = -1
+		}
+	}
+	for dir, last := range lastBags {
+		session, err := loadSession(dir)
+		if err != nil {
+			m.logger.Errorf("failed to load session '%s': %v", dir, err)
+			continue
+		}
+		if session != nil && session.ended() {
+			continue
+		}
+		if last < 0 {
+			if err = os.Remove(sessionFilePath(dir)); err != nil && !errors.Is(err, os.ErrNotExist) {
+				m.logger.Errorf("failed to remove '%s': %v", sessionFilePath(dir), err)
+			}
+			if err = removeSnapshot(dir); err != nil {
+				m.logger.Errorf("failed to remove '%s': %v", snapshotFilePath(dir), err)
+			}
+			m.removeSessionStart(dir)
+			m.removeDirIfEmpty(dir)
+			delete(sessions, dir)
+			continue
+		}
+		if session == nil {
+			session = &sessionInfo{ID: filepath.Base(dir)}
+		}
+		session.SplitCount = last + 1
+		if err = saveSession(dir, session); err != nil {
+			m.logger.Errorf("failed to save session '%s': %v", dir, err)
+			continue
+		}
+		sessions[dir] = true
+	}
+}
+
+func (m *uploadManager) SetConfig(workerCount int, mode compressionMode, level int) {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 	m.workerCount = semaphore.NewWeighted(int64(workerCount))
 	m.maxWorkerCount = workerCount
-	m.uploader = m.uploader.WithCompression(mode)
+	m.uploader = m.uploader.WithCompression(mode, level)
 }
 
 func (m *uploadManager) StartWorker(ctx context.Context) {
@@ -134,31 +290,52 @@ func (m *uploadManager) StartWorker(ctx context.Context) {
 
 func (m *uploadManager) uploadNextBag(ctx context.Context) {
 	defer m.wg.Done()
+	// The worker keeps uploading until the queue is empty so that bags added
+	// while all workers were busy are not left waiting for the next AddBag.
+	for ctx.Err() == nil {
+		if !m.uploadBag(ctx) {
+			return
+		}
+	}
+}
+
+func (m *uploadManager) uploadBag(ctx context.Context) (uploaded bool) {
 	bag, uploader, release := func() (*bagMetadata, uploaderInterface, func(int64)) {
 		m.mutex.Lock()
 		defer m.mutex.Unlock()
-		if !m.workerCount.TryAcquire(1) {
+		if m.queueStopped || m.paused || m.held || !m.workerCount.TryAcquire(1) {
 			return nil, nil, func(i int64) {}
 		}
-		return m.nextBag(), m.uploader, m.workerCount.Release
+		bag := m.nextBag()
+		if bag != nil {
+			m.uploading[bag] = time.Now()
+		}
+		return bag, m.uploader, m.workerCount.Release
 	}()
 	defer release(1)
 	if bag == nil {
-		return
+		return false
 	}
 	m.logger.Infof("bag '%s' is ready", bag.path)
+	size := fileSize(bag.filePath())
 	err := uploader.UploadBag(ctx, bag)
+	m.finishUpload(ctx, bag, size, err)
 	if err == nil {
 		m.logger.Infof("bag '%s' uploaded successfully", bag.path)
 		m.diagnostics.ReportSuccess("bag uploader", "ok")
 		m.removeBagFiles(bag)
+		m.completeSession(ctx, uploader, sessionDir(bag))
+	} else if ctx.Err() != nil {
+		m.logger.Infof("upload of bag '%s' was interrupted, it will be uploaded on the next start", bag.path)
 	} else {
 		m.logger.Errorf("failed to upload bag '%s': %v", bag.path, err)
 		m.diagnostics.ReportError("bag uploader", "failing: ", err)
 		if errors.Is(err, errEmptyBag) {
 			m.removeBagFiles(bag)
+			m.completeSession(ctx, uploader, sessionDir(bag))
 		}
 	}
+	return true
 }
 
 func (m *uploadManager) StartAllWorkers(ctx context.Context) {
@@ -169,6 +346,70 @@ func (m *uploadManager) StartAllWorkers(ctx context.Context) {
 	}
 }
 
+// StopQueue prevents workers from starting new uploads. Uploads in progress
+// are not affected. Queued bags are left in the destination directory.
+func (m *uploadManager) StopQueue() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.queueStopped = true
+}
+
+// PauseUploads prevents workers from starting new uploads until ResumeUploads
+// is called. Uploads in progress are not affected.
+func (m *uploadManager) PauseUploads() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.paused = true
+}
+
+func (m *uploadManager) ResumeUploads(ctx context.Context) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if !m.paused {
+		return
+	}
+	m.paused = false
+	for i := 0; i < m.maxWorkerCount; i++ {
+		m.StartWorker(ctx)
+	}
+}
+
+// HoldUploads prevents workers from starting new uploads until
+// ReleaseUploads is called. Uploads in progress are not affected.
+func (m *uploadManager) HoldUploads() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.held = true
+}
+
+func (m *uploadManager) ReleaseUploads(ctx context.Context) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if !m.held {
+		return
+	}
+	m.held = false
+	for i := 0; i < m.maxWorkerCount; i++ {
+		m.StartWorker(ctx)
+	}
+}
+
+// RetryFailed queues the bags whose upload failed again and returns their
+// number.
+func (m *uploadManager) RetryFailed(ctx context.Context) int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	failed := m.failed
+	m.failed = nil
+	for _, bag := range failed {
+		heap.Push(&m.queue, bag)
+	}
+	for i := 0; i < len(failed) && i < m.maxWorkerCount; i++ {
+		m.StartWorker(ctx)
+	}
+	return len(failed)
+}
+
 func (m *uploadManager) Wait() {
 	m.wg.Wait()
 }
@@ -189,21 +430,124 @@ func (m *uploadManager) removeBagFiles(bag *bagMetadata) {
 	if err = os.Remove(metadataFile); err != nil && !errors.Is(err, os.ErrNotExist) {
 		m.logger.Errorf("failed to remove '%s': %v", metadataFile, err)
 	}
-	err = os.Remove(bagDir)
+	m.removeDirIfEmpty(bagDir)
+}
+
+func (m *uploadManager) removeDirIfEmpty(dir string) {
+	err := os.Remove(dir)
 	if err != nil &&
+		!errors.Is(err, os.ErrNotExist) &&
 		!errors.Is(err, syscall.ENOTEMPTY) &&
 		!errors.Is(err, syscall.EEXIST) {
-		m.logger.Errorf("failed to remove '%s': %v", bagDir, err)
+		m.logger.Errorf("failed to remove '%s': %v", dir, err)
+	}
+}
+
+// completeSession notifies the backend that the session in dir is complete if
+// the recorder has stopped and all bags of the session have been uploaded. If
+// the notification fails, it is sent again when the program is restarted.
+func (m *uploadManager) completeSession(ctx context.Context, uploader uploaderInterface, dir string) {
+	m.sessionMutex.Lock()
+	defer m.sessionMutex.Unlock()
+	session, err := loadSession(dir)
+	if err == nil && (session == nil || !session.ended()) {
+		return
+	}
+	if err == nil {
+		var hasBags bool
+		if hasBags, err = sessionHasBags(dir); err == nil && hasBags {
+			return
+		}
+	}
+	if err == nil {
+		err = uploader.UploadSnapshot(ctx, dir, session)
+	}
+	if err == nil {
+		err = uploader.CompleteSession(ctx, session)
+	}
+	if err != nil {
+		if ctx.Err() == nil {
+			m.logger.Errorf("failed to complete session '%s': %v", dir, err)
+			m.diagnostics.ReportError("bag uploader", "failing: ", err)
+		}
+		return
+	}
+	m.logger.Infof("session '%s' completed", dir)
+	if err = os.Remove(sessionFilePath(dir)); err != nil {
+		m.logger.Errorf("failed to remove '%s': %v", sessionFilePath(dir), err)
+	}
+	m.removeSessionStart(dir)
+	m.removeDirIfEmpty(dir)
+}
+
+func (m *uploadManager) removeSessionStart(dir string) {
+	path := filepath.Join(dir, sessionStartFileName)
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		m.logger.Errorf("failed to remove '%s': %v", path, err)
 	}
 }
 
 func (m *uploadManager) AddBag(ctx context.Context, bag *bagMetadata) {
+	if !m.processBag(ctx, bag) {
+		m.mutex.Lock()
+		uploader := m.uploader
+		m.mutex.Unlock()
+		m.completeSession(ctx, uploader, sessionDir(bag))
+		return
+	}
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 	heap.Push(&m.queue, bag)
 	m.StartWorker(ctx)
 }
 
+// processBag runs the processors for bag. If a processor fails, the bag is
+// queued as it is so that it can still be uploaded, unless the processor
+// removed the bag. Returns true if the bag should be queued.
+func (m *uploadManager) processBag(ctx context.Context, bag *bagMetadata) bool {
+	if m.removeEmptyBag(ctx, bag) {
+		return false
+	}
+	for _, p := range m.processors {
+		if err := p.ProcessBag(ctx, bag); err != nil {
+			m.logger.Errorf("failed to process bag '%s': %v", bag.filePath(), err)
+			if errors.Is(err, errBagRemoved) {
+				return false
+			}
+			m.diagnostics.ReportError("bag processor", "failing: ", err)
+			return true
+		}
+	}
+	return true
+}
+
+// removeEmptyBag removes bag and returns true if it is a bag without messages.
+// Empty bags are removed before they are queued so that the bags left in a
+// session directory are the ones which will be uploaded. The start time of
+// other bags is stored in their manifests so that it isn't read again.
+func (m *uploadManager) removeEmptyBag(ctx context.Context, bag *bagMetadata) bool {
+	if bag.logArchive || bag.artifact || (bag.ext != "" && bag.ext != recorderCompressedBagExtension) {
+		return false
+	}
+	manifest, err := loadBagManifest(bag)
+	if err != nil || !manifest.RecordStartTime.IsZero() {
+		return false
+	}
+	manifest.RecordStartTime, err = getRecordStartTime(ctx, bag.filePath())
+	if errors.Is(err, errEmptyBag) {
+		m.logger.Infof("bag '%s' is empty, removing it", bag.path)
+		m.removeBagFiles(bag)
+		return true
+	} else if err != nil {
+		// The error is reported when the bag is processed or uploaded.
+		return false
+	}
+	if err = saveBagManifest(bag, manifest); err != nil {
+		m.logger.Errorf("failed to save manifest of bag '%s': %v", bag.path, err)
+	}
+	return false
+}
+
 // +checklocks:m.mutex
 func (m *uploadManager) nextBag() *bagMetadata {
 	if len(m.queue) == 0 {
@@ -217,3 +561,127 @@ func (m *uploadManager) nextBag() *bagMetadata {
 	}
 	return bag
 }
+
+// uploadHistoryLength is the number of uploads kept in the upload history.
+const uploadHistoryLength = 100
+
+// uploadRecord describes a finished upload.
+type uploadRecord struct {
+	Path     string        `json:"path"`
+	Kind     string        `json:"kind"`
+	Size     int64         `json:"size"`
+	Started  time.Time     `json:"started"`
+	Duration time.Duration `json:"duration"`
+	Error    string        `json:"error,omitempty"`
+}
+
+const (
+	bagStateQueued    = "queued"
+	bagStateUploading = "uploading"
+	bagStateFailed    = "failed"
+)
+
+// queuedBag describes a bag waiting to be uploaded.
+type queuedBag struct {
+	Path  string `json:"path"`
+	Kind  string `json:"kind"`
+	Size  int64  `json:"size"`
+	State string `json:"state"`
+	// Started is set for bags being uploaded.
+	Started *time.Time `json:"started,omitempty"`
+}
+
+// finishUpload records the result of the upload of bag which was size bytes
+// large.
+func (m *uploadManager) finishUpload(ctx context.Context, bag *bagMetadata, size int64, err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	started := m.uploading[bag]
+	delete(m.uploading, bag)
+	// Interrupted uploads are continued on the next start.
+	if err != nil && ctx.Err() != nil {
+		return
+	}
+	record := uploadRecord{
+		Path:     bag.filePath(),
+		Kind:     bagKind(bag),
+		Size:     size,
+		Started:  started,
+		Duration: time.Since(started),
+	}
+	if err != nil {
+		record.Error = err.Error()
+		if !errors.Is(err, errEmptyBag) {
+			m.failed = append(m.failed, bag)
+		}
+	}
+	m.history = append(m.history, record)
+	if len(m.history) > uploadHistoryLength {
+		m.history = m.history[len(m.history)-uploadHistoryLength:]
+	}
+}
+
+// Queue returns the bags being uploaded followed by the queued bags and the
+// bags whose upload failed.
+func (m *uploadManager) Queue() []queuedBag {
+	m.mutex.Lock()
+	bags := make([]queuedBag, 0, len(m.uploading)+len(m.queue)+len(m.failed))
+	for bag, started := range m.uploading {
+		started := started
+		bags = append(bags, newQueuedBag(bag, bagStateUploading))
+		bags[len(bags)-1].Started = &started
+	}
+	sort.Slice(bags, func(i, j int) bool { return bags[i].Started.Before(*bags[j].Started) })
+	queue := append(bagQueue(nil), m.queue...)
+	sort.Slice(queue, func(i, j int) bool { return queue.Less(i, j) })
+	for _, bag := range queue {
+		bags = append(bags, newQueuedBag(bag, bagStateQueued))
+	}
+	for _, bag := range m.failed {
+		bags = append(bags, newQueuedBag(bag, bagStateFailed))
+	}
+	m.mutex.Unlock()
+	for i := range bags {
+		bags[i].Size = fileSize(bags[i].Path)
+	}
+	return bags
+}
+
+func newQueuedBag(bag *bagMetadata, state string) queuedBag {
+	return queuedBag{Path: bag.filePath(), Kind: bagKind(bag), State: state}
+}
+
+func bagKind(bag *bagMetadata) string {
+	switch {
+	case bag.logArchive:
+		return "logs"
+	case bag.artifact:
+		return "artifact"
+	default:
+		return "bag"
+	}
+}
+
+// History returns the most recent uploads, oldest first.
+func (m *uploadManager) History() []uploadRecord {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return append([]uploadRecord(nil), m.history...)
+}
+
+// UploadState reports whether uploads are paused because of a mission and
+// whether they are held by the operator.
+func (m *uploadManager) UploadState() (paused, held bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.paused, m.held
+}
+
+// fileSize returns the size of the file at path or -1 if it can't be read.
+func fileSize(path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		return -1
+	}
+	return info.Size()
+}
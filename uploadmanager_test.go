@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"database/sql"
 	"fmt"
 	"math/rand"
 	"sync"
@@ -19,11 +20,19 @@ type fakeUploader struct {
 	mutex    sync.Mutex
 }
 
-func (u *fakeUploader) WithCompression(mode compressionMode) uploaderInterface {
-	u.t.Log("compression mode set to", mode)
+func (u *fakeUploader) WithCompression(mode compressionMode, level int) uploaderInterface {
+	u.t.Log("compression mode set to", mode, "level", level)
 	return u
 }
 
+func (u *fakeUploader) CompleteSession(ctx context.Context, session *sessionInfo) error {
+	return nil
+}
+
+func (u *fakeUploader) UploadSnapshot(ctx context.Context, dir string, session *sessionInfo) error {
+	return nil
+}
+
 func (u *fakeUploader) UploadBag(ctx context.Context, bag *bagMetadata) error {
 	time.Sleep(500 * time.Millisecond)
 	u.mutex.Lock()
@@ -35,9 +44,34 @@ func (u *fakeUploader) UploadBag(ctx context.Context, bag *bagMetadata) error {
 	return nil
 }
 
+// createTestBag creates a minimal rosbag2 SQLite database containing a message
+// for each timestamp.
+func createTestBag(t *testing.T, path string, timestamps ...int64) {
+	t.Helper()
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	_, err = db.Exec(`
+		CREATE TABLE topics(id INTEGER PRIMARY KEY, name TEXT NOT NULL, type TEXT NOT NULL, serialization_format TEXT NOT NULL, offered_qos_profiles TEXT NOT NULL);
+		CREATE TABLE messages(id INTEGER PRIMARY KEY, topic_id INTEGER NOT NULL, timestamp INTEGER NOT NULL, data BLOB NOT NULL);
+		INSERT INTO topics VALUES(1, '/test', 'std_msgs/msg/String', 'cdr', '');
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ts := range timestamps {
+		if _, err = db.Exec(`INSERT INTO messages(topic_id, timestamp, data) VALUES(1, ?, x'00010000')`, ts); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
 type fakeLogger struct{}
 
 func (l fakeLogger) Infof(string, ...interface{}) error  { return nil }
+func (l fakeLogger) Warnf(string, ...interface{}) error  { return nil }
 func (l fakeLogger) Errorf(string, ...interface{}) error { return nil }
 func (l fakeLogger) Errorln(...interface{}) error        { return nil }
 